@@ -0,0 +1,105 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// AccessTimedKVStore wraps a KVStore and records the time of the last read of each key via Get.
+// This supports sizing and tuning LRU value caches. At most maxKeys keys are tracked; when a new key
+// is read while the map is full, the least recently read key is dropped.
+// The store is safe to be shared between contract calls.
+type AccessTimedKVStore struct {
+	parent  KVStore
+	maxKeys int
+
+	mtx        sync.Mutex
+	lastAccess map[string]time.Time
+}
+
+var _ KVStore = (*AccessTimedKVStore)(nil)
+
+func NewAccessTimedKVStore(parent KVStore, maxKeys int) *AccessTimedKVStore {
+	return &AccessTimedKVStore{
+		parent:     parent,
+		maxKeys:    maxKeys,
+		lastAccess: make(map[string]time.Time),
+	}
+}
+
+// LastAccess returns the time of the last read of the given key, if it is tracked
+func (s *AccessTimedKVStore) LastAccess(key []byte) (time.Time, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	t, ok := s.lastAccess[string(key)]
+	return t, ok
+}
+
+// KeysByLastAccess returns the tracked keys ordered from the least to the most recently read.
+// Keys read at the same time are ordered bytewise.
+func (s *AccessTimedKVStore) KeysByLastAccess() [][]byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	keys := make([]string, 0, len(s.lastAccess))
+	for key := range s.lastAccess {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, tj := s.lastAccess[keys[i]], s.lastAccess[keys[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return keys[i] < keys[j]
+	})
+	out := make([][]byte, len(keys))
+	for i, key := range keys {
+		out[i] = []byte(key)
+	}
+	return out
+}
+
+func (s *AccessTimedKVStore) recordAccess(key []byte) {
+	now := nowFunc()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.lastAccess[string(key)]; !ok && len(s.lastAccess) >= s.maxKeys {
+		if s.maxKeys <= 0 {
+			return
+		}
+		// evict the least recently read key
+		var oldestKey string
+		var oldest time.Time
+		first := true
+		for k, t := range s.lastAccess {
+			if first || t.Before(oldest) || (t.Equal(oldest) && k < oldestKey) {
+				oldestKey, oldest, first = k, t, false
+			}
+		}
+		delete(s.lastAccess, oldestKey)
+	}
+	s.lastAccess[string(key)] = now
+}
+
+func (s *AccessTimedKVStore) Get(key []byte) []byte {
+	s.recordAccess(key)
+	return s.parent.Get(key)
+}
+
+func (s *AccessTimedKVStore) Set(key, value []byte) {
+	s.parent.Set(key, value)
+}
+
+func (s *AccessTimedKVStore) Delete(key []byte) {
+	s.parent.Delete(key)
+}
+
+func (s *AccessTimedKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.parent.Iterator(start, end)
+}
+
+func (s *AccessTimedKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.parent.ReverseIterator(start, end)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessTimedKVStore(t *testing.T) {
+	clock := useFakeClock(t)
+	start := clock.Now()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		parent.Set([]byte(key), []byte("value-"+key))
+	}
+	store := NewAccessTimedKVStore(parent, 3)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	read := func(key string) {
+		value, _, _, ret := db.get([]byte(key))
+		require.Equal(t, goErrorNone, ret)
+		require.Equal(t, parent.Get([]byte(key)), value)
+		clock.Advance(time.Second)
+	}
+	read("b")
+	read("a")
+	read("c")
+	read("b")
+	require.Equal(t, [][]byte{[]byte("a"), []byte("c"), []byte("b")}, store.KeysByLastAccess())
+
+	last, ok := store.LastAccess([]byte("b"))
+	require.True(t, ok)
+	require.Equal(t, start.Add(3*time.Second), last)
+
+	// a new key evicts the least recently read one
+	read("d")
+	require.Equal(t, [][]byte{[]byte("c"), []byte("b"), []byte("d")}, store.KeysByLastAccess())
+	_, ok = store.LastAccess([]byte("a"))
+	require.False(t, ok)
+
+	// missing keys are tracked too
+	read("missing")
+	require.Equal(t, [][]byte{[]byte("b"), []byte("d"), []byte("missing")}, store.KeysByLastAccess())
+
+	// writes are tracked since cSet reads the key to check for existence
+	_, _, ret := db.set([]byte("e"), []byte("value-e"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, [][]byte{[]byte("d"), []byte("missing"), []byte("e")}, store.KeysByLastAccess())
+}
@@ -45,3 +45,26 @@ func TestValidateAddressFailure(t *testing.T) {
 	// with this error
 	require.Equal(t, "Generic error: addr_validate errored: human encoding too long", result.Err)
 }
+
+func TestDefaultTestGoAPI(t *testing.T) {
+	api := DefaultTestGoAPI()
+
+	for _, human := range []string{"a", "foobar", "link1qyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqszqgpqyqs2ptg5m"} {
+		canon, cost, err := api.CanonicalAddress(human)
+		require.NoError(t, err)
+		require.Equal(t, CostCanonical, cost)
+		require.Equal(t, []byte(human), canon)
+
+		roundTrip, cost, err := api.HumanAddress(canon)
+		require.NoError(t, err)
+		require.Equal(t, CostHuman, cost)
+		require.Equal(t, human, roundTrip)
+	}
+
+	_, _, err := api.CanonicalAddress("")
+	require.EqualError(t, err, "empty human address")
+	_, _, err = api.HumanAddress(nil)
+	require.EqualError(t, err, "empty canonical address")
+	_, _, err = api.HumanAddress([]byte{})
+	require.EqualError(t, err, "empty canonical address")
+}
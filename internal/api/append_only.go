@@ -0,0 +1,33 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// AppendOnlyGuard enforces that cSet writes keys under Prefix in strictly ascending order
+// within a contract call. This is meant for contracts implementing append-only logs.
+type AppendOnlyGuard struct {
+	Prefix []byte
+}
+
+// AppendOnlyWrites enables the append-only check of cSet for one key prefix.
+// Out-of-order writes are rejected with a user error. Set to nil to disable (the default).
+var AppendOnlyWrites *AppendOnlyGuard
+
+// check returns an error if key is under the guarded prefix and not greater than the last key
+// written under this prefix in the given call. Otherwise key is remembered as the last key.
+func (g *AppendOnlyGuard) check(callID uint64, key []byte) error {
+	if !bytes.HasPrefix(key, g.Prefix) {
+		return nil
+	}
+	var err error
+	withCallState(callID, func(state *callState) {
+		if state.lastAppendKey != nil && bytes.Compare(key, state.lastAppendKey) <= 0 {
+			err = fmt.Errorf("Append-only violation: key %X must be greater than the previous key %X", key, state.lastAppendKey)
+			return
+		}
+		state.lastAppendKey = cloneBytes(key)
+	})
+	return err
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendOnlyGuard(t *testing.T) {
+	AppendOnlyWrites = &AppendOnlyGuard{Prefix: []byte("log/")}
+	defer func() { AppendOnlyWrites = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// in order
+	for _, key := range []string{"log/001", "log/002", "log/010"} {
+		_, errMsg, ret := db.set([]byte(key), []byte("entry"))
+		require.Equal(t, goErrorNone, ret)
+		require.Empty(t, errMsg)
+	}
+
+	// out of order and repeated keys are rejected
+	for _, key := range []string{"log/005", "log/010"} {
+		_, errMsg, ret := db.set([]byte(key), []byte("entry"))
+		require.Equal(t, goErrorUser, ret)
+		require.Contains(t, errMsg, "Append-only violation")
+	}
+	require.Nil(t, store.Get([]byte("log/005")))
+
+	// keys outside of the prefix are not affected
+	for _, key := range []string{"other/b", "other/a"} {
+		_, _, ret := db.set([]byte(key), []byte("value"))
+		require.Equal(t, goErrorNone, ret)
+	}
+
+	// a rejected write does not move the last key
+	_, _, ret := db.set([]byte("log/011"), []byte("entry"))
+	require.Equal(t, goErrorNone, ret)
+
+	// other calls track their own last key
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	other := newTestDB(store, gasMeter, otherCallID)
+	_, _, ret = other.set([]byte("log/001"), []byte("entry"))
+	require.Equal(t, goErrorNone, ret)
+}
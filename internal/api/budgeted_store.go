@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// BudgetedKVStore wraps a KVStore and limits the total number of bytes (keys plus values) written through it.
+// A write that would exceed the budget is not executed and panics with a KVStoreError, which is returned
+// to the contract as an error by the DB callbacks. This bounds state growth per execution independently of gas.
+// Create one BudgetedKVStore per contract call.
+type BudgetedKVStore struct {
+	parent  KVStore
+	budget  uint64
+	written uint64
+}
+
+var _ KVStore = (*BudgetedKVStore)(nil)
+
+func NewBudgetedKVStore(parent KVStore, maxWriteBytes uint64) *BudgetedKVStore {
+	return &BudgetedKVStore{
+		parent: parent,
+		budget: maxWriteBytes,
+	}
+}
+
+// Written returns the number of bytes written so far
+func (s *BudgetedKVStore) Written() uint64 {
+	return s.written
+}
+
+func (s *BudgetedKVStore) Get(key []byte) []byte {
+	return s.parent.Get(key)
+}
+
+func (s *BudgetedKVStore) Set(key, value []byte) {
+	size := uint64(len(key)) + uint64(len(value))
+	if size > s.budget-s.written {
+		panic(KVStoreError{Msg: fmt.Sprintf("write budget exhausted: writing %d bytes exceeds the remaining %d of %d bytes", size, s.budget-s.written, s.budget)})
+	}
+	s.parent.Set(key, value)
+	s.written += size
+}
+
+func (s *BudgetedKVStore) Delete(key []byte) {
+	s.parent.Delete(key)
+}
+
+func (s *BudgetedKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.parent.Iterator(start, end)
+}
+
+func (s *BudgetedKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.parent.ReverseIterator(start, end)
+}
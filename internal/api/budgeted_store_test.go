@@ -0,0 +1,52 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudgetedKVStore(t *testing.T) {
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	store := NewBudgetedKVStore(parent, 20)
+	db := newTestDB(store, gasMeter, callID)
+
+	// 3 + 7 bytes
+	_, _, ret := db.set([]byte("foo"), bytes.Repeat([]byte{0x01}, 7))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(10), store.Written())
+
+	// overwriting counts again, up to exactly the budget
+	_, _, ret = db.set([]byte("foo"), bytes.Repeat([]byte{0x02}, 7))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(20), store.Written())
+
+	// past the budget
+	_, errMsg, ret := db.set([]byte("bar"), []byte{})
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "write budget exhausted: writing 3 bytes exceeds the remaining 0 of 20 bytes", errMsg)
+	require.Nil(t, parent.Get([]byte("bar")))
+	require.Equal(t, uint64(20), store.Written())
+
+	// reads and deletes are still possible
+	value, _, _, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, bytes.Repeat([]byte{0x02}, 7), value)
+	_, _, ret = db.delete([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Nil(t, parent.Get([]byte("foo")))
+}
+
+func TestBudgetedKVStorePartialWrite(t *testing.T) {
+	store := NewBudgetedKVStore(NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT)), 10)
+	store.Set([]byte("a"), []byte("1234"))
+	require.PanicsWithValue(t, KVStoreError{Msg: "write budget exhausted: writing 6 bytes exceeds the remaining 5 of 10 bytes"}, func() {
+		store.Set([]byte("b"), []byte("12345"))
+	})
+	store.Set([]byte("b"), []byte("1234"))
+	require.Equal(t, uint64(10), store.Written())
+}
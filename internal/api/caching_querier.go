@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/Finschia/wasmvm/types"
+)
+
+// CachingQuerier is a Querier decorator that memoizes successful responses by request within a contract call.
+// Repeated identical requests are answered from the cache without calling the wrapped querier again,
+// so gas is only charged for the first request. Errors are not cached.
+//
+// The cache is reset when the contract call using this querier ends. Use one CachingQuerier per call.
+type CachingQuerier struct {
+	inner Querier
+	mutex sync.Mutex
+	cache map[string][]byte
+}
+
+var _ Querier = (*CachingQuerier)(nil)
+
+func NewCachingQuerier(inner Querier) *CachingQuerier {
+	return &CachingQuerier{
+		inner: inner,
+		cache: make(map[string][]byte),
+	}
+}
+
+func (q *CachingQuerier) Query(request types.QueryRequest, gasLimit uint64) ([]byte, error) {
+	key, err := json.Marshal(request)
+	if err != nil {
+		return q.inner.Query(request, gasLimit)
+	}
+
+	q.mutex.Lock()
+	res, ok := q.cache[string(key)]
+	q.mutex.Unlock()
+	if ok {
+		return res, nil
+	}
+
+	res, err = q.inner.Query(request, gasLimit)
+	if err != nil {
+		return nil, err
+	}
+	q.mutex.Lock()
+	q.cache[string(key)] = res
+	q.mutex.Unlock()
+	return res, nil
+}
+
+func (q *CachingQuerier) GasConsumed() uint64 {
+	return q.inner.GasConsumed()
+}
+
+// Reset removes all cached responses
+func (q *CachingQuerier) Reset() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.cache = make(map[string][]byte)
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingQuerier(t *testing.T) {
+	inner := &meteredQuerier{response: []byte(`{"amount":"100"}`)}
+	querier := NewCachingQuerier(inner)
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+
+	balanceRequest := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+	otherRequest := []byte(`{"bank":{"balance":{"address":"foo","denom":"baz"}}}`)
+
+	// miss
+	res, gas, _, ret := query(&state, 50000, balanceRequest)
+	require.Equal(t, goErrorNone, ret)
+	require.Greater(t, gas, uint64(0))
+	require.Len(t, inner.gasLimits, 1)
+	firstGas := gas
+
+	// hit
+	cached, gas, _, ret := query(&state, 50000, balanceRequest)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(0), gas)
+	require.Equal(t, res, cached)
+	require.Len(t, inner.gasLimits, 1)
+
+	// different request
+	_, gas, _, ret = query(&state, 50000, otherRequest)
+	require.Equal(t, goErrorNone, ret)
+	require.Greater(t, gas, uint64(0))
+	require.Len(t, inner.gasLimits, 2)
+
+	// the cache is reset at the end of the call
+	endCall(state.CallID)
+	state = buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+	_, gas, _, ret = query(&state, 50000, balanceRequest)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, firstGas, gas)
+	require.Len(t, inner.gasLimits, 3)
+}
@@ -37,8 +37,10 @@ import "C"
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"reflect"
 	"runtime/debug"
 	"unsafe"
@@ -53,42 +55,113 @@ import (
 
 func recoverPanic(ret *C.GoError) {
 	if rec := recover(); rec != nil {
-		// This is used to handle ErrorOutOfGas panics.
-		//
-		// What we do here is something that should not be done in the first place.
-		// "A panic typically means something went unexpectedly wrong. Mostly we use it to fail fast
-		// on errors that shouldn’t occur during normal operation, or that we aren’t prepared to
-		// handle gracefully." says https://gobyexample.com/panic.
-		// And 'Ask yourself "when this happens, should the application immediately crash?" If yes,
-		// use a panic; otherwise, use an error.' says this popular answer on SO: https://stackoverflow.com/a/44505268.
-		// Oh, and "If you're already worrying about discriminating different kinds of panics, you've lost sight of the ball."
-		// (Rob Pike) from https://eli.thegreenplace.net/2018/on-the-uses-and-misuses-of-panics-in-go/
-		//
-		// We don't want to import Cosmos SDK and also cannot use interfaces to detect these
-		// error types (as they have no methods). So, let's just rely on the descriptive names.
-		name := reflect.TypeOf(rec).Name()
-		switch name {
-		// These three types are "thrown" (which is not a thing in Go 🙃) in panics from the gas module
-		// (https://github.com/Finschia/finschia-sdk/blob/main/store/types/gas.go):
-		// 1. ErrorOutOfGas
-		// 2. ErrorGasOverflow
-		// 3. ErrorNegativeGasConsumed
-		//
-		// In the baseapp, ErrorOutOfGas gets special treatment:
-		// - https://github.com/Finschia/finschia-sdk/blob/main/baseapp/baseapp.go#L647
-		// - https://github.com/Finschia/finschia-sdk/blob/main/baseapp/recovery.go#L50-L60
-		// This turns the panic into a regular error with a helpful error message.
-		//
-		// The other two gas related panic types indicate programming errors and are handled along
-		// with all other errors in https://github.com/Finschia/finschia-sdk/blob/main/baseapp/recovery.go#L66-L77.
-		case "ErrorOutOfGas":
-			// TODO: figure out how to pass the text in its `Descriptor` field through all the FFI
-			*ret = C.GoError_OutOfGas
-		default:
-			log.Printf("Panic in Go callback: %#v\n", rec)
-			debug.PrintStack()
-			*ret = C.GoError_Panic
+		handlePanic("Go callback", rec, ret)
+	}
+}
+
+// callbackError is an error returned from a function run by safeCallback in order to return a specific GoError
+type callbackError C.GoError
+
+func (e callbackError) Error() string {
+	return fmt.Sprintf("callback error %d", int(e))
+}
+
+// safeCallback runs the body of a callback and maps the result to a GoError. A nil error results in GoError_None,
+// a callbackError in its GoError and any other error in GoError_User. Callbacks must write the error message
+// for the contract to their errOut vector before returning an error. Panics are handled like in recoverPanic,
+// using name to identify the callback in logs.
+func safeCallback(name string, fn func() error) (ret C.GoError) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handlePanic(name, rec, &ret)
+		}
+	}()
+
+	err := fn()
+	if err == nil {
+		return C.GoError_None
+	}
+	var code callbackError
+	if errors.As(err, &code) {
+		return C.GoError(code)
+	}
+	return C.GoError_User
+}
+
+// KVStoreError can be used as a panic value by KVStore implementations in order to return an error
+// message to the contract from a DB callback, instead of failing with a generic panic error.
+type KVStoreError struct {
+	Msg string
+}
+
+var _ error = KVStoreError{}
+
+func (e KVStoreError) Error() string {
+	return e.Msg
+}
+
+// recoverStorePanic works like recoverPanic but turns KVStoreError panics into user errors
+func recoverStorePanic(ret *C.GoError, errOut *C.UnmanagedVector) {
+	if rec := recover(); rec != nil {
+		if storeErr, ok := rec.(KVStoreError); ok && errOut != nil && bool(errOut.is_none) {
+			*errOut = newUnmanagedVector([]byte(storeErr.Error()))
+			*ret = C.GoError_User
+			return
 		}
+		handlePanic("Go callback", rec, ret)
+	}
+}
+
+// PrintStackOnPanic makes handlePanic log the full panic value and a stack trace for unexpected panics
+// in callbacks. If false, only the type of the panic value is logged, which reduces log volume and
+// avoids leaking internal details in production logs. Defaults to true.
+var PrintStackOnPanic = true
+
+// printStack writes the stack trace of the current goroutine to stderr. It can be replaced in tests.
+var printStack = debug.PrintStack
+
+// handlePanic maps a recovered panic value to a GoError. callback identifies the panicking code in logs.
+func handlePanic(callback string, rec interface{}, ret *C.GoError) {
+	// This is used to handle ErrorOutOfGas panics.
+	//
+	// What we do here is something that should not be done in the first place.
+	// "A panic typically means something went unexpectedly wrong. Mostly we use it to fail fast
+	// on errors that shouldn’t occur during normal operation, or that we aren’t prepared to
+	// handle gracefully." says https://gobyexample.com/panic.
+	// And 'Ask yourself "when this happens, should the application immediately crash?" If yes,
+	// use a panic; otherwise, use an error.' says this popular answer on SO: https://stackoverflow.com/a/44505268.
+	// Oh, and "If you're already worrying about discriminating different kinds of panics, you've lost sight of the ball."
+	// (Rob Pike) from https://eli.thegreenplace.net/2018/on-the-uses-and-misuses-of-panics-in-go/
+	//
+	// We don't want to import Cosmos SDK and also cannot use interfaces to detect these
+	// error types (as they have no methods). So, let's just rely on the descriptive names.
+	name := reflect.TypeOf(rec).Name()
+	switch name {
+	// These three types are "thrown" (which is not a thing in Go 🙃) in panics from the gas module
+	// (https://github.com/Finschia/finschia-sdk/blob/main/store/types/gas.go):
+	// 1. ErrorOutOfGas
+	// 2. ErrorGasOverflow
+	// 3. ErrorNegativeGasConsumed
+	//
+	// In the baseapp, ErrorOutOfGas gets special treatment:
+	// - https://github.com/Finschia/finschia-sdk/blob/main/baseapp/baseapp.go#L647
+	// - https://github.com/Finschia/finschia-sdk/blob/main/baseapp/recovery.go#L50-L60
+	// This turns the panic into a regular error with a helpful error message.
+	//
+	// The other two gas related panic types indicate programming errors and are handled along
+	// with all other errors in https://github.com/Finschia/finschia-sdk/blob/main/baseapp/recovery.go#L66-L77.
+	case "ErrorOutOfGas":
+		// TODO: figure out how to pass the text in its `Descriptor` field through all the FFI
+		*ret = C.GoError_OutOfGas
+	default:
+		recordCallbackPanic()
+		if PrintStackOnPanic {
+			log.Printf("Panic in %s: %#v\n", callback, rec)
+			printStack()
+		} else {
+			log.Printf("Panic in %s: %T\n", callback, rec)
+		}
+		*ret = C.GoError_Panic
 	}
 }
 
@@ -100,6 +173,108 @@ type GasMeter interface {
 	GasConsumed() Gas
 }
 
+// LimitedGasMeter is a GasMeter that knows its limit, like the finschia-sdk GasMeter
+type LimitedGasMeter interface {
+	GasMeter
+	Limit() Gas
+}
+
+// GasSafetyMargin is an amount of gas the DB callbacks reserve. A store operation is only started
+// if more than this amount of gas is remaining. Otherwise the callback returns an out of gas error
+// without touching the store, such that a contract does not run out of gas in the middle of a store operation.
+// This only applies to gas meters implementing LimitedGasMeter. Set to 0 to disable (the default).
+var GasSafetyMargin Gas = 0
+
+// hasGasSafetyMargin returns false if the gas meter has GasSafetyMargin or less gas remaining
+func hasGasSafetyMargin(gm GasMeter) bool {
+	if GasSafetyMargin == 0 {
+		return true
+	}
+	limited, ok := gm.(LimitedGasMeter)
+	if !ok {
+		return true
+	}
+	limit, consumed := limited.Limit(), limited.GasConsumed()
+	return consumed < limit && limit-consumed > GasSafetyMargin
+}
+
+// GasRoundingMode determines how roundGas rounds gas amounts to a multiple of GasRoundingUnit
+type GasRoundingMode int
+
+const (
+	// Floor rounds down, which matches integer truncation
+	Floor GasRoundingMode = iota
+	// Ceil rounds up
+	Ceil
+	// Round rounds to the nearest multiple, halfway amounts are rounded up
+	Round
+)
+
+// GasRoundingUnit is the unit in which callbacks report gas. The gas measured for each callback is
+// rounded to a multiple of it according to GasRounding, such that hosts accounting in coarser units
+// than the gas meter get consistent results. Set to 0 or 1 to report exact amounts (the default).
+var GasRoundingUnit uint64 = 0
+
+// GasRounding is the rounding applied with GasRoundingUnit. Defaults to Floor.
+var GasRounding = Floor
+
+// roundGas rounds gas to a multiple of GasRoundingUnit according to GasRounding.
+// Rounding up saturates at the largest multiple representable as uint64.
+func roundGas(gas uint64) uint64 {
+	if GasRoundingUnit <= 1 {
+		return gas
+	}
+	remainder := gas % GasRoundingUnit
+	floor := gas - remainder
+	switch {
+	case remainder == 0:
+		return gas
+	case GasRounding == Ceil, GasRounding == Round && remainder >= GasRoundingUnit-GasRoundingUnit/2:
+		if floor > math.MaxUint64-GasRoundingUnit {
+			return floor
+		}
+		return floor + GasRoundingUnit
+	default:
+		return floor
+	}
+}
+
+// trackCallbackGas records the gas in usedGas as the last callback gas of the call, see LastCallbackGas.
+// Callbacks defer it once the call ID is known, such that the final value of usedGas is recorded.
+func trackCallbackGas(callID uint64, callback string, usedGas *cu64) {
+	if usedGas != nil {
+		setLastCallbackGas(callID, callback, uint64(*usedGas))
+	}
+}
+
+// reportGas returns the gas a callback reports as used to the Rust side, given the gas meter
+// readings before and after the operation, rounded by roundGas. While gas is suspended for the call
+// (see WithoutGas), this is 0.
+// The result is added to the callback gas total of the call and to TotalCallbackGas.
+func reportGas(callID uint64, gasBefore, gasAfter uint64) uint64 {
+	used := roundGas(gasAfter - gasBefore)
+	withCallState(callID, func(state *callState) {
+		if state.gasSuspended > 0 {
+			used = 0
+		}
+		state.callbackGas += used
+		if used > 0 {
+			if state.gasByEntryPoint == nil {
+				state.gasByEntryPoint = make(map[string]uint64)
+			}
+			state.gasByEntryPoint[state.currentEntryPoint] += used
+		}
+	})
+	recordCallbackGas(used)
+	return used
+}
+
+// GasConsumer is the part of the finschia-sdk GasMeter that charges gas.
+// It is used by KVStore wrappers that charge for additional work they do.
+type GasConsumer interface {
+	ConsumeGas(amount Gas, descriptor string)
+}
+
 /****** DB ********/
 
 // KVStore copies a subset of types from finschia-sdk
@@ -122,6 +297,108 @@ type KVStore interface {
 	ReverseIterator(start, end []byte) dbm.Iterator
 }
 
+// SizedKVStore is an optional extension of KVStore for stores that can cheaply report their approximate size.
+// This can inform gas estimation, scan cost heuristics and metrics.
+type SizedKVStore interface {
+	KVStore
+	// ApproximateSize returns the approximate number of keys and total size of keys and values in bytes.
+	// cScan does not create an iterator if this reports zero keys, so 0 must only be reported for an empty store.
+	ApproximateSize() (keys uint64, bytes uint64)
+}
+
+// ApproximateSize returns the approximate size of the store if it implements SizedKVStore.
+// ok is false for stores that cannot report their size.
+func ApproximateSize(store KVStore) (keys uint64, bytes uint64, ok bool) {
+	sized, ok := store.(SizedKVStore)
+	if !ok {
+		return 0, 0, false
+	}
+	keys, bytes = sized.ApproximateSize()
+	return keys, bytes, true
+}
+
+// errNilKVStore is the error message returned by the DB callbacks when the DB pointer refers to a nil KVStore
+const errNilKVStore = "DB pointer refers to a nil KVStore"
+
+// ZeroizeSensitive makes the DB callbacks overwrite plaintext values with zeros once they are no longer needed,
+// in order to limit the exposure of secrets in memory when values are encrypted by WriteTransform and ReadTransform.
+// Only buffers owned by this package are zeroed: the plaintext passed to WriteTransform after the transformed
+// value was written, and the result of ReadTransform after it was copied to the VM. Keys and values handed to
+// the store are never zeroed, since stores may keep references to them.
+//
+// This is best-effort only: copies created by the Go runtime, the store or the Rust side are not covered.
+// Hooks receiving values (e.g. ValueValidator) must not retain them.
+var ZeroizeSensitive = false
+
+// WritePolicy is consulted by the DB callbacks before every write or delete. If it returns an error,
+// the operation is not executed and the error message is returned to the contract.
+// This allows the host to enforce invariants on contract storage, e.g. reserved key prefixes.
+// Set to nil to allow all writes (the default).
+var WritePolicy func(key []byte) error
+
+// ValueValidator is consulted by cSet before every write with the value to be written. If it returns an error,
+// the write is not executed and the error message is returned to the contract. This can be used e.g. to
+// ensure contract storage only contains valid JSON. Set to nil to disable (the default).
+var ValueValidator func(value []byte) error
+
+// MissedReadGas is the gas charged by cGet for reading a key that is not present in the store.
+// It is added to the gas used by the store. Set to 0 to disable (the default).
+var MissedReadGas uint64 = 0
+
+// OnKeyCreated is called by cSet when a key is written that was not present in the store before,
+// allowing hosts to distinguish created from updated keys. To find out, cSet reads every key before
+// writing it, no matter whether the hook is set, such that the gas of cSet does not depend on node-local
+// configuration. The gas the store consumes for this read is reported as used by the write.
+// The key must not be retained. Set to nil to disable (the default).
+var OnKeyCreated func(key []byte)
+
+// NilValuePolicy determines how cSet handles a nil (None) value, which some stores treat as a delete
+// and others reject
+type NilValuePolicy int
+
+const (
+	// NilValuePassThrough passes nil values to the store, which decides how to handle them
+	NilValuePassThrough NilValuePolicy = iota
+	// NilValueReject rejects nil values with a user error
+	NilValueReject
+	// NilValueAsEmpty writes an empty value instead of nil
+	NilValueAsEmpty
+)
+
+// NilValues is the policy for nil values passed to cSet. Defaults to NilValuePassThrough.
+var NilValues = NilValuePassThrough
+
+// errNilValue is the error returned by cSet for nil values with NilValueReject
+const errNilValue = "Value must not be nil"
+
+// ReadTransform and WriteTransform transform values at the store boundary, e.g. for envelope encryption.
+// WriteTransform is applied by cSet to values before they are written to the store and ReadTransform
+// is applied by cGet and cNext to values read from the store before they are returned to the contract.
+// They are not applied to missing values. Errors are returned to the contract.
+// Both default to nil, i.e. values are stored as they are.
+var (
+	ReadTransform  func(value []byte) ([]byte, error)
+	WriteTransform func(value []byte) ([]byte, error)
+)
+
+// transformRead applies ReadTransform to a value read from the store
+func transformRead(v []byte) ([]byte, error) {
+	if ReadTransform == nil || v == nil {
+		return v, nil
+	}
+	return ReadTransform(v)
+}
+
+// ValueBytesPerGas is the number of value bytes one unit of gas pays for in stores charging reads
+// proportionally to the value size. If set, cGet calls OnGasSizeMismatch when a value is larger than the
+// gas consumed by the read implies, which indicates a mismatch between store and gas configuration.
+// Set to 0 to disable the check (the default).
+var ValueBytesPerGas uint64 = 0
+
+// OnGasSizeMismatch is called by cGet when a value is larger than usedGas * ValueBytesPerGas.
+// usedGas is the gas consumed on the gas meter by the read.
+var OnGasSizeMismatch func(key []byte, valueLen int, usedGas uint64)
+
 var db_vtable = C.Db_vtable{
 	read_db:   (C.read_db_fn)(C.cGet_cgo),
 	write_db:  (C.write_db_fn)(C.cSet_cgo),
@@ -166,22 +443,103 @@ var iterator_vtable = C.Iterator_vtable{
 // In any reasonable contract, gas limits should hit sooner than that though.
 const frameLenLimit = 32768
 
+// IteratorHardLimit is the maximum number of iterators per contract call. Opening more iterators fails.
+// Values above frameLenLimit are clamped to it, which remains the upper bound for memory safety.
+// Defaults to frameLenLimit.
+var IteratorHardLimit = frameLenLimit
+
+// MaxIteratorsPerChecksum overrides IteratorHardLimit for the contracts with the given checksums
+// (indexed by string(checksum)), allowing operators to throttle known-heavy contracts. Quotas above
+// IteratorHardLimit have no effect. Set to nil to disable (the default).
+var MaxIteratorsPerChecksum map[string]int
+
+// IteratorSoftLimit is a number of iterators per contract call below IteratorHardLimit. When a call opens more
+// iterators than this, OnIteratorSoftLimit is invoked (or a warning is logged if unset) but the iterator is created.
+// This gives integrators a grace band to detect borderline contracts before they hit the hard limit.
+// Set to 0 to disable (the default).
+var IteratorSoftLimit = 0
+
+// OnIteratorSoftLimit is called once per contract call when the call crosses IteratorSoftLimit.
+// count is the number of iterators including the one just created.
+var OnIteratorSoftLimit func(callID uint64, count int)
+
+// MaxIterSteps is the maximum number of entries cNext returns from a single iterator.
+// Further steps fail with a user error. This is a defense-in-depth measure on top of gas metering.
+// Set to 0 to disable (the default).
+var MaxIterSteps uint64 = 0
+
+// ScanApprover is consulted by cScan before an iterator is created. If it returns an error, the scan is
+// rejected and the error message is returned to the contract. This allows the host to prevent accidental
+// full-domain scans, e.g. by rejecting scans with two open bounds. Set to nil to allow all scans (the default).
+var ScanApprover func(start, end []byte, order Order) error
+
+// IteratorPrefetch is the number of entries cScan reads ahead into a buffer, from which subsequent cNext
+// calls are served. This trades memory for latency with stores that have a high per-step latency.
+// The gas consumed for reading entries ahead is reported by cScan, which consumes it, and cNext reports
+// no gas for entries served from the buffer. Contracts stopping early pay for the entries read ahead.
+// Set to 0 to disable (the default).
+var IteratorPrefetch = 0
+
+// OnIteratorEnd is called the first time cNext finds an iterator to be exhausted.
+// stepsTaken is the number of entries returned by the iterator. This helps debugging pagination logic.
+// The iterator is not locked while the hook runs, so it may use LabelIterator or DumpFrames.
+var OnIteratorEnd func(callID, index uint64, stepsTaken uint64)
+
+// iteratorLimit returns the maximum number of iterators of the given call, taking IteratorHardLimit and
+// MaxIteratorsPerChecksum into account. The result never exceeds frameLenLimit.
+func iteratorLimit(callID uint64) int {
+	limit := IteratorHardLimit
+	if limit > frameLenLimit {
+		limit = frameLenLimit
+	}
+	if MaxIteratorsPerChecksum != nil {
+		if quota, ok := MaxIteratorsPerChecksum[string(callChecksum(callID))]; ok && quota < limit {
+			limit = quota
+		}
+	}
+	return limit
+}
+
 // contract: original pointer/struct referenced must live longer than C.Db struct
 // since this is only used internally, we can verify the code that this is the case
-func buildIterator(callID uint64, it dbm.Iterator) (C.iterator_t, error) {
-	idx, err := storeIterator(callID, it, frameLenLimit)
+func buildIterator(callID uint64, it dbm.Iterator, order Order) (C.iterator_t, error) {
+	idx, err := storeIterator(callID, it, order, iteratorLimit(callID))
 	if err != nil {
 		return C.iterator_t{}, err
 	}
+	if IteratorSoftLimit > 0 && idx == uint64(IteratorSoftLimit)+1 {
+		if OnIteratorSoftLimit != nil {
+			OnIteratorSoftLimit(callID, int(idx))
+		} else {
+			log.Printf("Contract call %d exceeded the iterator soft limit (%d)\n", callID, IteratorSoftLimit)
+		}
+	}
 	return C.iterator_t{
 		call_id:        cu64(callID),
 		iterator_index: cu64(idx),
 	}, nil
 }
 
+// emptyIteratorIndex is the iterator index cScan returns for scans over a SizedKVStore reporting zero keys.
+// storeIterator starts counting at 1, so it never refers to a stored iterator. cNext treats it as exhausted.
+const emptyIteratorIndex = 0
+
+// Creates an empty C.GoIter to be filled by cScan, which cannot be done in test files directly
+func constructGoIter() C.GoIter {
+	return C.GoIter{}
+}
+
+// Creates a C.iterator_t referencing a stored iterator, which cannot be done in test files directly
+func constructIteratorRef(callID uint64, index uint64) C.iterator_t {
+	return C.iterator_t{
+		call_id:        cu64(callID),
+		iterator_index: cu64(index),
+	}
+}
+
 //export cGet
 func cGet(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *cu64, key C.U8SliceView, val *C.UnmanagedVector, errOut *C.UnmanagedVector) (ret C.GoError) {
-	defer recoverPanic(&ret)
+	defer recoverStorePanic(&ret, errOut)
 
 	if ptr == nil || gasMeter == nil || usedGas == nil || val == nil || errOut == nil {
 		// we received an invalid pointer
@@ -192,24 +550,54 @@ func cGet(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *cu64, key C.U8SliceView
 	}
 
 	gm := *(*GasMeter)(unsafe.Pointer(gasMeter))
-	kv := *(*KVStore)(unsafe.Pointer(ptr))
+	if !hasGasSafetyMargin(gm) {
+		return C.GoError_OutOfGas
+	}
+	state := (*DBState)(unsafe.Pointer(ptr))
+	defer trackCallbackGas(state.CallID, "cGet", usedGas)
+	kv := state.Store
+	if kv == nil {
+		// we received a valid pointer to a nil store
+		*errOut = newUnmanagedVector([]byte(errNilKVStore))
+		return C.GoError_BadArgument
+	}
+	if !allowRead(state.CallID) {
+		*errOut = newUnmanagedVector([]byte(errReadRateExceeded))
+		return C.GoError_User
+	}
 	k := copyU8Slice(key)
 
 	gasBefore := gm.GasConsumed()
 	v := kv.Get(k)
 	gasAfter := gm.GasConsumed()
-	*usedGas = (cu64)(gasAfter - gasBefore)
+	*usedGas = (cu64)(reportGas(state.CallID, gasBefore, gasAfter))
 
 	// v will equal nil when the key is missing
 	// https://github.com/Finschia/finschia-sdk/blob/786df84b8e0aaa0a1aff79ffbab0541e597ee004/store/types/store.go#L203
-	*val = newUnmanagedVector(v)
+	if v == nil {
+		recordMissedRead(state.CallID)
+		if MissedReadGas > 0 {
+			*usedGas += (cu64)(reportGas(state.CallID, 0, MissedReadGas))
+		}
+	} else if ValueBytesPerGas > 0 && OnGasSizeMismatch != nil {
+		if uint64(len(v)) > (gasAfter-gasBefore)*ValueBytesPerGas {
+			OnGasSizeMismatch(k, len(v), gasAfter-gasBefore)
+		}
+	}
+	plain, err := transformRead(v)
+	if err != nil {
+		*errOut = newUnmanagedVector([]byte(err.Error()))
+		return C.GoError_User
+	}
+	*val = newCallbackVector(state.CallID, "cGet", plain)
+	zeroizePlaintext(plain, v)
 
 	return C.GoError_None
 }
 
 //export cSet
 func cSet(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, key C.U8SliceView, val C.U8SliceView, errOut *C.UnmanagedVector) (ret C.GoError) {
-	defer recoverPanic(&ret)
+	defer recoverStorePanic(&ret, errOut)
 
 	if ptr == nil || gasMeter == nil || usedGas == nil || errOut == nil {
 		// we received an invalid pointer
@@ -220,21 +608,82 @@ func cSet(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, key C.U8Sli
 	}
 
 	gm := *(*GasMeter)(unsafe.Pointer(gasMeter))
-	kv := *(*KVStore)(unsafe.Pointer(ptr))
+	if !hasGasSafetyMargin(gm) {
+		return C.GoError_OutOfGas
+	}
+	state := (*DBState)(unsafe.Pointer(ptr))
+	defer trackCallbackGas(state.CallID, "cSet", usedGas)
+	kv := state.Store
+	if kv == nil {
+		// we received a valid pointer to a nil store
+		*errOut = newUnmanagedVector([]byte(errNilKVStore))
+		return C.GoError_BadArgument
+	}
 	k := copyU8Slice(key)
 	v := copyU8Slice(val)
+	if v == nil {
+		switch NilValues {
+		case NilValueReject:
+			*errOut = newUnmanagedVector([]byte(errNilValue))
+			return C.GoError_User
+		case NilValueAsEmpty:
+			v = []byte{}
+		}
+	}
+
+	if isReadOnly(state.CallID) {
+		*errOut = newUnmanagedVector([]byte(errReadOnly))
+		return C.GoError_User
+	}
+	if WritePolicy != nil {
+		if err := WritePolicy(k); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+	}
+	if ValueValidator != nil {
+		if err := ValueValidator(v); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+	}
+	if AppendOnlyWrites != nil {
+		if err := AppendOnlyWrites.check(state.CallID, k); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+	}
+
+	stored := v
+	if WriteTransform != nil {
+		var err error
+		if stored, err = WriteTransform(v); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+		// v is our own copy of the plaintext, which the store never sees
+		defer zeroizePlaintext(v, stored)
+	}
 
 	gasBefore := gm.GasConsumed()
-	kv.Set(k, v)
+	// always check for existence, since the gas used must not depend on whether OnKeyCreated is set
+	created := kv.Get(k) == nil
+	kv.Set(k, stored)
 	gasAfter := gm.GasConsumed()
-	*usedGas = (C.uint64_t)(gasAfter - gasBefore)
+	*usedGas = (C.uint64_t)(reportGas(state.CallID, gasBefore, gasAfter))
+	recordValueWritten(state.CallID, len(v))
+	recordKeyWritten(state.CallID, k)
+	recordWriteOp(state.CallID, k, false)
+	if created && OnKeyCreated != nil {
+		OnKeyCreated(k)
+	}
 
 	return C.GoError_None
 }
 
 //export cDelete
 func cDelete(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, key C.U8SliceView, errOut *C.UnmanagedVector) (ret C.GoError) {
-	defer recoverPanic(&ret)
+	defer recoverStorePanic(&ret, errOut)
 
 	if ptr == nil || gasMeter == nil || usedGas == nil || errOut == nil {
 		// we received an invalid pointer
@@ -245,20 +694,42 @@ func cDelete(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, key C.U8
 	}
 
 	gm := *(*GasMeter)(unsafe.Pointer(gasMeter))
-	kv := *(*KVStore)(unsafe.Pointer(ptr))
+	if !hasGasSafetyMargin(gm) {
+		return C.GoError_OutOfGas
+	}
+	state := (*DBState)(unsafe.Pointer(ptr))
+	defer trackCallbackGas(state.CallID, "cDelete", usedGas)
+	kv := state.Store
+	if kv == nil {
+		// we received a valid pointer to a nil store
+		*errOut = newUnmanagedVector([]byte(errNilKVStore))
+		return C.GoError_BadArgument
+	}
 	k := copyU8Slice(key)
 
+	if isReadOnly(state.CallID) {
+		*errOut = newUnmanagedVector([]byte(errReadOnly))
+		return C.GoError_User
+	}
+	if WritePolicy != nil {
+		if err := WritePolicy(k); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+	}
+
 	gasBefore := gm.GasConsumed()
 	kv.Delete(k)
 	gasAfter := gm.GasConsumed()
-	*usedGas = (C.uint64_t)(gasAfter - gasBefore)
+	*usedGas = (C.uint64_t)(reportGas(state.CallID, gasBefore, gasAfter))
+	recordWriteOp(state.CallID, k, true)
 
 	return C.GoError_None
 }
 
 //export cScan
 func cScan(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, start C.U8SliceView, end C.U8SliceView, order ci32, out *C.GoIter, errOut *C.UnmanagedVector) (ret C.GoError) {
-	defer recoverPanic(&ret)
+	defer recoverStorePanic(&ret, errOut)
 
 	if ptr == nil || gasMeter == nil || usedGas == nil || out == nil || errOut == nil {
 		// we received an invalid pointer
@@ -269,30 +740,75 @@ func cScan(ptr *C.db_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, start C.U8
 	}
 
 	gm := *(*GasMeter)(unsafe.Pointer(gasMeter))
+	if !hasGasSafetyMargin(gm) {
+		return C.GoError_OutOfGas
+	}
 	state := (*DBState)(unsafe.Pointer(ptr))
+	defer trackCallbackGas(state.CallID, "cScan", usedGas)
 	kv := state.Store
+	if kv == nil {
+		// we received a valid pointer to a nil store
+		*errOut = newUnmanagedVector([]byte(errNilKVStore))
+		return C.GoError_BadArgument
+	}
+	if Order(order) != Ascending && Order(order) != Descending {
+		// any other value is a bug in the caller, including extreme ones like INT32_MIN
+		*errOut = newUnmanagedVector([]byte(fmt.Sprintf("Invalid iteration order: %d", int32(order))))
+		return C.GoError_BadArgument
+	}
 	s := copyU8Slice(start)
 	e := copyU8Slice(end)
 
+	// Reversed ranges make the iterator invalid (see KVStore docs),
+	// so we reject them here instead of forwarding them to the store.
+	if err := ValidateScanRange(s, e, Order(order)); err != nil {
+		*errOut = newUnmanagedVector([]byte(err.Error()))
+		return C.GoError_User
+	}
+	if err := validateCallScanRange(state.CallID, s, e); err != nil {
+		*errOut = newUnmanagedVector([]byte(err.Error()))
+		return C.GoError_User
+	}
+	if ScanApprover != nil {
+		if err := ScanApprover(s, e, Order(order)); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+	}
+	if !allowRead(state.CallID) {
+		*errOut = newUnmanagedVector([]byte(errReadRateExceeded))
+		return C.GoError_User
+	}
+
+	if keys, _, ok := ApproximateSize(kv); isEmptyScanRange(s, e) || (ok && keys == 0) {
+		// nothing to iterate, so we do not need to occupy a frame slot
+		out.state = constructIteratorRef(state.CallID, emptyIteratorIndex)
+		out.vtable = iterator_vtable
+		return C.GoError_None
+	}
+
 	var iter dbm.Iterator
 	gasBefore := gm.GasConsumed()
-	switch order {
-	case 1: // Ascending
+	switch Order(order) {
+	case Ascending:
 		iter = kv.Iterator(s, e)
-	case 2: // Descending
-		iter = kv.ReverseIterator(s, e)
 	default:
-		return C.GoError_BadArgument
+		iter = kv.ReverseIterator(s, e)
 	}
 	gasAfter := gm.GasConsumed()
-	*usedGas = (C.uint64_t)(gasAfter - gasBefore)
+	*usedGas = (C.uint64_t)(reportGas(state.CallID, gasBefore, gasAfter))
 
-	cIterator, err := buildIterator(state.CallID, iter)
+	cIterator, err := buildIterator(state.CallID, iter, Order(order))
 	if err != nil {
 		// store the actual error message in the return buffer
 		*errOut = newUnmanagedVector([]byte(err.Error()))
 		return C.GoError_User
 	}
+	if IteratorPrefetch > 0 {
+		// the gas is reported right away, since the contract may not consume all prefetched entries
+		prefetchGas := retrieveIteratorEntry(state.CallID, uint64(cIterator.iterator_index)).prefetch(gm, IteratorPrefetch)
+		*usedGas += (C.uint64_t)(reportGas(state.CallID, 0, prefetchGas))
+	}
 
 	out.state = cIterator
 	out.vtable = iterator_vtable
@@ -307,7 +823,7 @@ func cNext(ref C.iterator_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, key *
 	// 		...
 	// 	}
 
-	defer recoverPanic(&ret)
+	defer recoverStorePanic(&ret, errOut)
 	if ref.call_id == 0 || gasMeter == nil || usedGas == nil || key == nil || val == nil || errOut == nil {
 		// we received an invalid pointer
 		return C.GoError_BadArgument
@@ -316,27 +832,96 @@ func cNext(ref C.iterator_t, gasMeter *C.gas_meter_t, usedGas *C.uint64_t, key *
 		panic("Got a non-none UnmanagedVector we're about to override. This is a bug because someone has to drop the old one.")
 	}
 
+	defer trackCallbackGas(uint64(ref.call_id), "cNext", usedGas)
+	if ref.iterator_index == emptyIteratorIndex {
+		// iterator over an empty store created by cScan
+		return C.GoError_None
+	}
 	gm := *(*GasMeter)(unsafe.Pointer(gasMeter))
-	iter := retrieveIterator(uint64(ref.call_id), uint64(ref.iterator_index))
-	if iter == nil {
+	if !hasGasSafetyMargin(gm) {
+		return C.GoError_OutOfGas
+	}
+	entry := retrieveIteratorEntry(uint64(ref.call_id), uint64(ref.iterator_index))
+	if entry == nil {
+		panic("Unable to retrieve iterator.")
+	}
+	// OnIteratorEnd is run after the lock is released, since the hook may inspect the iterator
+	var notifyEnd func()
+	defer func() {
+		if notifyEnd != nil {
+			notifyEnd()
+		}
+	}()
+	// serialize steps of the same iterator
+	entry.mtx.Lock()
+	defer entry.mtx.Unlock()
+	if entry.closed {
+		// the call ended while we were waiting for the lock
 		panic("Unable to retrieve iterator.")
 	}
-	if !iter.Valid() {
+	iter := entry.iter
+	if len(entry.prefetched) == 0 && !iter.Valid() {
+		// an iterator may become invalid because of an error, e.g. a conflict in a merged iterator
+		if err := iter.Error(); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+		if !entry.ended {
+			entry.ended = true
+			if OnIteratorEnd != nil {
+				steps := entry.steps
+				notifyEnd = func() {
+					OnIteratorEnd(uint64(ref.call_id), uint64(ref.iterator_index), steps)
+				}
+			}
+		}
 		// end of iterator, return as no-op, nil key is considered end
 		return C.GoError_None
 	}
+	if isAborted(uint64(ref.call_id)) {
+		*errOut = newUnmanagedVector([]byte(errIterationAborted))
+		return C.GoError_User
+	}
+	if MaxIterSteps > 0 && entry.steps >= MaxIterSteps {
+		msg := "iterator step limit exceeded"
+		if entry.label != "" {
+			msg += fmt.Sprintf(" (%s)", entry.label)
+		}
+		*errOut = newUnmanagedVector([]byte(msg))
+		return C.GoError_User
+	}
+	entry.steps++
+
+	var k, v []byte
+	if len(entry.prefetched) > 0 {
+		// serve from the buffer, the gas for reading the entry was reported by cScan
+		step := entry.prefetched[0]
+		entry.prefetched = entry.prefetched[1:]
+		k, v = step.key, step.value
+	} else {
+		gasBefore := gm.GasConsumed()
+		// call Next at the end, upon creation we have first data loaded
+		k = iter.Key()
+		v = iter.Value()
+		iter.Next()
+		gasAfter := gm.GasConsumed()
+		*usedGas = (C.uint64_t)(reportGas(uint64(ref.call_id), gasBefore, gasAfter))
+		if err := iter.Error(); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+	}
 
-	gasBefore := gm.GasConsumed()
-	// call Next at the end, upon creation we have first data loaded
-	k := iter.Key()
-	v := iter.Value()
-	// check iter.Error() ????
-	iter.Next()
-	gasAfter := gm.GasConsumed()
-	*usedGas = (C.uint64_t)(gasAfter - gasBefore)
+	entry.lastKey = append(entry.lastKey[:0], k...)
 
-	*key = newUnmanagedVector(k)
-	*val = newUnmanagedVector(v)
+	plain, err := transformRead(v)
+	if err != nil {
+		*errOut = newUnmanagedVector([]byte(err.Error()))
+		return C.GoError_User
+	}
+	*key = newCallbackVector(uint64(ref.call_id), "cNext", k)
+	*val = newCallbackVector(uint64(ref.call_id), "cNext", plain)
+	zeroizePlaintext(plain, v)
 	return C.GoError_None
 }
 
@@ -357,68 +942,132 @@ var api_vtable = C.GoApi_vtable{
 	canonicalize_address: (C.canonicalize_address_fn)(C.cCanonicalAddress_cgo),
 }
 
+// APIState is referenced by the state pointer of C.GoApi and gives the API callbacks access to the GoAPI and the call
+type APIState struct {
+	API *GoAPI
+	// CallID is the ID of the contract call using the API
+	CallID uint64
+}
+
+func buildAPIState(api *GoAPI, callID uint64) APIState {
+	return APIState{
+		API:    api,
+		CallID: callID,
+	}
+}
+
 // contract: original pointer/struct referenced must live longer than C.GoApi struct
 // since this is only used internally, we can verify the code that this is the case
-func buildAPI(api *GoAPI) C.GoApi {
+func buildAPI(state *APIState) C.GoApi {
 	return C.GoApi{
-		state:  (*C.api_t)(unsafe.Pointer(api)),
+		state:  (*C.api_t)(unsafe.Pointer(state)),
 		vtable: api_vtable,
 	}
 }
 
-//export cHumanAddress
-func cHumanAddress(ptr *C.api_t, src C.U8SliceView, dest *C.UnmanagedVector, errOut *C.UnmanagedVector, used_gas *cu64) (ret C.GoError) {
-	defer recoverPanic(&ret)
-
-	if dest == nil || errOut == nil {
-		return C.GoError_BadArgument
-	}
-	if !(*dest).is_none || !(*errOut).is_none {
-		panic("Got a non-none UnmanagedVector we're about to override. This is a bug because someone has to drop the old one.")
+// CacheCanonicalAddresses enables a cache of the results of GoAPI.CanonicalAddress within each contract call.
+// Repeated conversions of the same address are served from the cache without calling the host again and
+// are charged the gas of the original conversion, so the gas used does not depend on the cache.
+// Failed conversions are not cached. Defaults to false.
+var CacheCanonicalAddresses = false
+
+// MaxHumanAddressLen is the maximum length in bytes of an address returned by GoAPI.HumanAddress.
+// Longer results are rejected with a user error since they most likely indicate a bug in the host.
+// Set to 0 to disable.
+var MaxHumanAddressLen = 1024
+
+// MaxAddressConversionGas is the maximum gas cost GoAPI.HumanAddress and GoAPI.CanonicalAddress may report
+// for a single conversion. Higher costs are not charged but rejected with a user error since they most likely
+// indicate a bug in the host. Set to 0 to disable (the default).
+var MaxAddressConversionGas uint64 = 0
+
+// checkAddressConversionGas returns an error if cost exceeds MaxAddressConversionGas
+func checkAddressConversionGas(cost uint64) error {
+	if MaxAddressConversionGas > 0 && cost > MaxAddressConversionGas {
+		return fmt.Errorf("Address conversion gas too high: %d exceeds the limit of %d", cost, MaxAddressConversionGas)
 	}
+	return nil
+}
 
-	api := (*GoAPI)(unsafe.Pointer(ptr))
-	s := copyU8Slice(src)
+//export cHumanAddress
+func cHumanAddress(ptr *C.api_t, src C.U8SliceView, dest *C.UnmanagedVector, errOut *C.UnmanagedVector, used_gas *cu64) C.GoError {
+	return safeCallback("cHumanAddress", func() error {
+		if dest == nil || errOut == nil {
+			return callbackError(C.GoError_BadArgument)
+		}
+		if !(*dest).is_none || !(*errOut).is_none {
+			panic("Got a non-none UnmanagedVector we're about to override. This is a bug because someone has to drop the old one.")
+		}
 
-	h, cost, err := api.HumanAddress(s)
-	*used_gas = cu64(cost)
-	if err != nil {
-		// store the actual error message in the return buffer
-		*errOut = newUnmanagedVector([]byte(err.Error()))
-		return C.GoError_User
-	}
-	if len(h) == 0 {
-		panic(fmt.Sprintf("`api.HumanAddress()` returned an empty string for %q", s))
-	}
-	*dest = newUnmanagedVector([]byte(h))
-	return C.GoError_None
+		state := (*APIState)(unsafe.Pointer(ptr))
+		defer trackCallbackGas(state.CallID, "cHumanAddress", used_gas)
+		api := state.API
+		s := copyU8Slice(src)
+
+		h, cost, err := api.HumanAddress(s)
+		if err := checkAddressConversionGas(cost); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return err
+		}
+		*used_gas = cu64(cost)
+		if err != nil {
+			// store the actual error message in the return buffer
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return err
+		}
+		if len(h) == 0 {
+			panic(fmt.Sprintf("`api.HumanAddress()` returned an empty string for %q", s))
+		}
+		if MaxHumanAddressLen > 0 && len(h) > MaxHumanAddressLen {
+			err := fmt.Errorf("Human address too long: %d bytes exceeds the limit of %d", len(h), MaxHumanAddressLen)
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return err
+		}
+		*dest = newCallbackVector(state.CallID, "cHumanAddress", []byte(h))
+		return nil
+	})
 }
 
 //export cCanonicalAddress
-func cCanonicalAddress(ptr *C.api_t, src C.U8SliceView, dest *C.UnmanagedVector, errOut *C.UnmanagedVector, used_gas *cu64) (ret C.GoError) {
-	defer recoverPanic(&ret)
-
-	if dest == nil || errOut == nil {
-		return C.GoError_BadArgument
-	}
-	if !(*dest).is_none || !(*errOut).is_none {
-		panic("Got a non-none UnmanagedVector we're about to override. This is a bug because someone has to drop the old one.")
-	}
+func cCanonicalAddress(ptr *C.api_t, src C.U8SliceView, dest *C.UnmanagedVector, errOut *C.UnmanagedVector, used_gas *cu64) C.GoError {
+	return safeCallback("cCanonicalAddress", func() error {
+		if dest == nil || errOut == nil {
+			return callbackError(C.GoError_BadArgument)
+		}
+		if !(*dest).is_none || !(*errOut).is_none {
+			panic("Got a non-none UnmanagedVector we're about to override. This is a bug because someone has to drop the old one.")
+		}
 
-	api := (*GoAPI)(unsafe.Pointer(ptr))
-	s := string(copyU8Slice(src))
-	c, cost, err := api.CanonicalAddress(s)
-	*used_gas = cu64(cost)
-	if err != nil {
-		// store the actual error message in the return buffer
-		*errOut = newUnmanagedVector([]byte(err.Error()))
-		return C.GoError_User
-	}
-	if len(c) == 0 {
-		panic(fmt.Sprintf("`api.CanonicalAddress()` returned an empty string for %q", s))
-	}
-	*dest = newUnmanagedVector(c)
-	return C.GoError_None
+		state := (*APIState)(unsafe.Pointer(ptr))
+		defer trackCallbackGas(state.CallID, "cCanonicalAddress", used_gas)
+		s := string(copyU8Slice(src))
+		if CacheCanonicalAddresses {
+			if c, cost, ok := cachedCanonicalAddress(state.CallID, s); ok {
+				*used_gas = cu64(cost)
+				*dest = newCallbackVector(state.CallID, "cCanonicalAddress", c)
+				return nil
+			}
+		}
+		c, cost, err := state.API.CanonicalAddress(s)
+		if err := checkAddressConversionGas(cost); err != nil {
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return err
+		}
+		*used_gas = cu64(cost)
+		if err != nil {
+			// store the actual error message in the return buffer
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return err
+		}
+		if len(c) == 0 {
+			panic(fmt.Sprintf("`api.CanonicalAddress()` returned an empty string for %q", s))
+		}
+		if CacheCanonicalAddresses {
+			cacheCanonicalAddress(state.CallID, s, c, cost)
+		}
+		*dest = newCallbackVector(state.CallID, "cCanonicalAddress", c)
+		return nil
+	})
 }
 
 /****** Go Querier ********/
@@ -427,15 +1076,142 @@ var querier_vtable = C.Querier_vtable{
 	query_external: (C.query_external_fn)(C.cQueryExternal_cgo),
 }
 
+// vtableFunctions maps the addresses of the exported callbacks to their names, see VtableInfo
+var vtableFunctions = map[uintptr]string{
+	uintptr(unsafe.Pointer(C.cGet_cgo)):              "cGet",
+	uintptr(unsafe.Pointer(C.cSet_cgo)):              "cSet",
+	uintptr(unsafe.Pointer(C.cDelete_cgo)):           "cDelete",
+	uintptr(unsafe.Pointer(C.cScan_cgo)):             "cScan",
+	uintptr(unsafe.Pointer(C.cNext_cgo)):             "cNext",
+	uintptr(unsafe.Pointer(C.cHumanAddress_cgo)):     "cHumanAddress",
+	uintptr(unsafe.Pointer(C.cCanonicalAddress_cgo)): "cCanonicalAddress",
+	uintptr(unsafe.Pointer(C.cQueryExternal_cgo)):    "cQueryExternal",
+}
+
+// VtableInfo returns the name of the Go callback bound to each slot of the vtables passed to Rust,
+// indexed by vtable ("db", "iterator", "api" and "querier") and slot name (e.g. "read_db").
+// Empty slots are reported as "" and slots bound to an unknown function as "unknown".
+// This is meant for debugging the FFI wiring.
+func VtableInfo() map[string]map[string]string {
+	vtables := map[string]interface{}{
+		"db":       db_vtable,
+		"iterator": iterator_vtable,
+		"api":      api_vtable,
+		"querier":  querier_vtable,
+	}
+	info := make(map[string]map[string]string, len(vtables))
+	for name, vtable := range vtables {
+		v := reflect.ValueOf(vtable)
+		slots := make(map[string]string, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			slot := v.Type().Field(i).Name
+			ptr := v.Field(i).Pointer()
+			switch fn, ok := vtableFunctions[ptr]; {
+			case ptr == 0:
+				slots[slot] = ""
+			case ok:
+				slots[slot] = fn
+			default:
+				slots[slot] = "unknown"
+			}
+		}
+		info[name] = slots
+	}
+	return info
+}
+
+type QuerierState struct {
+	Querier Querier
+	// CallID is the ID of the contract call issuing the queries
+	CallID uint64
+	// Checksum is the checksum of the contract issuing the queries
+	Checksum []byte
+}
+
+// QueryAttribution is called after every query with the checksum of the querying contract,
+// the type of the query request (e.g. "bank" or "wasm") and the gas consumed by the querier.
+// This allows hosts to attribute query gas per contract. Set to nil to disable (the default).
+var QueryAttribution func(checksum []byte, requestType string, gas uint64)
+
+// OnQueryGasLimit is called at the start of every query with the type of the query request (e.g. "bank" or "wasm")
+// and the gas limit given by the VM, before QueryTypeGasLimits is applied. This shows how the VM budgets queries.
+// Set to nil to disable (the default).
+var OnQueryGasLimit func(requestType string, limit uint64)
+
+// MaxQueriesPerCall is the maximum number of queries a contract call can issue. Further queries fail
+// with a "query call limit exceeded" error. Set to 0 for no limit (the default).
+var MaxQueriesPerCall uint64 = 0
+
+// QueryTypeGasLimits contains gas limits for individual query request types (e.g. "bank" or "wasm").
+// cQueryExternal passes the smaller of the limit given by the VM and the limit for the request type
+// to the querier. Request types without an entry only use the limit given by the VM.
+var QueryTypeGasLimits map[string]uint64
+
+// QuerySerializationGasPerByte is the gas charged per byte of the serialized query result
+// returned to the contract. It is added to the gas used by the querier. Set to 0 to disable (the default).
+var QuerySerializationGasPerByte uint64 = 0
+
+// ResponseRewriter allows post-processing the serialized query result (a JSON encoded QuerierResult)
+// before it is returned to the contract, e.g. for testing or middleware. An error is returned
+// to the contract as a user error. Set to nil to disable (the default).
+var ResponseRewriter func(request, response []byte) ([]byte, error)
+
+// OnQueryError is called with the raw query request whenever a query fails, i.e. the querier
+// returned an error or cQueryExternal reports an error to the VM. This gives hosts the exact
+// failing request for reproduction. Set to nil to disable (the default).
+var OnQueryError func(request []byte, err error)
+
+// marshalQuerierResult serializes the result returned to the contract. Tests replace it to
+// simulate serialization errors, which cannot be produced by any querier.
+var marshalQuerierResult = func(res types.QuerierResult) ([]byte, error) {
+	return json.Marshal(res)
+}
+
+// reportQueryError passes err to OnQueryError if set
+func reportQueryError(request []byte, err error) {
+	if OnQueryError != nil {
+		OnQueryError(request, err)
+	}
+}
+
+// use this to create C.GoQuerier in two steps, so the pointer lives as long as the calling stack
+//
+//	state := buildQuerierState(querier, callID, checksum)
+//	q := buildQuerier(&state)
+//	// then pass q into some FFI function
+func buildQuerierState(q Querier, callID uint64, checksum []byte) QuerierState {
+	if caching, ok := q.(*CachingQuerier); ok {
+		onCallEnd(callID, caching.Reset)
+	}
+	return QuerierState{
+		Querier:  q,
+		CallID:   callID,
+		Checksum: checksum,
+	}
+}
+
 // contract: original pointer/struct referenced must live longer than C.GoQuerier struct
 // since this is only used internally, we can verify the code that this is the case
-func buildQuerier(q *Querier) C.GoQuerier {
+func buildQuerier(state *QuerierState) C.GoQuerier {
 	return C.GoQuerier{
-		state:  (*C.querier_t)(unsafe.Pointer(q)),
+		state:  (*C.querier_t)(unsafe.Pointer(state)),
 		vtable: querier_vtable,
 	}
 }
 
+// queryRequestType returns the name of the top level variant of a serialized types.QueryRequest,
+// e.g. "bank" or "wasm". Returns "unknown" if the request cannot be parsed.
+func queryRequestType(request []byte) string {
+	var variants map[string]json.RawMessage
+	if err := json.Unmarshal(request, &variants); err != nil || len(variants) != 1 {
+		return "unknown"
+	}
+	for name := range variants {
+		return name
+	}
+	return "unknown"
+}
+
 //export cQueryExternal
 func cQueryExternal(ptr *C.querier_t, gasLimit C.uint64_t, usedGas *C.uint64_t, request C.U8SliceView, result *C.UnmanagedVector, errOut *C.UnmanagedVector) (ret C.GoError) {
 	defer recoverPanic(&ret)
@@ -449,20 +1225,80 @@ func cQueryExternal(ptr *C.querier_t, gasLimit C.uint64_t, usedGas *C.uint64_t,
 	}
 
 	// query the data
-	querier := *(*Querier)(unsafe.Pointer(ptr))
+	state := (*QuerierState)(unsafe.Pointer(ptr))
+	defer trackCallbackGas(state.CallID, "cQueryExternal", usedGas)
 	req := copyU8Slice(request)
+	requestType := queryRequestType(req)
+	if OnQueryGasLimit != nil {
+		OnQueryGasLimit(requestType, uint64(gasLimit))
+	}
+	if count := recordQuery(state.CallID); MaxQueriesPerCall > 0 && count > MaxQueriesPerCall {
+		*errOut = newUnmanagedVector([]byte("query call limit exceeded"))
+		return C.GoError_User
+	}
+	querier := state.Querier
+
+	limit := uint64(gasLimit)
+	if typeLimit, ok := QueryTypeGasLimits[requestType]; ok && typeLimit < limit {
+		limit = typeLimit
+	}
+
+	ctx := callContext(state.CallID)
+	if ctx.Err() != nil {
+		*errOut = newUnmanagedVector([]byte(errQueryAborted))
+		return C.GoError_User
+	}
+	var q Querier = querier
+	if cq, ok := querier.(ContextQuerier); ok {
+		q = contextQuerier{inner: cq, ctx: ctx}
+	}
 
 	gasBefore := querier.GasConsumed()
-	res := types.RustQuery(querier, req, uint64(gasLimit))
+	res := types.RustQuery(q, req, limit)
 	gasAfter := querier.GasConsumed()
-	*usedGas = (C.uint64_t)(gasAfter - gasBefore)
+	if gasAfter < gasBefore {
+		// the subtraction below would underflow, which indicates a bug in the querier
+		err := fmt.Errorf("Querier gas consumed decreased from %d to %d", gasBefore, gasAfter)
+		reportQueryError(req, err)
+		*errOut = newUnmanagedVector([]byte(err.Error()))
+		return C.GoError_User
+	}
+	*usedGas = (C.uint64_t)(reportGas(state.CallID, gasBefore, gasAfter))
+	if ctx.Err() != nil {
+		*errOut = newUnmanagedVector([]byte(errQueryAborted))
+		return C.GoError_User
+	}
+
+	if QueryAttribution != nil {
+		QueryAttribution(state.Checksum, requestType, gasAfter-gasBefore)
+	}
+
+	switch {
+	case res.Err != nil:
+		reportQueryError(req, res.Err)
+	case res.Ok != nil && res.Ok.Err != "":
+		reportQueryError(req, errors.New(res.Ok.Err))
+	}
 
 	// serialize the response
-	bz, err := json.Marshal(res)
+	bz, err := marshalQuerierResult(res)
 	if err != nil {
+		reportQueryError(req, err)
 		*errOut = newUnmanagedVector([]byte(err.Error()))
 		return C.GoError_CannotSerialize
 	}
-	*result = newUnmanagedVector(bz)
+	if ResponseRewriter != nil {
+		bz, err = ResponseRewriter(req, bz)
+		if err != nil {
+			reportQueryError(req, err)
+			*errOut = newUnmanagedVector([]byte(err.Error()))
+			return C.GoError_User
+		}
+	}
+	if QuerySerializationGasPerByte > 0 {
+		serializationGas := uint64(len(bz)) * QuerySerializationGasPerByte
+		*usedGas += (C.uint64_t)(reportGas(state.CallID, 0, serializationGas))
+	}
+	*result = newCallbackVector(state.CallID, "cQueryExternal", bz)
 	return C.GoError_None
 }
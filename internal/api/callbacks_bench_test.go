@@ -0,0 +1,163 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// The benchmarks in this file drive the DB callbacks directly (without a contract) in order
+// to track the throughput of the Go side of the FFI hot path. Run with
+//
+//	go test ./internal/api -run XXX -bench Callback
+//
+
+// The number of iterators opened in one call before the frame gets released
+const benchFrameSize = 1000
+
+func newBenchDB(b *testing.B) (*testDB, *Lookup) {
+	gasMeter := NewMockGasMeter(math.MaxUint64)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	b.Cleanup(func() { endCall(callID) })
+	return newTestDB(store, gasMeter, callID), store
+}
+
+// renewCall ends the call of the benchmark DB and starts a new one, such that the
+// iterator frame limit is not hit. The timer is stopped while doing so.
+func renewCall(b *testing.B, db *testDB) {
+	b.StopTimer()
+	endCall(db.state.CallID)
+	db.state.CallID = startCall()
+	b.StartTimer()
+}
+
+func reportOpsPerSec(b *testing.B) {
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
+
+var benchValueSizes = []int{32, 64 * 1024}
+
+func BenchmarkCallbackGet(b *testing.B) {
+	for _, size := range benchValueSizes {
+		b.Run(fmt.Sprintf("value=%dB", size), func(b *testing.B) {
+			db, store := newBenchDB(b)
+			key := []byte("some key")
+			store.Set(key, make([]byte, size))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				value, _, _, ret := db.get(key)
+				if ret != goErrorNone || len(value) != size {
+					b.Fatalf("unexpected result: %d", ret)
+				}
+			}
+			reportOpsPerSec(b)
+		})
+	}
+}
+
+func BenchmarkCallbackSet(b *testing.B) {
+	for _, size := range benchValueSizes {
+		b.Run(fmt.Sprintf("value=%dB", size), func(b *testing.B) {
+			db, _ := newBenchDB(b)
+			key := []byte("some key")
+			value := make([]byte, size)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, ret := db.set(key, value)
+				if ret != goErrorNone {
+					b.Fatalf("unexpected result: %d", ret)
+				}
+			}
+			reportOpsPerSec(b)
+		})
+	}
+}
+
+func BenchmarkCallbackScan(b *testing.B) {
+	db, store := newBenchDB(b)
+	for i := 0; i < 100; i++ {
+		store.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value"))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i > 0 && i%benchFrameSize == 0 {
+			renewCall(b, db)
+		}
+		_, _, _, ret := db.scan([]byte("key"), []byte("kez"), Ascending)
+		if ret != goErrorNone {
+			b.Fatalf("unexpected result: %d", ret)
+		}
+	}
+	reportOpsPerSec(b)
+}
+
+// BenchmarkCallbackNext measures opening an iterator and walking it until the end
+func BenchmarkCallbackNext(b *testing.B) {
+	for _, length := range []int{10, 100, 1000} {
+		for _, size := range benchValueSizes {
+			b.Run(fmt.Sprintf("length=%d/value=%dB", length, size), func(b *testing.B) {
+				db, store := newBenchDB(b)
+				for i := 0; i < length; i++ {
+					store.Set([]byte(fmt.Sprintf("key%05d", i)), make([]byte, size))
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if i > 0 && i%benchFrameSize == 0 {
+						renewCall(b, db)
+					}
+					index, _, _, ret := db.scan(nil, nil, Ascending)
+					if ret != goErrorNone {
+						b.Fatalf("unexpected result: %d", ret)
+					}
+					count := 0
+					for {
+						key, _, _, _, ret := db.next(index)
+						if ret != goErrorNone {
+							b.Fatalf("unexpected result: %d", ret)
+						}
+						if key == nil {
+							break
+						}
+						count++
+					}
+					if count != length {
+						b.Fatalf("expected %d items, got %d", length, count)
+					}
+				}
+				reportOpsPerSec(b)
+			})
+		}
+	}
+}
+
+// BenchmarkCgoCrossing measures the pure FFI overhead without any work on either side. This is the
+// baseline for the callback benchmarks above. Run with
+//
+//	go test ./internal/api -run XXX -bench CgoCrossing
+func BenchmarkCgoCrossing(b *testing.B) {
+	b.Run("GoToC", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			crossIntoC()
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N), "ns/crossing")
+	})
+
+	b.Run("GoToCToGo", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if ret := crossIntoCAndBack(); ret != goErrorBadArgument {
+				b.Fatalf("unexpected result %d", ret)
+			}
+		}
+		// two crossings per iteration
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(2*b.N), "ns/crossing")
+	})
+}
@@ -0,0 +1,1863 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Finschia/wasmvm/types"
+)
+
+// testDB allows calling the DB callbacks directly, without going through a contract
+type testDB struct {
+	state    DBState
+	gasMeter GasMeter
+}
+
+func newTestDB(store KVStore, gasMeter GasMeter, callID uint64) *testDB {
+	return &testDB{
+		state:    buildDBState(store, callID),
+		gasMeter: gasMeter,
+	}
+}
+
+func (d *testDB) get(key []byte) ([]byte, uint64, string, goError) {
+	db := buildDB(&d.state, &d.gasMeter)
+	var usedGas cu64
+	val := newUnmanagedVector(nil)
+	errOut := newUnmanagedVector(nil)
+	ret := cGet(db.state, db.gas_meter, &usedGas, constructU8SliceView(key), &val, &errOut)
+	return copyAndDestroyUnmanagedVector(val), uint64(usedGas), string(copyAndDestroyUnmanagedVector(errOut)), ret
+}
+
+func (d *testDB) set(key, value []byte) (uint64, string, goError) {
+	db := buildDB(&d.state, &d.gasMeter)
+	var usedGas cu64
+	errOut := newUnmanagedVector(nil)
+	ret := cSet(db.state, db.gas_meter, &usedGas, constructU8SliceView(key), constructU8SliceView(value), &errOut)
+	return uint64(usedGas), string(copyAndDestroyUnmanagedVector(errOut)), ret
+}
+
+func (d *testDB) delete(key []byte) (uint64, string, goError) {
+	db := buildDB(&d.state, &d.gasMeter)
+	var usedGas cu64
+	errOut := newUnmanagedVector(nil)
+	ret := cDelete(db.state, db.gas_meter, &usedGas, constructU8SliceView(key), &errOut)
+	return uint64(usedGas), string(copyAndDestroyUnmanagedVector(errOut)), ret
+}
+
+// scan returns the iterator index within the call on success
+func (d *testDB) scan(start, end []byte, order Order) (uint64, uint64, string, goError) {
+	db := buildDB(&d.state, &d.gasMeter)
+	var usedGas cu64
+	out := constructGoIter()
+	errOut := newUnmanagedVector(nil)
+	ret := cScan(db.state, db.gas_meter, &usedGas, constructU8SliceView(start), constructU8SliceView(end), ci32(order), &out, &errOut)
+	return uint64(out.state.iterator_index), uint64(usedGas), string(copyAndDestroyUnmanagedVector(errOut)), ret
+}
+
+// next returns a nil key at the end of the iterator
+func (d *testDB) next(index uint64) ([]byte, []byte, uint64, string, goError) {
+	db := buildDB(&d.state, &d.gasMeter)
+	var usedGas cu64
+	key := newUnmanagedVector(nil)
+	val := newUnmanagedVector(nil)
+	errOut := newUnmanagedVector(nil)
+	ret := cNext(constructIteratorRef(d.state.CallID, index), db.gas_meter, &usedGas, &key, &val, &errOut)
+	return copyAndDestroyUnmanagedVector(key), copyAndDestroyUnmanagedVector(val), uint64(usedGas), string(copyAndDestroyUnmanagedVector(errOut)), ret
+}
+
+// query calls cQueryExternal directly with the given querier state
+func query(state *QuerierState, gasLimit uint64, request []byte) ([]byte, uint64, string, goError) {
+	q := buildQuerier(state)
+	var usedGas cu64
+	result := newUnmanagedVector(nil)
+	errOut := newUnmanagedVector(nil)
+	ret := cQueryExternal(q.state, cu64(gasLimit), &usedGas, constructU8SliceView(request), &result, &errOut)
+	return copyAndDestroyUnmanagedVector(result), uint64(usedGas), string(copyAndDestroyUnmanagedVector(errOut)), ret
+}
+
+// meteredQuerier charges gas for the length of each request and returns a fixed response
+type meteredQuerier struct {
+	usedGas  uint64
+	response []byte
+	// gasLimits contains the gas limit received by each query
+	gasLimits []uint64
+}
+
+var _ Querier = (*meteredQuerier)(nil)
+
+func (q *meteredQuerier) Query(request types.QueryRequest, gasLimit uint64) ([]byte, error) {
+	q.gasLimits = append(q.gasLimits, gasLimit)
+	bz, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	q.usedGas += uint64(len(bz))
+	return q.response, nil
+}
+
+func (q *meteredQuerier) GasConsumed() uint64 {
+	return q.usedGas
+}
+
+// copyingStore copies all keys and values before passing them on and remembers the slices it received
+type copyingStore struct {
+	KVStore
+	received [][]byte
+}
+
+func (s *copyingStore) Get(key []byte) []byte {
+	s.received = append(s.received, key)
+	return s.KVStore.Get(cloneBytes(key))
+}
+
+func (s *copyingStore) Set(key, value []byte) {
+	s.received = append(s.received, key, value)
+	s.KVStore.Set(cloneBytes(key), cloneBytes(value))
+}
+
+func (s *copyingStore) Delete(key []byte) {
+	s.received = append(s.received, key)
+	s.KVStore.Delete(cloneBytes(key))
+}
+
+func TestZeroizeSensitive(t *testing.T) {
+	// a reversible "encryption" producing new buffers, remembering the plaintexts it saw
+	var plaintexts [][]byte
+	reverse := func(value []byte) []byte {
+		out := make([]byte, len(value))
+		for i, b := range value {
+			out[len(value)-1-i] = b
+		}
+		return out
+	}
+	WriteTransform = func(value []byte) ([]byte, error) {
+		plaintexts = append(plaintexts, value)
+		return reverse(value), nil
+	}
+	ReadTransform = func(value []byte) ([]byte, error) {
+		plain := reverse(value)
+		plaintexts = append(plaintexts, plain)
+		return plain, nil
+	}
+	defer func() {
+		ZeroizeSensitive = false
+		WriteTransform = nil
+		ReadTransform = nil
+	}()
+
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	db := newTestDB(store, gasMeter, callID)
+
+	// disabled by default
+	_, _, ret := db.set([]byte("key"), []byte("secret"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, [][]byte{[]byte("secret")}, plaintexts)
+
+	ZeroizeSensitive = true
+	plaintexts = nil
+	_, _, ret = db.set([]byte("key"), []byte("secret"))
+	require.Equal(t, goErrorNone, ret)
+	value, _, _, ret := db.get([]byte("key"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("secret"), value)
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, value, _, _, ret = db.next(index)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("secret"), value)
+
+	// the plaintexts of the write, the read and the iteration are zeroed
+	require.Len(t, plaintexts, 3)
+	for _, buf := range plaintexts {
+		require.Equal(t, make([]byte, len(buf)), buf)
+	}
+	// keys and values handed to the store are intact
+	require.Equal(t, []byte("terces"), store.Get([]byte("key")))
+}
+
+func TestZeroizeSensitiveKeepsStoreBuffers(t *testing.T) {
+	ZeroizeSensitive = true
+	defer func() { ZeroizeSensitive = false }()
+
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := &copyingStore{KVStore: NewLookup(gasMeter)}
+	db := newTestDB(store, gasMeter, callID)
+
+	// without transforms, all buffers are handed to the store, which may retain them
+	_, _, ret := db.set([]byte("key"), []byte("secret"))
+	require.Equal(t, goErrorNone, ret)
+	value, _, _, ret := db.get([]byte("key"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("secret"), value)
+	_, _, ret = db.delete([]byte("key"))
+	require.Equal(t, goErrorNone, ret)
+	// cSet reads the key before writing it
+	require.Equal(t, [][]byte{[]byte("key"), []byte("key"), []byte("secret"), []byte("key"), []byte("key")}, store.received)
+}
+
+func TestWritePolicy(t *testing.T) {
+	WritePolicy = func(key []byte) error {
+		if bytes.HasPrefix(key, []byte("reserved/")) {
+			return fmt.Errorf("write to reserved key %q denied", key)
+		}
+		return nil
+	}
+	defer func() { WritePolicy = nil }()
+
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("reserved/config"), []byte("original"))
+	db := newTestDB(store, gasMeter, callID)
+
+	// allowed
+	usedGas, errMsg, ret := db.set([]byte("data/foo"), []byte("bar"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, "", errMsg)
+	require.Equal(t, uint64(GetPrice+SetPrice), usedGas)
+	usedGas, errMsg, ret = db.delete([]byte("data/foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, "", errMsg)
+	require.Equal(t, uint64(RemovePrice), usedGas)
+
+	// denied
+	usedGas, errMsg, ret = db.set([]byte("reserved/config"), []byte("changed"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, `write to reserved key "reserved/config" denied`, errMsg)
+	require.Equal(t, uint64(0), usedGas)
+	usedGas, errMsg, ret = db.delete([]byte("reserved/config"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, `write to reserved key "reserved/config" denied`, errMsg)
+	require.Equal(t, uint64(0), usedGas)
+
+	// reads are not affected
+	value, _, _, ret := db.get([]byte("reserved/config"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("original"), value)
+}
+
+func TestQueryAttribution(t *testing.T) {
+	type attribution struct {
+		checksum    string
+		requestType string
+		gas         uint64
+	}
+	var attributions []attribution
+	QueryAttribution = func(checksum []byte, requestType string, gas uint64) {
+		attributions = append(attributions, attribution{string(checksum), requestType, gas})
+	}
+	defer func() { QueryAttribution = nil }()
+
+	querier1 := buildQuerierState(&meteredQuerier{response: []byte(`{}`)}, startCall(), []byte("checksum1"))
+	defer endCall(querier1.CallID)
+	querier2 := buildQuerierState(&meteredQuerier{response: []byte(`{}`)}, startCall(), []byte("checksum2"))
+	defer endCall(querier2.CallID)
+
+	bankRequest := []byte(`{"bank":{"all_balances":{"address":"foo"}}}`)
+	wasmRequest := []byte(`{"wasm":{"raw":{"contract_addr":"foo","key":"YmFy"}}}`)
+
+	_, gas1, _, ret := query(&querier1, DEFAULT_QUERIER_GAS_LIMIT, bankRequest)
+	require.Equal(t, goErrorNone, ret)
+	_, gas2, _, ret := query(&querier2, DEFAULT_QUERIER_GAS_LIMIT, wasmRequest)
+	require.Equal(t, goErrorNone, ret)
+	_, gas3, _, ret := query(&querier1, DEFAULT_QUERIER_GAS_LIMIT, wasmRequest)
+	require.Equal(t, goErrorNone, ret)
+	require.NotZero(t, gas1)
+	require.NotZero(t, gas2)
+
+	require.Equal(t, []attribution{
+		{"checksum1", "bank", gas1},
+		{"checksum2", "wasm", gas2},
+		{"checksum1", "wasm", gas3},
+	}, attributions)
+}
+
+func TestQueryRequestType(t *testing.T) {
+	require.Equal(t, "bank", queryRequestType([]byte(`{"bank":{}}`)))
+	require.Equal(t, "custom", queryRequestType([]byte(`{"custom":{"ping":{}}}`)))
+	require.Equal(t, "unknown", queryRequestType([]byte(`{}`)))
+	require.Equal(t, "unknown", queryRequestType([]byte(`{"bank":{},"wasm":{}}`)))
+	require.Equal(t, "unknown", queryRequestType([]byte(`not json`)))
+}
+
+func TestGasSafetyMargin(t *testing.T) {
+	GasSafetyMargin = 1000
+	defer func() { GasSafetyMargin = 0 }()
+
+	callID := startCall()
+	defer endCall(callID)
+	// enough gas for one set (including its existence check) and one get plus the margin
+	gasMeter := NewMockGasMeter(SetPrice + 2*GetPrice + 1001)
+	store := NewLookup(gasMeter)
+	db := newTestDB(store, gasMeter, callID)
+
+	_, _, ret := db.set([]byte("foo"), []byte("bar"))
+	require.Equal(t, goErrorNone, ret)
+	value, _, _, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("bar"), value)
+
+	// 1001 gas left, which is more than the margin
+	require.Equal(t, uint64(SetPrice+2*GetPrice), gasMeter.GasConsumed())
+
+	// 1000 gas left, which is not more than the margin
+	gasMeter.ConsumeGas(1, "test")
+	usedGas, _, ret := db.set([]byte("foo"), []byte("baz"))
+	require.Equal(t, goErrorOutOfGas, ret)
+	require.Equal(t, uint64(0), usedGas)
+	_, _, _, ret = db.get([]byte("foo"))
+	require.Equal(t, goErrorOutOfGas, ret)
+	_, _, ret = db.delete([]byte("foo"))
+	require.Equal(t, goErrorOutOfGas, ret)
+	_, _, _, ret = db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorOutOfGas, ret)
+
+	// the store was not touched
+	require.Equal(t, uint64(SetPrice+2*GetPrice+1), gasMeter.GasConsumed())
+	require.Equal(t, []byte("bar"), store.WithGasMeter(NewMockGasMeter(GetPrice)).Get([]byte("foo")))
+}
+
+// unlimitedGasMeter does not expose a limit
+type unlimitedGasMeter struct{}
+
+func (unlimitedGasMeter) GasConsumed() Gas {
+	return 0
+}
+
+func TestGasSafetyMarginWithoutLimit(t *testing.T) {
+	GasSafetyMargin = 1000
+	defer func() { GasSafetyMargin = 0 }()
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT)), unlimitedGasMeter{}, callID)
+
+	_, _, ret := db.set([]byte("foo"), []byte("bar"))
+	require.Equal(t, goErrorNone, ret)
+}
+
+func TestScanBounds(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	cases := map[string]struct {
+		start []byte
+		end   []byte
+		valid bool
+	}{
+		"reversed bounds": {[]byte("b"), []byte("a"), false},
+		"equal bounds":    {[]byte("a"), []byte("a"), true},
+		"valid bounds":    {[]byte("a"), []byte("b"), true},
+		"nil start":       {nil, []byte("a"), true},
+		"nil end":         {[]byte("b"), nil, true},
+		"nil bounds":      {nil, nil, true},
+	}
+	for _, order := range []Order{Ascending, Descending} {
+		for name, tc := range cases {
+			_, gas, errMsg, ret := db.scan(tc.start, tc.end, order)
+			if tc.valid {
+				require.Equal(t, goErrorNone, ret, "%s (order %d)", name, order)
+				require.Empty(t, errMsg)
+			} else {
+				require.Equal(t, goErrorUser, ret, "%s (order %d)", name, order)
+				require.Contains(t, errMsg, "Invalid scan range")
+				require.Equal(t, uint64(0), gas)
+			}
+		}
+	}
+
+	// equal bounds are an empty range that is not forwarded to the store
+	for _, order := range []Order{Ascending, Descending} {
+		iterID, gas, _, ret := db.scan([]byte("a"), []byte("a"), order)
+		require.Equal(t, goErrorNone, ret)
+		require.Equal(t, uint64(0), gas)
+		key, _, _, _, ret := db.next(iterID)
+		require.Equal(t, goErrorNone, ret)
+		require.Nil(t, key)
+	}
+
+	// an invalid order is still a bad argument
+	_, _, _, ret := db.scan([]byte("b"), []byte("a"), 3)
+	require.Equal(t, goErrorBadArgument, ret)
+}
+
+func TestScanInvalidOrder(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	for _, order := range []Order{math.MinInt32, -1, 0, 3, math.MaxInt32} {
+		index, gas, errMsg, ret := db.scan(nil, nil, order)
+		require.Equal(t, goErrorBadArgument, ret, "order %d", order)
+		require.Equal(t, fmt.Sprintf("Invalid iteration order: %d", order), errMsg)
+		require.Equal(t, uint64(0), gas)
+		require.Equal(t, uint64(0), index)
+	}
+}
+
+func TestMaxIterSteps(t *testing.T) {
+	defer func(old uint64) { MaxIterSteps = old }(MaxIterSteps)
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+	store.Set([]byte("c"), []byte("3"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// below the limit
+	MaxIterSteps = 3
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	for _, expected := range []string{"a", "b", "c"} {
+		key, _, _, errMsg, ret := db.next(index)
+		require.Equal(t, goErrorNone, ret)
+		require.Empty(t, errMsg)
+		require.Equal(t, []byte(expected), key)
+	}
+	// reaching the end does not count as a step
+	key, _, _, _, ret := db.next(index)
+	require.Equal(t, goErrorNone, ret)
+	require.Nil(t, key)
+
+	// past the limit
+	MaxIterSteps = 2
+	index, _, _, ret = db.scan(nil, nil, Descending)
+	require.Equal(t, goErrorNone, ret)
+	for _, expected := range []string{"c", "b"} {
+		key, _, _, _, ret := db.next(index)
+		require.Equal(t, goErrorNone, ret)
+		require.Equal(t, []byte(expected), key)
+	}
+	key, _, _, errMsg, ret := db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "iterator step limit exceeded", errMsg)
+	require.Nil(t, key)
+
+	// disabled
+	MaxIterSteps = 0
+	key, _, _, _, ret = db.next(index)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("a"), key)
+}
+
+// sizedStore is a KVStore implementing SizedKVStore by counting its contents
+type sizedStore struct {
+	KVStore
+}
+
+func (s sizedStore) ApproximateSize() (uint64, uint64) {
+	var keys, bytes uint64
+	iter := s.Iterator(nil, nil)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		keys++
+		bytes += uint64(len(iter.Key()) + len(iter.Value()))
+	}
+	return keys, bytes
+}
+
+func TestApproximateSize(t *testing.T) {
+	store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	store.Set([]byte("foo"), []byte("bar"))
+	store.Set([]byte("hello"), []byte("world"))
+
+	// not implemented
+	keys, bytes, ok := ApproximateSize(store)
+	require.False(t, ok)
+	require.Equal(t, uint64(0), keys)
+	require.Equal(t, uint64(0), bytes)
+
+	// implemented
+	keys, bytes, ok = ApproximateSize(sizedStore{store})
+	require.True(t, ok)
+	require.Equal(t, uint64(2), keys)
+	require.Equal(t, uint64(16), bytes)
+}
+
+func TestScanEmptySizedStore(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	callID := startCall()
+	defer endCall(callID)
+
+	// an empty sized store does not occupy a frame slot
+	db := newTestDB(sizedStore{NewLookup(gasMeter)}, gasMeter, callID)
+	idx, gas, errMsg, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	require.Empty(t, errMsg)
+	require.Equal(t, uint64(0), gas)
+	require.Equal(t, uint64(emptyIteratorIndex), idx)
+	iteratorFramesMutex.Lock()
+	require.Empty(t, iteratorFrames[callID])
+	iteratorFramesMutex.Unlock()
+	for i := 0; i < 2; i++ {
+		key, val, _, errMsg, ret := db.next(idx)
+		require.Equal(t, goErrorNone, ret)
+		require.Empty(t, errMsg)
+		require.Nil(t, key)
+		require.Nil(t, val)
+	}
+
+	// a non-empty sized store is iterated as usual
+	store := NewLookup(gasMeter)
+	store.Set([]byte("foo"), []byte("bar"))
+	db = newTestDB(sizedStore{store}, gasMeter, callID)
+	idx, _, _, ret = db.scan(nil, nil, Descending)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(1), idx)
+	key, val, _, _, ret := db.next(idx)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("foo"), key)
+	require.Equal(t, []byte("bar"), val)
+	key, _, _, _, ret = db.next(idx)
+	require.Equal(t, goErrorNone, ret)
+	require.Nil(t, key)
+}
+
+func TestOnIteratorEnd(t *testing.T) {
+	type event struct {
+		callID, index, steps uint64
+	}
+	var events []event
+	OnIteratorEnd = func(callID, index uint64, stepsTaken uint64) {
+		events = append(events, event{callID, index, stepsTaken})
+	}
+	defer func() { OnIteratorEnd = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+	store.Set([]byte("c"), []byte("3"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	for i := 0; i < 3; i++ {
+		key, _, _, _, ret := db.next(index)
+		require.Equal(t, goErrorNone, ret)
+		require.NotNil(t, key)
+	}
+	require.Empty(t, events)
+
+	// the hook fires once, even if cNext is called again at the end
+	for i := 0; i < 3; i++ {
+		key, _, _, _, ret := db.next(index)
+		require.Equal(t, goErrorNone, ret)
+		require.Nil(t, key)
+	}
+	require.Equal(t, []event{{callID, index, 3}}, events)
+
+	// an iterator that is not exhausted does not trigger the hook
+	other, _, _, ret := db.scan([]byte("b"), nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, _, ret = db.next(other)
+	require.Equal(t, goErrorNone, ret)
+	require.Len(t, events, 1)
+}
+
+func TestOnIteratorEndCanInspectIterator(t *testing.T) {
+	var dump string
+	OnIteratorEnd = func(callID, index uint64, stepsTaken uint64) {
+		// both lock the iterator, which must not be held by cNext while the hook runs
+		require.NoError(t, LabelIterator(callID, index, "exhausted"))
+		dump = DumpFrames()
+	}
+	defer func() { OnIteratorEnd = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	for i := 0; i < 2; i++ {
+		_, _, _, _, ret = db.next(index)
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Contains(t, dump, "exhausted")
+}
+
+func TestQueryTypeGasLimits(t *testing.T) {
+	QueryTypeGasLimits = map[string]uint64{
+		"wasm":    1000,
+		"staking": 1_000_000,
+	}
+	defer func() { QueryTypeGasLimits = nil }()
+
+	querier := &meteredQuerier{response: []byte(`{}`)}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+
+	requests := [][]byte{
+		// type limit is lower than the global limit
+		[]byte(`{"wasm":{"smart":{"contract_addr":"foo","msg":"e30="}}}`),
+		// type limit is higher than the global limit
+		[]byte(`{"staking":{"bonded_denom":{}}}`),
+		// no type limit
+		[]byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`),
+	}
+	for _, request := range requests {
+		_, _, _, ret := query(&state, 50000, request)
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, []uint64{1000, 50000, 50000}, querier.gasLimits)
+}
+
+func TestMaxQueriesPerCall(t *testing.T) {
+	defer func(old uint64) { MaxQueriesPerCall = old }(MaxQueriesPerCall)
+	MaxQueriesPerCall = 3
+
+	request := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+	querier := &meteredQuerier{response: []byte(`{}`)}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+
+	for i := 0; i < 3; i++ {
+		_, _, errMsg, ret := query(&state, 50000, request)
+		require.Equal(t, goErrorNone, ret)
+		require.Empty(t, errMsg)
+	}
+	for i := 0; i < 2; i++ {
+		_, gas, errMsg, ret := query(&state, 50000, request)
+		require.Equal(t, goErrorUser, ret)
+		require.Equal(t, "query call limit exceeded", errMsg)
+		require.Equal(t, uint64(0), gas)
+	}
+	require.Len(t, querier.gasLimits, 3)
+
+	// calls are counted separately
+	other := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(other.CallID)
+	_, _, _, ret := query(&other, 50000, request)
+	require.Equal(t, goErrorNone, ret)
+
+	// no limit
+	MaxQueriesPerCall = 0
+	_, _, _, ret = query(&state, 50000, request)
+	require.Equal(t, goErrorNone, ret)
+}
+
+func TestNilKVStore(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	callID := startCall()
+	defer endCall(callID)
+
+	// DB pointer to a nil store
+	db := newTestDB(nil, gasMeter, callID)
+	_, _, errMsg, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorBadArgument, ret)
+	require.Equal(t, errNilKVStore, errMsg)
+	_, errMsg, ret = db.set([]byte("foo"), []byte("bar"))
+	require.Equal(t, goErrorBadArgument, ret)
+	require.Equal(t, errNilKVStore, errMsg)
+	_, errMsg, ret = db.delete([]byte("foo"))
+	require.Equal(t, goErrorBadArgument, ret)
+	require.Equal(t, errNilKVStore, errMsg)
+	_, _, errMsg, ret = db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorBadArgument, ret)
+	require.Equal(t, errNilKVStore, errMsg)
+
+	// no DB pointer at all
+	c := buildDB(&db.state, &db.gasMeter)
+	var usedGas cu64
+	val := newUnmanagedVector(nil)
+	errOut := newUnmanagedVector(nil)
+	ret = cGet(nil, c.gas_meter, &usedGas, constructU8SliceView([]byte("foo")), &val, &errOut)
+	require.Equal(t, goErrorBadArgument, ret)
+	_, isNone := UnmanagedVectorBytes(errOut)
+	require.True(t, isNone)
+}
+
+func TestWithoutGas(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("foo"), []byte("bar"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	_, gas, _, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(GetPrice), gas)
+
+	WithoutGas(callID, func() {
+		val, gas, _, ret := db.get([]byte("foo"))
+		require.Equal(t, goErrorNone, ret)
+		require.Equal(t, []byte("bar"), val)
+		require.Equal(t, uint64(0), gas)
+
+		// nested
+		WithoutGas(callID, func() {
+			_, gas, _, _ := db.get([]byte("foo"))
+			require.Equal(t, uint64(0), gas)
+		})
+		_, gas, _, _ = db.get([]byte("foo"))
+		require.Equal(t, uint64(0), gas)
+
+		// other calls are not affected
+		otherCallID := startCall()
+		defer endCall(otherCallID)
+		other := newTestDB(store, gasMeter, otherCallID)
+		_, gas, _, _ = other.get([]byte("foo"))
+		require.Equal(t, uint64(GetPrice), gas)
+	})
+
+	_, gas, _, ret = db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(GetPrice), gas)
+}
+
+func TestWithReadOnly(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("foo"), []byte("bar"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	_, _, ret := db.set([]byte("a"), []byte("1"))
+	require.Equal(t, goErrorNone, ret)
+
+	WithReadOnly(callID, func() {
+		_, errMsg, ret := db.set([]byte("b"), []byte("2"))
+		require.Equal(t, goErrorUser, ret)
+		require.Equal(t, errReadOnly, errMsg)
+		_, errMsg, ret = db.delete([]byte("a"))
+		require.Equal(t, goErrorUser, ret)
+		require.Equal(t, errReadOnly, errMsg)
+
+		// reads work
+		val, _, _, ret := db.get([]byte("foo"))
+		require.Equal(t, goErrorNone, ret)
+		require.Equal(t, []byte("bar"), val)
+
+		// nested
+		WithReadOnly(callID, func() {})
+		_, _, ret = db.set([]byte("b"), []byte("2"))
+		require.Equal(t, goErrorUser, ret)
+
+		// other calls are not affected
+		otherCallID := startCall()
+		defer endCall(otherCallID)
+		other := newTestDB(store, gasMeter, otherCallID)
+		_, _, ret = other.set([]byte("c"), []byte("3"))
+		require.Equal(t, goErrorNone, ret)
+	})
+	require.Nil(t, store.Get([]byte("b")))
+	require.Equal(t, []byte("1"), store.Get([]byte("a")))
+
+	_, _, ret = db.set([]byte("b"), []byte("2"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.delete([]byte("a"))
+	require.Equal(t, goErrorNone, ret)
+}
+
+func TestMaxHumanAddressLen(t *testing.T) {
+	defer func(old int) { MaxHumanAddressLen = old }(MaxHumanAddressLen)
+	MaxHumanAddressLen = 20
+
+	humanize := func(length int) ([]byte, string, goError) {
+		api := &GoAPI{
+			HumanAddress: func(canon []byte) (string, uint64, error) {
+				return strings.Repeat("a", length), 0, nil
+			},
+		}
+		apiState := buildAPIState(api, 0)
+		a := buildAPI(&apiState)
+		var usedGas cu64
+		dest := newUnmanagedVector(nil)
+		errOut := newUnmanagedVector(nil)
+		ret := cHumanAddress(a.state, constructU8SliceView([]byte{0x01}), &dest, &errOut, &usedGas)
+		return copyAndDestroyUnmanagedVector(dest), string(copyAndDestroyUnmanagedVector(errOut)), ret
+	}
+
+	// below and at the limit
+	for _, length := range []int{19, 20} {
+		human, errMsg, ret := humanize(length)
+		require.Equal(t, goErrorNone, ret)
+		require.Empty(t, errMsg)
+		require.Len(t, human, length)
+	}
+
+	// above the limit
+	human, errMsg, ret := humanize(21)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "Human address too long: 21 bytes exceeds the limit of 20", errMsg)
+	require.Nil(t, human)
+
+	// disabled
+	MaxHumanAddressLen = 0
+	human, _, ret = humanize(5000)
+	require.Equal(t, goErrorNone, ret)
+	require.Len(t, human, 5000)
+}
+
+func TestQuerySerializationGasPerByte(t *testing.T) {
+	defer func() { QuerySerializationGasPerByte = 0 }()
+	request := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+
+	for _, size := range []int{10, 100, 1000} {
+		querier := &meteredQuerier{response: bytes.Repeat([]byte{'a'}, size)}
+		state := buildQuerierState(querier, startCall(), []byte("checksum"))
+
+		QuerySerializationGasPerByte = 0
+		result, baseGas, _, ret := query(&state, 50000, request)
+		require.Equal(t, goErrorNone, ret)
+		require.Greater(t, len(result), size)
+
+		QuerySerializationGasPerByte = 7
+		result, gas, _, ret := query(&state, 50000, request)
+		require.Equal(t, goErrorNone, ret)
+		require.Equal(t, baseGas+7*uint64(len(result)), gas)
+
+		endCall(state.CallID)
+	}
+}
+
+func TestResponseRewriter(t *testing.T) {
+	defer func() { ResponseRewriter = nil }()
+
+	querier := &meteredQuerier{response: []byte(`{}`)}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+	request := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+
+	original, _, _, ret := query(&state, 50000, request)
+	require.Equal(t, goErrorNone, ret)
+
+	var receivedRequest, receivedResponse []byte
+	ResponseRewriter = func(request, response []byte) ([]byte, error) {
+		receivedRequest, receivedResponse = request, response
+		return []byte(`{"ok":{"ok":"cmV3cml0dGVu"}}`), nil
+	}
+	result, _, errMsg, ret := query(&state, 50000, request)
+	require.Equal(t, goErrorNone, ret)
+	require.Empty(t, errMsg)
+	require.Equal(t, request, receivedRequest)
+	require.Equal(t, original, receivedResponse)
+	require.Equal(t, []byte(`{"ok":{"ok":"cmV3cml0dGVu"}}`), result)
+
+	ResponseRewriter = func(_, _ []byte) ([]byte, error) {
+		return nil, errors.New("response rejected")
+	}
+	result, _, errMsg, ret = query(&state, 50000, request)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "response rejected", errMsg)
+	require.Nil(t, result)
+}
+
+func TestCallbackGasTotal(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+	querier := &meteredQuerier{response: []byte(`{}`)}
+	querierState := buildQuerierState(querier, callID, []byte("checksum"))
+	require.Equal(t, uint64(0), CallbackGasTotal(callID))
+
+	var expected uint64
+	_, gas, _, _ := db.get([]byte("a"))
+	expected += gas
+	gas, _, _ = db.set([]byte("b"), []byte("2"))
+	expected += gas
+	index, gas, _, _ := db.scan(nil, nil, Ascending)
+	expected += gas
+	_, _, gas, _, _ = db.next(index)
+	expected += gas
+	_, gas, _, _ = query(&querierState, 50000, []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`))
+	expected += gas
+	require.Greater(t, gas, uint64(0))
+	gas, _, _ = db.delete([]byte("a"))
+	expected += gas
+
+	// suspended gas is not counted
+	WithoutGas(callID, func() {
+		_, gas, _, _ = db.get([]byte("b"))
+		require.Equal(t, uint64(0), gas)
+	})
+
+	// cSet includes the existence check
+	require.Equal(t, uint64(2*GetPrice+SetPrice+RangePrice+RemovePrice)+querier.usedGas, expected)
+	require.Equal(t, expected, CallbackGasTotal(callID))
+
+	// other calls are tracked separately
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	require.Equal(t, uint64(0), CallbackGasTotal(otherCallID))
+}
+
+func TestMissedReads(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("present1"), []byte("1"))
+	store.Set([]byte("present2"), []byte("2"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+	require.Equal(t, uint64(0), MissedReads(callID))
+
+	for _, key := range []string{"present1", "absent1", "present2", "absent2", "absent1", "present1"} {
+		_, _, _, ret := db.get([]byte(key))
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, uint64(3), MissedReads(callID))
+
+	// writes do not count
+	_, _, ret := db.set([]byte("absent3"), []byte("3"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(3), MissedReads(callID))
+}
+
+// readGasStore charges gasPerByte for every byte of a value read
+type readGasStore struct {
+	KVStore
+	gasMeter   GasConsumer
+	gasPerByte uint64
+}
+
+func (s readGasStore) Get(key []byte) []byte {
+	v := s.KVStore.Get(key)
+	s.gasMeter.ConsumeGas(uint64(len(v))*s.gasPerByte, "read")
+	return v
+}
+
+func TestOnGasSizeMismatch(t *testing.T) {
+	defer func(old uint64) { ValueBytesPerGas = old }(ValueBytesPerGas)
+	defer func() { OnGasSizeMismatch = nil }()
+
+	type mismatch struct {
+		key      string
+		valueLen int
+		usedGas  uint64
+	}
+	var mismatches []mismatch
+	OnGasSizeMismatch = func(key []byte, valueLen int, usedGas uint64) {
+		mismatches = append(mismatches, mismatch{string(key), valueLen, usedGas})
+	}
+	ValueBytesPerGas = 1
+
+	run := func(gasPerByte uint64) {
+		gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+		inner := newSortedKVStore()
+		inner.Set([]byte("small"), []byte("1"))
+		inner.Set([]byte("large"), bytes.Repeat([]byte{1}, 100))
+		store := readGasStore{KVStore: inner, gasMeter: gasMeter, gasPerByte: gasPerByte}
+		callID := startCall()
+		defer endCall(callID)
+		db := newTestDB(store, gasMeter, callID)
+		for _, key := range []string{"small", "large", "absent"} {
+			_, _, _, ret := db.get([]byte(key))
+			require.Equal(t, goErrorNone, ret)
+		}
+	}
+
+	// consistent store
+	run(1)
+	require.Empty(t, mismatches)
+
+	// charging more than implied is fine
+	ValueBytesPerGas = 2
+	run(1)
+	require.Empty(t, mismatches)
+
+	// store charging too little
+	ValueBytesPerGas = 1
+	run(0)
+	require.Equal(t, []mismatch{{"small", 1, 0}, {"large", 100, 0}}, mismatches)
+	mismatches = nil
+
+	// disabled
+	ValueBytesPerGas = 0
+	run(0)
+	require.Empty(t, mismatches)
+}
+
+func TestMissedReadGas(t *testing.T) {
+	defer func(old uint64) { MissedReadGas = old }(MissedReadGas)
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("present"), []byte("1"))
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// disabled
+	_, presentGas, _, _ := db.get([]byte("present"))
+	_, absentGas, _, _ := db.get([]byte("absent"))
+	require.Equal(t, uint64(GetPrice), presentGas)
+	require.Equal(t, uint64(GetPrice), absentGas)
+
+	MissedReadGas = 1234
+	_, presentGas, _, _ = db.get([]byte("present"))
+	val, absentGas, _, ret := db.get([]byte("absent"))
+	require.Equal(t, goErrorNone, ret)
+	require.Nil(t, val)
+	require.Equal(t, uint64(GetPrice), presentGas)
+	require.Equal(t, uint64(GetPrice)+1234, absentGas)
+
+	// not charged while gas is suspended
+	WithoutGas(callID, func() {
+		_, gas, _, _ := db.get([]byte("absent"))
+		require.Equal(t, uint64(0), gas)
+	})
+}
+
+func TestSafeCallback(t *testing.T) {
+	cases := map[string]struct {
+		fn       func() error
+		expected goError
+	}{
+		"success": {
+			fn:       func() error { return nil },
+			expected: goErrorNone,
+		},
+		"error": {
+			fn:       func() error { return errors.New("not found") },
+			expected: goErrorUser,
+		},
+		"callback error": {
+			fn:       func() error { return callbackError(goErrorBadArgument) },
+			expected: goErrorBadArgument,
+		},
+		"wrapped callback error": {
+			fn:       func() error { return fmt.Errorf("wrapped: %w", callbackError(goErrorCannotSerialize)) },
+			expected: goErrorCannotSerialize,
+		},
+		"out of gas panic": {
+			fn:       func() error { panic(ErrorOutOfGas{Descriptor: "test"}) },
+			expected: goErrorOutOfGas,
+		},
+		"other panic": {
+			fn:       func() error { panic("boom") },
+			expected: goErrorPanic,
+		},
+	}
+	for name, tc := range cases {
+		require.Equal(t, tc.expected, safeCallback("test", tc.fn), name)
+	}
+}
+
+func TestCacheCanonicalAddresses(t *testing.T) {
+	defer func(old bool) { CacheCanonicalAddresses = old }(CacheCanonicalAddresses)
+
+	var hostCalls []string
+	api := &GoAPI{
+		CanonicalAddress: func(human string) ([]byte, uint64, error) {
+			hostCalls = append(hostCalls, human)
+			if human == "invalid" {
+				return nil, 7, errors.New("invalid address")
+			}
+			return append([]byte("canon-"), human...), uint64(100 + len(hostCalls)), nil
+		},
+	}
+	callID := startCall()
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	canonicalize := func(human string) ([]byte, uint64, goError) {
+		var usedGas cu64
+		dest := newUnmanagedVector(nil)
+		errOut := newUnmanagedVector(nil)
+		ret := cCanonicalAddress(a.state, constructU8SliceView([]byte(human)), &dest, &errOut, &usedGas)
+		copyAndDestroyUnmanagedVector(errOut)
+		return copyAndDestroyUnmanagedVector(dest), uint64(usedGas), ret
+	}
+
+	// disabled by default
+	canonicalize("alice")
+	canonicalize("alice")
+	require.Equal(t, []string{"alice", "alice"}, hostCalls)
+	hostCalls = nil
+
+	CacheCanonicalAddresses = true
+	// miss
+	canon, gas, ret := canonicalize("bob")
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("canon-bob"), canon)
+	require.Equal(t, uint64(101), gas)
+	// hits are charged the gas of the original conversion
+	for i := 0; i < 3; i++ {
+		canon, gas, ret = canonicalize("bob")
+		require.Equal(t, goErrorNone, ret)
+		require.Equal(t, []byte("canon-bob"), canon)
+		require.Equal(t, uint64(101), gas)
+	}
+	canon, gas, _ = canonicalize("carol")
+	require.Equal(t, []byte("canon-carol"), canon)
+	require.Equal(t, uint64(102), gas)
+	require.Equal(t, []string{"bob", "carol"}, hostCalls)
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		_, gas, ret = canonicalize("invalid")
+		require.Equal(t, goErrorUser, ret)
+		require.Equal(t, uint64(7), gas)
+	}
+	require.Equal(t, []string{"bob", "carol", "invalid", "invalid"}, hostCalls)
+
+	// the cache is dropped when the call ends
+	endCall(callID)
+	hostCalls = nil
+	newCallID := startCall()
+	defer endCall(newCallID)
+	apiState = buildAPIState(api, newCallID)
+	a = buildAPI(&apiState)
+	canonicalize("bob")
+	require.Equal(t, []string{"bob"}, hostCalls)
+}
+
+func TestCanonicalAddressErrors(t *testing.T) {
+	canonicalize := func(fn CanonicalizeAddress) ([]byte, string, goError) {
+		apiState := buildAPIState(&GoAPI{CanonicalAddress: fn}, 0)
+		a := buildAPI(&apiState)
+		var usedGas cu64
+		dest := newUnmanagedVector(nil)
+		errOut := newUnmanagedVector(nil)
+		ret := cCanonicalAddress(a.state, constructU8SliceView([]byte("human")), &dest, &errOut, &usedGas)
+		return copyAndDestroyUnmanagedVector(dest), string(copyAndDestroyUnmanagedVector(errOut)), ret
+	}
+
+	canon, errMsg, ret := canonicalize(func(string) ([]byte, uint64, error) { return []byte{0x01}, 5, nil })
+	require.Equal(t, goErrorNone, ret)
+	require.Empty(t, errMsg)
+	require.Equal(t, []byte{0x01}, canon)
+
+	canon, errMsg, ret = canonicalize(func(string) ([]byte, uint64, error) { return nil, 5, errors.New("invalid address") })
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "invalid address", errMsg)
+	require.Nil(t, canon)
+
+	_, _, ret = canonicalize(func(string) ([]byte, uint64, error) { return []byte{}, 5, nil })
+	require.Equal(t, goErrorPanic, ret)
+}
+
+func TestPrintStackOnPanic(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	stackPrinted := 0
+	printStack = func() { stackPrinted++ }
+	defer func() {
+		printStack = debug.PrintStack
+		PrintStackOnPanic = true
+	}()
+
+	ret := safeCallback("cTest", func() error { panic(errors.New("secret internal detail")) })
+	require.Equal(t, goErrorPanic, ret)
+	require.Equal(t, 1, stackPrinted)
+	require.Contains(t, logs.String(), "Panic in cTest:")
+	require.Contains(t, logs.String(), "secret internal detail")
+
+	PrintStackOnPanic = false
+	logs.Reset()
+	ret = safeCallback("cTest", func() error { panic(errors.New("secret internal detail")) })
+	require.Equal(t, goErrorPanic, ret)
+	require.Equal(t, 1, stackPrinted)
+	require.Contains(t, logs.String(), "Panic in cTest: *errors.errorString")
+	require.NotContains(t, logs.String(), "secret internal detail")
+}
+
+func TestValueValidator(t *testing.T) {
+	ValueValidator = func(value []byte) error {
+		if !json.Valid(value) {
+			return errors.New("value is not valid JSON")
+		}
+		return nil
+	}
+	defer func() { ValueValidator = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	for _, value := range []string{`{"count":1}`, `[1,2,3]`, `"text"`, `null`} {
+		_, errMsg, ret := db.set([]byte("valid"), []byte(value))
+		require.Equal(t, goErrorNone, ret)
+		require.Empty(t, errMsg)
+		require.Equal(t, []byte(value), store.Get([]byte("valid")))
+	}
+
+	for _, value := range []string{`{"count":`, `text`, ``} {
+		gas, errMsg, ret := db.set([]byte("invalid"), []byte(value))
+		require.Equal(t, goErrorUser, ret)
+		require.Equal(t, "value is not valid JSON", errMsg)
+		require.Equal(t, uint64(0), gas)
+	}
+	require.Nil(t, store.Get([]byte("invalid")))
+}
+
+func TestOnLargeAllocation(t *testing.T) {
+	type allocation struct {
+		callback string
+		size     int
+	}
+	var allocations []allocation
+	OnLargeAllocation = func(callback string, size int) {
+		allocations = append(allocations, allocation{callback, size})
+	}
+	defer func(old int) {
+		OnLargeAllocation = nil
+		LargeAllocationThreshold = old
+	}(LargeAllocationThreshold)
+	LargeAllocationThreshold = 1000
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("small"), bytes.Repeat([]byte{0x01}, 1000))
+	store.Set([]byte("large"), bytes.Repeat([]byte{0x02}, 1001))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	_, _, _, ret := db.get([]byte("small"))
+	require.Equal(t, goErrorNone, ret)
+	require.Empty(t, allocations)
+
+	val, _, _, ret := db.get([]byte("large"))
+	require.Equal(t, goErrorNone, ret)
+	require.Len(t, val, 1001)
+	require.Equal(t, []allocation{{"cGet", 1001}}, allocations)
+
+	index, _, _, ret := db.scan([]byte("large"), nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, _, ret = db.next(index)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []allocation{{"cGet", 1001}, {"cNext", 1001}}, allocations)
+}
+
+func TestVtableInfo(t *testing.T) {
+	expected := map[string]map[string]string{
+		"db": {
+			"read_db":   "cGet",
+			"write_db":  "cSet",
+			"remove_db": "cDelete",
+			"scan_db":   "cScan",
+		},
+		"iterator": {
+			"next_db": "cNext",
+		},
+		"api": {
+			"humanize_address":     "cHumanAddress",
+			"canonicalize_address": "cCanonicalAddress",
+		},
+		"querier": {
+			"query_external": "cQueryExternal",
+		},
+	}
+	require.Equal(t, expected, VtableInfo())
+}
+
+func TestMaxAddressConversionGas(t *testing.T) {
+	defer func(old uint64) { MaxAddressConversionGas = old }(MaxAddressConversionGas)
+	MaxAddressConversionGas = 1000
+
+	var cost uint64
+	api := &GoAPI{
+		HumanAddress: func(canon []byte) (string, uint64, error) {
+			return "human", cost, nil
+		},
+		CanonicalAddress: func(human string) ([]byte, uint64, error) {
+			return []byte("canonical"), cost, nil
+		},
+	}
+	apiState := buildAPIState(api, 0)
+	a := buildAPI(&apiState)
+	convert := func() (uint64, string, goError, uint64, string, goError) {
+		var humanGas, canonicalGas cu64
+		dest := newUnmanagedVector(nil)
+		errOut := newUnmanagedVector(nil)
+		humanRet := cHumanAddress(a.state, constructU8SliceView([]byte("canonical")), &dest, &errOut, &humanGas)
+		copyAndDestroyUnmanagedVector(dest)
+		humanErr := string(copyAndDestroyUnmanagedVector(errOut))
+
+		dest = newUnmanagedVector(nil)
+		errOut = newUnmanagedVector(nil)
+		canonicalRet := cCanonicalAddress(a.state, constructU8SliceView([]byte("human")), &dest, &errOut, &canonicalGas)
+		copyAndDestroyUnmanagedVector(dest)
+		canonicalErr := string(copyAndDestroyUnmanagedVector(errOut))
+		return uint64(humanGas), humanErr, humanRet, uint64(canonicalGas), canonicalErr, canonicalRet
+	}
+
+	// at the limit
+	cost = 1000
+	humanGas, humanErr, humanRet, canonicalGas, canonicalErr, canonicalRet := convert()
+	require.Equal(t, goErrorNone, humanRet)
+	require.Empty(t, humanErr)
+	require.Equal(t, uint64(1000), humanGas)
+	require.Equal(t, goErrorNone, canonicalRet)
+	require.Empty(t, canonicalErr)
+	require.Equal(t, uint64(1000), canonicalGas)
+
+	// excessive cost is not charged
+	cost = math.MaxUint64
+	humanGas, humanErr, humanRet, canonicalGas, canonicalErr, canonicalRet = convert()
+	expectedErr := fmt.Sprintf("Address conversion gas too high: %d exceeds the limit of 1000", uint64(math.MaxUint64))
+	require.Equal(t, goErrorUser, humanRet)
+	require.Equal(t, expectedErr, humanErr)
+	require.Equal(t, uint64(0), humanGas)
+	require.Equal(t, goErrorUser, canonicalRet)
+	require.Equal(t, expectedErr, canonicalErr)
+	require.Equal(t, uint64(0), canonicalGas)
+
+	// disabled
+	MaxAddressConversionGas = 0
+	humanGas, _, humanRet, canonicalGas, _, canonicalRet = convert()
+	require.Equal(t, goErrorNone, humanRet)
+	require.Equal(t, uint64(math.MaxUint64), humanGas)
+	require.Equal(t, goErrorNone, canonicalRet)
+	require.Equal(t, uint64(math.MaxUint64), canonicalGas)
+}
+
+func TestReadWriteTransform(t *testing.T) {
+	defer func() {
+		ReadTransform = nil
+		WriteTransform = nil
+	}()
+	WriteTransform = func(value []byte) ([]byte, error) {
+		if bytes.Equal(value, []byte("forbidden")) {
+			return nil, errors.New("cannot encrypt")
+		}
+		out := []byte("enc:")
+		for _, b := range value {
+			out = append(out, b^0xff)
+		}
+		return out, nil
+	}
+	ReadTransform = func(value []byte) ([]byte, error) {
+		if !bytes.HasPrefix(value, []byte("enc:")) {
+			return nil, errors.New("not encrypted")
+		}
+		var out []byte
+		for _, b := range value[4:] {
+			out = append(out, b^0xff)
+		}
+		return out, nil
+	}
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	for _, key := range []string{"a", "b"} {
+		_, _, ret := db.set([]byte(key), []byte("value-"+key))
+		require.Equal(t, goErrorNone, ret)
+	}
+	// the store only sees transformed values
+	require.Equal(t, []byte("enc:\x89\x9e\x93\x8a\x9a\xd2\x9e"), store.Get([]byte("a")))
+
+	val, _, _, ret := db.get([]byte("a"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("value-a"), val)
+	val, _, _, ret = db.get([]byte("missing"))
+	require.Equal(t, goErrorNone, ret)
+	require.Nil(t, val)
+
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	var pairs []string
+	for {
+		key, value, _, _, ret := db.next(index)
+		require.Equal(t, goErrorNone, ret)
+		if key == nil {
+			break
+		}
+		pairs = append(pairs, string(key)+"="+string(value))
+	}
+	require.Equal(t, []string{"a=value-a", "b=value-b"}, pairs)
+
+	// errors are returned to the contract
+	_, errMsg, ret := db.set([]byte("c"), []byte("forbidden"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "cannot encrypt", errMsg)
+	require.Nil(t, store.Get([]byte("c")))
+
+	store.Set([]byte("plain"), []byte("value"))
+	_, _, errMsg, ret = db.get([]byte("plain"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "not encrypted", errMsg)
+	index, _, _, ret = db.scan([]byte("plain"), nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, errMsg, ret = db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "not encrypted", errMsg)
+}
+
+func TestScanApprover(t *testing.T) {
+	type scanRequest struct {
+		start, end []byte
+		order      Order
+	}
+	var requests []scanRequest
+	ScanApprover = func(start, end []byte, order Order) error {
+		requests = append(requests, scanRequest{start, end, order})
+		if start == nil && end == nil {
+			return errors.New("full-domain scans are not allowed")
+		}
+		return nil
+	}
+	defer func() { ScanApprover = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// narrow ranges are approved
+	index, _, errMsg, ret := db.scan([]byte("a"), []byte("b"), Ascending)
+	require.Equal(t, goErrorNone, ret)
+	require.Empty(t, errMsg)
+	key, _, _, _, _ := db.next(index)
+	require.Equal(t, []byte("a"), key)
+	_, _, _, ret = db.scan(nil, []byte("b"), Descending)
+	require.Equal(t, goErrorNone, ret)
+
+	// full-domain scans are rejected
+	for _, order := range []Order{Ascending, Descending} {
+		_, gas, errMsg, ret := db.scan(nil, nil, order)
+		require.Equal(t, goErrorUser, ret)
+		require.Equal(t, "full-domain scans are not allowed", errMsg)
+		require.Equal(t, uint64(0), gas)
+	}
+
+	require.Equal(t, []scanRequest{
+		{[]byte("a"), []byte("b"), Ascending},
+		{nil, []byte("b"), Descending},
+		{nil, nil, Ascending},
+		{nil, nil, Descending},
+	}, requests)
+
+	// invalid ranges are rejected before the approver is consulted
+	_, _, errMsg, ret = db.scan([]byte("b"), []byte("a"), Ascending)
+	require.Equal(t, goErrorUser, ret)
+	require.Contains(t, errMsg, "Invalid scan range")
+	require.Len(t, requests, 4)
+}
+
+// refundingQuerier is a buggy querier whose gas consumed decreases with every query
+type refundingQuerier struct {
+	meteredQuerier
+}
+
+func (q *refundingQuerier) Query(request types.QueryRequest, gasLimit uint64) ([]byte, error) {
+	q.usedGas -= 100
+	return q.response, nil
+}
+
+func TestQuerierGasDecrease(t *testing.T) {
+	var attributed []uint64
+	QueryAttribution = func(checksum []byte, requestType string, gas uint64) {
+		attributed = append(attributed, gas)
+	}
+	defer func() { QueryAttribution = nil }()
+
+	request := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+	querier := &refundingQuerier{meteredQuerier{usedGas: 1000, response: []byte(`{}`)}}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+
+	res, gas, errMsg, ret := query(&state, 50000, request)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "Querier gas consumed decreased from 1000 to 900", errMsg)
+	require.Nil(t, res)
+	require.Equal(t, uint64(0), gas)
+	require.Equal(t, uint64(0), CallbackGasTotal(state.CallID))
+	require.Empty(t, attributed)
+
+	// a monotonic querier works as before
+	monotonic := &meteredQuerier{usedGas: 1000, response: []byte(`{}`)}
+	state = buildQuerierState(monotonic, state.CallID, []byte("checksum"))
+	_, gas, _, ret = query(&state, 50000, request)
+	require.Equal(t, goErrorNone, ret)
+	require.Greater(t, gas, uint64(0))
+	require.Len(t, attributed, 1)
+}
+
+func TestOnKeyCreated(t *testing.T) {
+	var created []string
+	OnKeyCreated = func(key []byte) {
+		created = append(created, string(key))
+	}
+	defer func() { OnKeyCreated = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("existing"), []byte("value"))
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// create
+	consumedBefore := gasMeter.GasConsumed()
+	gas, _, ret := db.set([]byte("new"), []byte("value"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []string{"new"}, created)
+	// the existence check is reported along with the write
+	require.Equal(t, uint64(GetPrice+SetPrice), gas)
+	require.Equal(t, gasMeter.GasConsumed()-consumedBefore, gas)
+
+	// update
+	db.set([]byte("new"), []byte("value2"))
+	db.set([]byte("existing"), []byte("value2"))
+	require.Equal(t, []string{"new"}, created)
+
+	// delete then recreate
+	db.delete([]byte("existing"))
+	require.Equal(t, []string{"new"}, created)
+	db.set([]byte("existing"), []byte("value3"))
+	require.Equal(t, []string{"new", "existing"}, created)
+
+	// failed writes do not create keys
+	WithReadOnly(callID, func() {
+		_, _, ret := db.set([]byte("readonly"), []byte("value"))
+		require.Equal(t, goErrorUser, ret)
+	})
+	require.Equal(t, []string{"new", "existing"}, created)
+
+	// the gas does not depend on whether the hook is set
+	OnKeyCreated = nil
+	gas, _, ret = db.set([]byte("other"), []byte("value"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(GetPrice+SetPrice), gas)
+}
+
+// lastValueStore remembers the last value passed to Set without writing it, so it accepts nil values
+type lastValueStore struct {
+	KVStore
+	lastValue []byte
+	sets      int
+}
+
+func (s *lastValueStore) Set(key, value []byte) {
+	s.lastValue = cloneBytes(value)
+	s.sets++
+}
+
+func TestNilValues(t *testing.T) {
+	defer func(old NilValuePolicy) { NilValues = old }(NilValues)
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := &lastValueStore{KVStore: newSortedKVStore()}
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	for _, policy := range []NilValuePolicy{NilValuePassThrough, NilValueReject, NilValueAsEmpty} {
+		NilValues = policy
+
+		// empty values are never changed
+		_, _, ret := db.set([]byte("empty"), []byte{})
+		require.Equal(t, goErrorNone, ret)
+		require.NotNil(t, store.lastValue)
+		require.Empty(t, store.lastValue)
+
+		sets := store.sets
+		_, errMsg, ret := db.set([]byte("nil"), nil)
+		switch policy {
+		case NilValuePassThrough:
+			require.Equal(t, goErrorNone, ret)
+			require.Nil(t, store.lastValue)
+		case NilValueReject:
+			require.Equal(t, goErrorUser, ret)
+			require.Equal(t, errNilValue, errMsg)
+			require.Equal(t, sets, store.sets)
+		case NilValueAsEmpty:
+			require.Equal(t, goErrorNone, ret)
+			require.NotNil(t, store.lastValue)
+			require.Empty(t, store.lastValue)
+		}
+	}
+}
+
+// failingQuerier returns err for every query
+type failingQuerier struct {
+	meteredQuerier
+	err error
+}
+
+func (q *failingQuerier) Query(request types.QueryRequest, gasLimit uint64) ([]byte, error) {
+	return nil, q.err
+}
+
+func TestOnQueryError(t *testing.T) {
+	var requests [][]byte
+	var errs []error
+	OnQueryError = func(request []byte, err error) {
+		requests = append(requests, request)
+		errs = append(errs, err)
+	}
+	defer func() { OnQueryError = nil }()
+
+	request := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+
+	// querier error
+	querier := &failingQuerier{err: types.NoSuchContract{Addr: "foo"}}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+	_, _, _, ret := query(&state, 50000, request)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, [][]byte{request}, requests)
+	require.EqualError(t, errs[0], "no such contract: foo")
+
+	// serialization error
+	marshalQuerierResult = func(res types.QuerierResult) ([]byte, error) {
+		return nil, errors.New("cannot serialize")
+	}
+	defer func() {
+		marshalQuerierResult = func(res types.QuerierResult) ([]byte, error) {
+			return json.Marshal(res)
+		}
+	}()
+	ok := buildQuerierState(&meteredQuerier{response: []byte(`{}`)}, state.CallID, []byte("checksum"))
+	_, _, errMsg, ret := query(&ok, 50000, request)
+	require.Equal(t, goErrorCannotSerialize, ret)
+	require.Equal(t, "cannot serialize", errMsg)
+	require.Equal(t, [][]byte{request, request}, requests)
+	require.EqualError(t, errs[1], "cannot serialize")
+
+	// the hook is optional
+	OnQueryError = nil
+	_, _, _, ret = query(&ok, 50000, request)
+	require.Equal(t, goErrorCannotSerialize, ret)
+	require.Len(t, requests, 2)
+}
+
+func TestVectorAllocations(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+	require.Equal(t, uint64(0), VectorAllocations(callID))
+
+	// every read allocates one vector, also for absent keys
+	for _, key := range []string{"a", "absent", "b"} {
+		_, _, _, ret := db.get([]byte(key))
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, uint64(3), VectorAllocations(callID))
+
+	// writes and deletes do not return data
+	_, _, ret := db.set([]byte("c"), []byte("3"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.delete([]byte("a"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(3), VectorAllocations(callID))
+
+	// every iterator step allocates a key and a value vector
+	idx, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	for i := 0; i < 2; i++ {
+		_, _, _, _, ret = db.next(idx)
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, uint64(7), VectorAllocations(callID))
+	// the end of the iteration does not allocate
+	key, _, _, _, ret := db.next(idx)
+	require.Equal(t, goErrorNone, ret)
+	require.Nil(t, key)
+	require.Equal(t, uint64(7), VectorAllocations(callID))
+
+	// calls are counted separately
+	require.Equal(t, uint64(0), VectorAllocations(callID+1))
+}
+
+func TestOnQueryGasLimit(t *testing.T) {
+	type observation struct {
+		requestType string
+		limit       uint64
+	}
+	var observed []observation
+	OnQueryGasLimit = func(requestType string, limit uint64) {
+		observed = append(observed, observation{requestType, limit})
+	}
+	defer func() { OnQueryGasLimit = nil }()
+	QueryTypeGasLimits = map[string]uint64{"wasm": 1000}
+	defer func() { QueryTypeGasLimits = nil }()
+
+	querier := &meteredQuerier{response: []byte(`{}`)}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+
+	_, _, _, ret := query(&state, 50000, []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`))
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, ret = query(&state, 40000, []byte(`{"wasm":{"smart":{"contract_addr":"foo","msg":"e30="}}}`))
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, ret = query(&state, 30000, []byte(`not json`))
+	require.Equal(t, goErrorNone, ret)
+
+	// the hook sees the limit given by the VM, the querier the limit for the request type
+	require.Equal(t, []observation{{"bank", 50000}, {"wasm", 40000}, {"unknown", 30000}}, observed)
+	require.Equal(t, []uint64{50000, 1000}, querier.gasLimits)
+}
+
+func TestGasRounding(t *testing.T) {
+	defer func() {
+		GasRoundingUnit = 0
+		GasRounding = Floor
+	}()
+
+	// gas amounts are reported in units of 100, so these are 12.34, 12.5, 12.99, 13 and 0.01 units
+	deltas := []uint64{1234, 1250, 1299, 1300, 1}
+	cases := map[GasRoundingMode][]uint64{
+		Floor: {1200, 1200, 1200, 1300, 0},
+		Ceil:  {1300, 1300, 1300, 1300, 100},
+		Round: {1200, 1300, 1300, 1300, 0},
+	}
+	callID := startCall()
+	defer endCall(callID)
+	for mode, expected := range cases {
+		GasRoundingUnit = 100
+		GasRounding = mode
+		for i, delta := range deltas {
+			require.Equal(t, expected[i], reportGas(callID, 5000, 5000+delta), "mode %d, delta %d", mode, delta)
+		}
+	}
+
+	// disabled, also the default
+	GasRoundingUnit = 0
+	GasRounding = Ceil
+	require.Equal(t, uint64(1234), reportGas(callID, 0, 1234))
+
+	// rounding up saturates
+	GasRoundingUnit = 1000
+	require.Equal(t, uint64(math.MaxUint64/1000*1000), roundGas(math.MaxUint64))
+
+	// applied to the gas reported by callbacks
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	db := newTestDB(store, gasMeter, callID)
+	GasRoundingUnit = 1000
+	GasRounding = Floor
+	_, gas, _, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(GetPrice), gas)
+	GasRoundingUnit = 100000
+	_, gas, _, _ = db.get([]byte("foo"))
+	require.Equal(t, uint64(0), gas)
+	GasRounding = Ceil
+	_, gas, _, _ = db.get([]byte("foo"))
+	require.Equal(t, uint64(100000), gas)
+}
+
+func TestQueryNotFound(t *testing.T) {
+	var failed [][]byte
+	OnQueryError = func(request []byte, err error) {
+		failed = append(failed, request)
+	}
+	defer func() { OnQueryError = nil }()
+
+	request := []byte(`{"wasm":{"smart":{"contract_addr":"foo","msg":"e30="}}}`)
+	notFound := &failingQuerier{err: fmt.Errorf("contract foo: %w", types.ErrNotFound)}
+	state := buildQuerierState(notFound, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+
+	// not found is encoded the same way for all queries
+	bankRequest := []byte(`{"bank":{"balance":{"address":"foo","denom":"stake"}}}`)
+	for _, req := range [][]byte{request, bankRequest} {
+		res, _, _, ret := query(&state, 50000, req)
+		require.Equal(t, goErrorNone, ret)
+		var result types.QuerierResult
+		require.NoError(t, json.Unmarshal(res, &result))
+		require.Nil(t, result.Ok)
+		require.Equal(t, &types.SystemError{InvalidRequest: &types.InvalidRequest{Err: "not found", Request: req}}, result.Err)
+	}
+	require.Len(t, failed, 2)
+	failed = nil
+
+	// a genuine error
+	failing := buildQuerierState(&failingQuerier{err: errors.New("try again later")}, state.CallID, []byte("checksum"))
+	res, _, _, ret := query(&failing, 50000, request)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, `{"ok":{"error":"try again later"}}`, string(res))
+	require.Len(t, failed, 1)
+}
+
+// outOfGasStore runs out of gas on every read
+type outOfGasStore struct {
+	KVStore
+}
+
+func (outOfGasStore) Get(key []byte) []byte {
+	PanicOutOfGas()
+	return nil
+}
+
+// outOfGasQuerier runs out of gas on every query
+type outOfGasQuerier struct {
+	meteredQuerier
+}
+
+func (*outOfGasQuerier) Query(request types.QueryRequest, gasLimit uint64) ([]byte, error) {
+	PanicOutOfGas()
+	return nil, nil
+}
+
+func TestPanicOutOfGas(t *testing.T) {
+	require.PanicsWithValue(t, ErrorOutOfGas{Descriptor: "PanicOutOfGas"}, PanicOutOfGas)
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(outOfGasStore{NewLookup(gasMeter)}, gasMeter, callID)
+	_, _, errMsg, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorOutOfGas, ret)
+	require.Empty(t, errMsg)
+
+	state := buildQuerierState(&outOfGasQuerier{}, callID, []byte("checksum"))
+	_, _, errMsg, ret = query(&state, 50000, []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`))
+	require.Equal(t, goErrorOutOfGas, ret)
+	require.Empty(t, errMsg)
+}
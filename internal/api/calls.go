@@ -0,0 +1,511 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// callState holds data collected during one contract call, from startCall to endCall
+type callState struct {
+	// startTime is the time the call was started
+	startTime time.Time
+	// checksum is the checksum of the contract being executed, set by setCallChecksum
+	checksum []byte
+	// maxValueWritten is the size of the largest value written by cSet during this call
+	maxValueWritten int
+	// entryPoints are the names of the contract entry points invoked under this call ID in order
+	entryPoints []string
+	// gasSuspended is greater than 0 while the host runs operations that must not be charged to the contract
+	gasSuspended int
+	// readOnly is greater than 0 while writes are forbidden, see WithReadOnly
+	readOnly int
+	// callbackGas is the sum of the gas reported as used by the DB and querier callbacks
+	callbackGas uint64
+	// lastCallback and lastCallbackGas are the name and the reported gas of the most recent callback
+	lastCallback    string
+	lastCallbackGas uint64
+	// currentEntryPoint is the entry point callback gas is currently attributed to, see MarkEntryPoint
+	currentEntryPoint string
+	// gasByEntryPoint is callbackGas bucketed by currentEntryPoint
+	gasByEntryPoint map[string]uint64
+	// queries is the number of queries issued through cQueryExternal
+	queries uint64
+	// canonicalAddresses caches the results of GoAPI.CanonicalAddress if CacheCanonicalAddresses is set
+	canonicalAddresses map[string]canonicalAddress
+	// missedReads is the number of cGet calls for keys not present in the store
+	missedReads uint64
+	// vectorAllocations is the number of vectors allocated for data returned by callbacks.
+	// It is updated without holding activeCallsMutex exclusively, see recordVectorAllocation.
+	vectorAllocations atomic.Uint64
+	// scanPrefix is the prefix all scans of the call must stay within, see RequireScanPrefix
+	scanPrefix []byte
+	// lastAppendKey is the last key written under the prefix of AppendOnlyWrites
+	lastAppendKey []byte
+	// writtenKeys is the set of keys written by cSet, bounded by MaxTrackedKeysWritten
+	writtenKeys map[string]struct{}
+	// lastWriteOps maps keys to whether their last write in this call was a delete, see OnWriteAfterDelete
+	lastWriteOps map[string]bool
+	// writtenKeysCapped is set when a key was not added to writtenKeys because it was full
+	writtenKeysCapped bool
+	// ctx is the cancellation token of the call checked by cNext and cQueryExternal and passed
+	// to ContextQueriers. It is created on first use and canceled by cancel (see AbortCall).
+	ctx    context.Context
+	cancel context.CancelFunc
+	// cleanups are run by endCall after OnContractEnd, before the call is unregistered
+	cleanups []func()
+}
+
+// activeCalls contains the state of all contract calls currently running, indexed by contract call ID.
+var activeCalls = make(map[uint64]*callState)
+var activeCallsMutex sync.RWMutex
+
+// registerCall adds a new entry to activeCalls. Called by startCall.
+func registerCall(callID uint64) {
+	activeCallsMutex.Lock()
+	defer activeCallsMutex.Unlock()
+	activeCalls[callID] = &callState{startTime: nowFunc()}
+}
+
+// unregisterCall removes the entry from activeCalls. Called by endCall.
+func unregisterCall(callID uint64) {
+	activeCallsMutex.Lock()
+	defer activeCallsMutex.Unlock()
+	delete(activeCalls, callID)
+}
+
+// withCallState runs fn with the state of the given call while holding activeCallsMutex.
+// Nothing happens if the call is not active.
+func withCallState(callID uint64, fn func(state *callState)) {
+	activeCallsMutex.Lock()
+	defer activeCallsMutex.Unlock()
+	if state, ok := activeCalls[callID]; ok {
+		fn(state)
+	}
+}
+
+// lookupCallState returns the state of the given call or nil if the call is not active.
+// The returned state must only be used for fields that are safe for concurrent use without activeCallsMutex.
+func lookupCallState(callID uint64) *callState {
+	activeCallsMutex.RLock()
+	defer activeCallsMutex.RUnlock()
+	return activeCalls[callID]
+}
+
+// setCallChecksum stores the checksum of the contract executed in the given call
+func setCallChecksum(callID uint64, checksum []byte) {
+	withCallState(callID, func(state *callState) {
+		state.checksum = checksum
+	})
+}
+
+// callChecksum returns the checksum of the contract executed in the given call, or nil if unknown
+func callChecksum(callID uint64) []byte {
+	var checksum []byte
+	withCallState(callID, func(state *callState) {
+		checksum = state.checksum
+	})
+	return checksum
+}
+
+// onCallEnd registers a function that is run by endCall when the given call ends
+func onCallEnd(callID uint64, fn func()) {
+	withCallState(callID, func(state *callState) {
+		state.cleanups = append(state.cleanups, fn)
+	})
+}
+
+// recordEntryPoint appends the name of an invoked entry point (e.g. "instantiate") to the log of the given call
+// and attributes subsequent callback gas to it
+func recordEntryPoint(callID uint64, entryPoint string) {
+	withCallState(callID, func(state *callState) {
+		state.entryPoints = append(state.entryPoints, entryPoint)
+		state.currentEntryPoint = entryPoint
+	})
+}
+
+// MarkEntryPoint attributes all callback gas reported after this point to the entry point with the given name,
+// until the next entry point is marked. The VM marks the entry points it invokes automatically; hosts can use
+// this to set custom boundaries within a call. See GasByEntryPoint.
+func MarkEntryPoint(callID uint64, name string) {
+	withCallState(callID, func(state *callState) {
+		state.currentEntryPoint = name
+	})
+}
+
+// GasByEntryPoint returns the callback gas of the given call bucketed by the entry point that was marked
+// when the gas was reported. Gas reported before any entry point was marked is attributed to "".
+// The data is only available while the call is running. Returns nil for unknown calls.
+func GasByEntryPoint(callID uint64) map[string]uint64 {
+	var out map[string]uint64
+	withCallState(callID, func(state *callState) {
+		out = make(map[string]uint64, len(state.gasByEntryPoint))
+		for name, gas := range state.gasByEntryPoint {
+			out[name] = gas
+		}
+	})
+	return out
+}
+
+// CallEntryPoints returns the names of the entry points invoked under the given call ID in order.
+// The data is only available while the call is running. Returns nil for unknown calls.
+func CallEntryPoints(callID uint64) []string {
+	var out []string
+	withCallState(callID, func(state *callState) {
+		out = append(out, state.entryPoints...)
+	})
+	return out
+}
+
+// WithoutGas runs fn with gas reporting suspended for the given call, such that the callbacks
+// report 0 used gas to the contract. This is meant for host-internal bookkeeping like maintenance reads
+// which must not be charged to the contract. Note that gas consumed on the gas meter is not reverted.
+// Calls can be nested.
+func WithoutGas(callID uint64, fn func()) {
+	withCallState(callID, func(state *callState) {
+		state.gasSuspended++
+	})
+	defer withCallState(callID, func(state *callState) {
+		state.gasSuspended--
+	})
+	fn()
+}
+
+// errReadOnly is the error returned to the contract for writes inside of WithReadOnly
+const errReadOnly = "write in read-only section"
+
+// WithReadOnly runs fn with writes forbidden for the given call, such that cSet and cDelete fail
+// with a user error. This allows the host to enforce read-only sections of a call. Calls can be nested.
+func WithReadOnly(callID uint64, fn func()) {
+	withCallState(callID, func(state *callState) {
+		state.readOnly++
+	})
+	defer withCallState(callID, func(state *callState) {
+		state.readOnly--
+	})
+	fn()
+}
+
+// isReadOnly returns true if the given call is inside of WithReadOnly
+func isReadOnly(callID uint64) bool {
+	var readOnly bool
+	withCallState(callID, func(state *callState) {
+		readOnly = state.readOnly > 0
+	})
+	return readOnly
+}
+
+// CallbackGasTotal returns the sum of the gas reported to the VM by all DB and querier callbacks
+// of the given call so far. This allows hosts to reconcile their accounting against the VM.
+// The data is only available while the call is running. Returns 0 for unknown calls.
+func CallbackGasTotal(callID uint64) uint64 {
+	var total uint64
+	withCallState(callID, func(state *callState) {
+		total = state.callbackGas
+	})
+	return total
+}
+
+// setLastCallbackGas records the gas reported by the most recent callback of the call
+func setLastCallbackGas(callID uint64, callback string, gas uint64) {
+	withCallState(callID, func(state *callState) {
+		state.lastCallback, state.lastCallbackGas = callback, gas
+	})
+}
+
+// LastCallbackGas returns the name of the most recent callback of the given call (e.g. "cGet") and the gas
+// it reported to the VM. This allows debuggers to show the most recent host-side gas charge.
+// Returns an empty name if no callback was run yet or the call is unknown.
+func LastCallbackGas(callID uint64) (callback string, gas uint64) {
+	withCallState(callID, func(state *callState) {
+		callback, gas = state.lastCallback, state.lastCallbackGas
+	})
+	return callback, gas
+}
+
+// RequireScanPrefix restricts the scans of the given call to keys starting with prefix. Scans whose range
+// crosses the boundaries of the prefix are rejected with a user error, which catches contracts scanning
+// too broadly. A nil prefix removes the restriction (the default).
+func RequireScanPrefix(callID uint64, prefix []byte) {
+	withCallState(callID, func(state *callState) {
+		state.scanPrefix = cloneBytes(prefix)
+	})
+}
+
+// validateCallScanRange checks the scan range [start, end) against the prefix set by RequireScanPrefix
+func validateCallScanRange(callID uint64, start, end []byte) error {
+	var prefix []byte
+	withCallState(callID, func(state *callState) {
+		prefix = state.scanPrefix
+	})
+	if prefix == nil {
+		return nil
+	}
+	return checkScanPrefix(start, end, prefix)
+}
+
+// recordQuery counts a query issued by the contract and returns the number of queries of the call so far.
+// Returns 0 for unknown calls.
+func recordQuery(callID uint64) uint64 {
+	var count uint64
+	withCallState(callID, func(state *callState) {
+		state.queries++
+		count = state.queries
+	})
+	return count
+}
+
+// canonicalAddress is a cached result of GoAPI.CanonicalAddress
+type canonicalAddress struct {
+	canonical []byte
+	cost      uint64
+}
+
+// cachedCanonicalAddress returns the cached canonical form of human in the given call
+func cachedCanonicalAddress(callID uint64, human string) ([]byte, uint64, bool) {
+	var entry canonicalAddress
+	var ok bool
+	withCallState(callID, func(state *callState) {
+		entry, ok = state.canonicalAddresses[human]
+	})
+	return entry.canonical, entry.cost, ok
+}
+
+// cacheCanonicalAddress stores the canonical form of human for the rest of the given call
+func cacheCanonicalAddress(callID uint64, human string, canonical []byte, cost uint64) {
+	withCallState(callID, func(state *callState) {
+		if state.canonicalAddresses == nil {
+			state.canonicalAddresses = make(map[string]canonicalAddress)
+		}
+		state.canonicalAddresses[human] = canonicalAddress{canonical: canonical, cost: cost}
+	})
+}
+
+// recordMissedRead counts a read of an absent key. Called by cGet.
+func recordMissedRead(callID uint64) {
+	withCallState(callID, func(state *callState) {
+		state.missedReads++
+	})
+}
+
+// MissedReads returns the number of reads of absent keys in the given call.
+// This reveals contracts probing many non-existent keys and helps tuning read caches.
+// The data is only available while the call is running. Returns 0 for unknown calls.
+func MissedReads(callID uint64) uint64 {
+	var count uint64
+	withCallState(callID, func(state *callState) {
+		count = state.missedReads
+	})
+	return count
+}
+
+// recordVectorAllocation counts a vector allocated for data returned by a callback. Called by newCallbackVector.
+// This is on the hot path of every callback, so it only takes a read lock.
+func recordVectorAllocation(callID uint64) {
+	if state := lookupCallState(callID); state != nil {
+		state.vectorAllocations.Add(1)
+	}
+}
+
+// VectorAllocations returns the number of vectors allocated for data returned to the VM by callbacks
+// (values, iterator keys, addresses and query results) in the given call. Vectors for error messages are not counted.
+// Together with the byte sizes this helps finding allocation-heavy contracts even if the values are small.
+// The data is only available while the call is running. Returns 0 for unknown calls.
+func VectorAllocations(callID uint64) uint64 {
+	if state := lookupCallState(callID); state != nil {
+		return state.vectorAllocations.Load()
+	}
+	return 0
+}
+
+// MaxTrackedKeysWritten is the maximum number of distinct keys tracked per call for DistinctKeysWritten.
+// This bounds the memory used for tracking.
+var MaxTrackedKeysWritten = 10000
+
+// recordKeyWritten adds key to the set of keys written in the given call. Called by cSet.
+func recordKeyWritten(callID uint64, key []byte) {
+	withCallState(callID, func(state *callState) {
+		if _, ok := state.writtenKeys[string(key)]; ok {
+			return
+		}
+		if len(state.writtenKeys) >= MaxTrackedKeysWritten {
+			state.writtenKeysCapped = true
+			return
+		}
+		if state.writtenKeys == nil {
+			state.writtenKeys = make(map[string]struct{})
+		}
+		state.writtenKeys[string(key)] = struct{}{}
+	})
+}
+
+// OnWriteAfterDelete is called when a key is written by cSet after being deleted by cDelete in the same call,
+// or deleted after being written. Such sequences can reveal contract bugs, like unintentionally resurrected keys.
+// Up to MaxTrackedKeysWritten keys are tracked per call. The key must not be retained.
+// Set to nil to disable (the default).
+var OnWriteAfterDelete func(key []byte)
+
+// recordWriteOp remembers whether the last write of key in the given call was a delete and calls
+// OnWriteAfterDelete if the previous write was of the other kind. Called by cSet and cDelete.
+func recordWriteOp(callID uint64, key []byte, deleted bool) {
+	if OnWriteAfterDelete == nil {
+		return
+	}
+	var flipped bool
+	withCallState(callID, func(state *callState) {
+		previous, ok := state.lastWriteOps[string(key)]
+		if !ok && len(state.lastWriteOps) >= MaxTrackedKeysWritten {
+			return
+		}
+		if state.lastWriteOps == nil {
+			state.lastWriteOps = make(map[string]bool)
+		}
+		state.lastWriteOps[string(key)] = deleted
+		flipped = ok && previous != deleted
+	})
+	// called without holding activeCallsMutex
+	if flipped {
+		OnWriteAfterDelete(key)
+	}
+}
+
+// DistinctKeysWritten returns the number of distinct keys written in the given call.
+// If more than MaxTrackedKeysWritten keys were written, the result is a lower bound
+// (see DistinctKeysWrittenIsApproximate).
+// The data is only available while the call is running. Returns 0 for unknown calls.
+func DistinctKeysWritten(callID uint64) int {
+	var count int
+	withCallState(callID, func(state *callState) {
+		count = len(state.writtenKeys)
+	})
+	return count
+}
+
+// DistinctKeysWrittenIsApproximate returns true if the given call wrote more distinct keys
+// than can be tracked, such that DistinctKeysWritten only returns a lower bound.
+func DistinctKeysWrittenIsApproximate(callID uint64) bool {
+	var capped bool
+	withCallState(callID, func(state *callState) {
+		capped = state.writtenKeysCapped
+	})
+	return capped
+}
+
+// OnContractStart is called on the goroutine of every contract call before the contract is executed.
+// callID is the ID under which the per-call data of the call (e.g. CallbackGasTotal) can be accessed until
+// OnContractEnd is called. store is the KVStore passed to the call, which allows the host to associate the call ID
+// with its own context of the call. The checksum must not be modified.
+var OnContractStart func(callID uint64, entryPoint string, checksum []byte, store KVStore)
+
+// beginCall records the checksum and entry point of a call created by startCall and calls OnContractStart
+func beginCall(callID uint64, checksum []byte, entryPoint string, store KVStore) {
+	setCallChecksum(callID, checksum)
+	recordEntryPoint(callID, entryPoint)
+	if OnContractStart != nil {
+		OnContractStart(callID, entryPoint, checksum, store)
+	}
+}
+
+// OnContractEnd is called by endCall with the wall-clock duration of the call. The call is still registered
+// while the hook runs, so the per-call accessors (e.g. CallbackGasTotal) return the final data of the call.
+var OnContractEnd func(callID uint64, d time.Duration)
+
+// CallDuration returns the time elapsed since the given call was started.
+// Returns 0 for unknown calls and calls that already ended.
+func CallDuration(callID uint64) time.Duration {
+	var d time.Duration
+	withCallState(callID, func(state *callState) {
+		d = nowFunc().Sub(state.startTime)
+	})
+	return d
+}
+
+// errIterationAborted is returned to the contract by cNext when the call was aborted via AbortCall
+const errIterationAborted = "iteration aborted"
+
+// callContext returns the cancellation token of the given call, which is canceled by AbortCall.
+// For unknown calls, a context that is never canceled is returned.
+func callContext(callID uint64) context.Context {
+	ctx := context.Background()
+	withCallState(callID, func(state *callState) {
+		initCallContext(state)
+		ctx = state.ctx
+	})
+	return ctx
+}
+
+// initCallContext creates the cancellation token of a call if it does not exist yet.
+// Must be called while holding activeCallsMutex.
+func initCallContext(state *callState) {
+	if state.ctx != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	state.ctx, state.cancel = ctx, cancel
+	state.cleanups = append(state.cleanups, cancel)
+}
+
+// isAborted returns true if the given call was aborted via AbortCall.
+// Unlike callContext it does not create the token, which keeps the check cheap for cNext.
+func isAborted(callID uint64) bool {
+	aborted := false
+	withCallState(callID, func(state *callState) {
+		aborted = state.ctx != nil && state.ctx.Err() != nil
+	})
+	return aborted
+}
+
+// AbortCall aborts the given call, e.g. when the execution is aborted by an outer timeout.
+// Both iteration and queries are stopped: in-flight and future cNext and cQueryExternal calls
+// return an error to the contract. Queriers implementing ContextQuerier observe the cancellation
+// through their context.
+func AbortCall(callID uint64) {
+	withCallState(callID, func(state *callState) {
+		initCallContext(state)
+		state.cancel()
+	})
+}
+
+// AbortQueries cancels all in-flight and future queries of the given call.
+//
+// Deprecated: The cancellation of queries and iteration is unified. Use AbortCall, which this calls.
+func AbortQueries(callID uint64) {
+	AbortCall(callID)
+}
+
+// ActiveCallIDs returns the IDs of all contract calls currently running in ascending order.
+// This is meant for diagnostics like building a "what's running now" view.
+func ActiveCallIDs() []uint64 {
+	activeCallsMutex.Lock()
+	defer activeCallsMutex.Unlock()
+	out := make([]uint64, 0, len(activeCalls))
+	for callID := range activeCalls {
+		out = append(out, callID)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// ActiveChecksums returns the distinct checksums of the contracts currently running, hex encoded and sorted.
+// Calls for which no checksum is known are not included. This shows which contracts are live during an incident.
+func ActiveChecksums() []string {
+	activeCallsMutex.Lock()
+	defer activeCallsMutex.Unlock()
+	seen := make(map[string]struct{})
+	out := []string{}
+	for _, state := range activeCalls {
+		if state.checksum == nil {
+			continue
+		}
+		checksum := hex.EncodeToString(state.checksum)
+		if _, ok := seen[checksum]; !ok {
+			seen[checksum] = struct{}{}
+			out = append(out, checksum)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
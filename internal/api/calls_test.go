@@ -0,0 +1,357 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestActiveCallIDs(t *testing.T) {
+	const count = 20
+
+	callIDs := make(chan uint64, count)
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			callIDs <- startCall()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	close(callIDs)
+
+	var started []uint64
+	for callID := range callIDs {
+		started = append(started, callID)
+	}
+	active := ActiveCallIDs()
+	require.Subset(t, active, started)
+	for i := 1; i < len(active); i++ {
+		require.Less(t, active[i-1], active[i])
+	}
+
+	// end half of the calls concurrently
+	wg.Add(count / 2)
+	for _, callID := range started[:count/2] {
+		go func(callID uint64) {
+			endCall(callID)
+			wg.Done()
+		}(callID)
+	}
+	wg.Wait()
+
+	active = ActiveCallIDs()
+	require.Subset(t, active, started[count/2:])
+	for _, callID := range started[:count/2] {
+		require.NotContains(t, active, callID)
+	}
+
+	for _, callID := range started[count/2:] {
+		endCall(callID)
+	}
+	for _, callID := range started {
+		require.NotContains(t, ActiveCallIDs(), callID)
+	}
+}
+
+func TestActiveChecksums(t *testing.T) {
+	checksum1 := []byte{0xaa, 0x01}
+	checksum2 := []byte{0xbb, 0x02}
+
+	first := startCall()
+	setCallChecksum(first, checksum1)
+	second := startCall()
+	setCallChecksum(second, checksum2)
+	third := startCall()
+	setCallChecksum(third, checksum1)
+	unknown := startCall()
+	defer endCall(unknown)
+
+	active := ActiveChecksums()
+	require.Subset(t, active, []string{"aa01", "bb02"})
+	require.True(t, sort.StringsAreSorted(active))
+	// the checksum running twice is listed once
+	var count int
+	for _, checksum := range active {
+		if checksum == "aa01" {
+			count++
+		}
+	}
+	require.Equal(t, 1, count)
+
+	// a checksum is listed while any of its calls is running
+	endCall(first)
+	require.Contains(t, ActiveChecksums(), "aa01")
+	endCall(third)
+	require.NotContains(t, ActiveChecksums(), "aa01")
+	require.Contains(t, ActiveChecksums(), "bb02")
+	endCall(second)
+	require.NotContains(t, ActiveChecksums(), "bb02")
+}
+
+func TestCallEntryPoints(t *testing.T) {
+	callID := startCall()
+	require.Nil(t, CallEntryPoints(callID))
+
+	recordEntryPoint(callID, "instantiate")
+	recordEntryPoint(callID, "execute")
+	recordEntryPoint(callID, "reply")
+	entryPoints := CallEntryPoints(callID)
+	require.Equal(t, []string{"instantiate", "execute", "reply"}, entryPoints)
+
+	// the result is a copy
+	entryPoints[0] = "modified"
+	require.Equal(t, []string{"instantiate", "execute", "reply"}, CallEntryPoints(callID))
+
+	// calls are tracked separately
+	otherCallID := startCall()
+	recordEntryPoint(otherCallID, "query")
+	require.Equal(t, []string{"query"}, CallEntryPoints(otherCallID))
+	require.Len(t, CallEntryPoints(callID), 3)
+
+	endCall(callID)
+	endCall(otherCallID)
+	require.Nil(t, CallEntryPoints(callID))
+	recordEntryPoint(callID, "migrate")
+	require.Nil(t, CallEntryPoints(callID))
+}
+
+func TestGasByEntryPoint(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	db := newTestDB(store, gasMeter, callID)
+	require.Equal(t, map[string]uint64{}, GasByEntryPoint(callID))
+
+	unmarkedGas, _, _ := db.set([]byte("a"), []byte("1"))
+	require.Greater(t, unmarkedGas, uint64(0))
+
+	MarkEntryPoint(callID, "instantiate")
+	var instantiateGas uint64
+	gas, _, _ := db.set([]byte("b"), []byte("2"))
+	instantiateGas += gas
+	_, gas, _, _ = db.get([]byte("a"))
+	instantiateGas += gas
+
+	MarkEntryPoint(callID, "execute")
+	executeGas, _, _ := db.set([]byte("c"), []byte("3"))
+
+	// returning to an entry point adds to its bucket
+	MarkEntryPoint(callID, "instantiate")
+	gas, _, _ = db.delete([]byte("b"))
+	instantiateGas += gas
+
+	byEntryPoint := GasByEntryPoint(callID)
+	require.Equal(t, map[string]uint64{
+		"":            unmarkedGas,
+		"instantiate": instantiateGas,
+		"execute":     executeGas,
+	}, byEntryPoint)
+	require.Equal(t, unmarkedGas+instantiateGas+executeGas, CallbackGasTotal(callID))
+
+	// the result is a copy
+	byEntryPoint["execute"] = 0
+	require.Equal(t, executeGas, GasByEntryPoint(callID)["execute"])
+
+	// entry points invoked by the VM are marked automatically
+	recordEntryPoint(callID, "reply")
+	replyGas, _, _ := db.set([]byte("d"), []byte("4"))
+	require.Equal(t, replyGas, GasByEntryPoint(callID)["reply"])
+
+	endCall(callID)
+	require.Nil(t, GasByEntryPoint(callID))
+}
+
+func TestDistinctKeysWritten(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+	require.Equal(t, 0, DistinctKeysWritten(callID))
+
+	for _, key := range []string{"a", "b", "a", "c", "b", "a"} {
+		_, _, ret := db.set([]byte(key), []byte("value"))
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, 3, DistinctKeysWritten(callID))
+	require.False(t, DistinctKeysWrittenIsApproximate(callID))
+
+	// reads and deletes do not count
+	db.get([]byte("d"))
+	db.delete([]byte("e"))
+	require.Equal(t, 3, DistinctKeysWritten(callID))
+}
+
+func TestOnWriteAfterDelete(t *testing.T) {
+	var flagged []string
+	OnWriteAfterDelete = func(key []byte) {
+		flagged = append(flagged, string(key))
+	}
+	defer func() { OnWriteAfterDelete = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("existing"), []byte("value"))
+	callID := startCall()
+	db := newTestDB(store, gasMeter, callID)
+
+	// delete then set
+	db.delete([]byte("existing"))
+	require.Empty(t, flagged)
+	db.set([]byte("existing"), []byte("resurrected"))
+	require.Equal(t, []string{"existing"}, flagged)
+
+	// set then delete
+	db.set([]byte("temp"), []byte("value"))
+	db.set([]byte("temp"), []byte("value2"))
+	require.Equal(t, []string{"existing"}, flagged)
+	db.delete([]byte("temp"))
+	require.Equal(t, []string{"existing", "temp"}, flagged)
+
+	// repeated operations of the same kind are fine
+	db.delete([]byte("temp"))
+	db.set([]byte("other"), []byte("value"))
+	db.set([]byte("other"), []byte("value"))
+	require.Equal(t, []string{"existing", "temp"}, flagged)
+
+	// calls are tracked separately
+	endCall(callID)
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	other := newTestDB(store, gasMeter, otherCallID)
+	other.set([]byte("temp"), []byte("value"))
+	require.Equal(t, []string{"existing", "temp"}, flagged)
+}
+
+func TestDistinctKeysWrittenCapped(t *testing.T) {
+	defer func(old int) { MaxTrackedKeysWritten = old }(MaxTrackedKeysWritten)
+	MaxTrackedKeysWritten = 3
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	for _, key := range []string{"a", "b", "c", "a"} {
+		db.set([]byte(key), []byte("value"))
+	}
+	require.Equal(t, 3, DistinctKeysWritten(callID))
+	require.False(t, DistinctKeysWrittenIsApproximate(callID))
+
+	db.set([]byte("d"), []byte("value"))
+	require.Equal(t, 3, DistinctKeysWritten(callID))
+	require.True(t, DistinctKeysWrittenIsApproximate(callID))
+}
+
+func TestCallDuration(t *testing.T) {
+	clock := useFakeClock(t)
+	ended := make(map[uint64]time.Duration)
+	OnContractEnd = func(callID uint64, d time.Duration) {
+		ended[callID] = d
+	}
+	defer func() { OnContractEnd = nil }()
+
+	callID := startCall()
+	require.Equal(t, time.Duration(0), CallDuration(callID))
+	clock.Advance(150 * time.Millisecond)
+	require.Equal(t, 150*time.Millisecond, CallDuration(callID))
+
+	otherCallID := startCall()
+	clock.Advance(50 * time.Millisecond)
+	require.Equal(t, 200*time.Millisecond, CallDuration(callID))
+	require.Equal(t, 50*time.Millisecond, CallDuration(otherCallID))
+
+	endCall(otherCallID)
+	clock.Advance(25 * time.Millisecond)
+	endCall(callID)
+	require.Equal(t, map[uint64]time.Duration{
+		callID:      225 * time.Millisecond,
+		otherCallID: 50 * time.Millisecond,
+	}, ended)
+	require.Equal(t, time.Duration(0), CallDuration(callID))
+}
+
+func TestOnContractEndReadsCallData(t *testing.T) {
+	type result struct {
+		callbackGas uint64
+		missedReads uint64
+		entryPoints []string
+	}
+	var ended []result
+	OnContractEnd = func(callID uint64, d time.Duration) {
+		ended = append(ended, result{CallbackGasTotal(callID), MissedReads(callID), CallEntryPoints(callID)})
+	}
+	defer func() { OnContractEnd = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	recordEntryPoint(callID, "execute")
+	db := newTestDB(store, gasMeter, callID)
+	_, getGas, _, _ := db.get([]byte("missing"))
+	setGas, _, _ := db.set([]byte("foo"), []byte("bar"))
+	endCall(callID)
+
+	require.Equal(t, []result{{getGas + setGas, 1, []string{"execute"}}}, ended)
+	// the data is removed after the hook ran
+	require.Equal(t, uint64(0), CallbackGasTotal(callID))
+	require.NotContains(t, ActiveCallIDs(), callID)
+}
+
+func TestLastCallbackGas(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	callback, gas := LastCallbackGas(callID)
+	require.Equal(t, "", callback)
+	require.Equal(t, uint64(0), gas)
+
+	_, _, ret := db.set([]byte("foo"), []byte("bar"))
+	require.Equal(t, goErrorNone, ret)
+	callback, gas = LastCallbackGas(callID)
+	require.Equal(t, "cSet", callback)
+	require.Equal(t, uint64(GetPrice+SetPrice), gas)
+
+	_, _, _, ret = db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	callback, gas = LastCallbackGas(callID)
+	require.Equal(t, "cGet", callback)
+	require.Equal(t, uint64(GetPrice), gas)
+
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, nextGas, _, ret := db.next(index)
+	require.Equal(t, goErrorNone, ret)
+	callback, gas = LastCallbackGas(callID)
+	require.Equal(t, "cNext", callback)
+	require.Equal(t, nextGas, gas)
+
+	querier := &meteredQuerier{response: []byte(`{}`)}
+	state := buildQuerierState(querier, callID, []byte("checksum"))
+	_, queryGas, _, ret := query(&state, 50000, []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`))
+	require.Equal(t, goErrorNone, ret)
+	require.Greater(t, queryGas, uint64(0))
+	callback, gas = LastCallbackGas(callID)
+	require.Equal(t, "cQueryExternal", callback)
+	require.Equal(t, queryGas, gas)
+
+	// failing callbacks are recorded too
+	_, _, ret = db.set([]byte("foo"), nil)
+	require.NotEqual(t, goErrorNone, ret)
+	callback, _ = LastCallbackGas(callID)
+	require.Equal(t, "cSet", callback)
+
+	// unknown calls
+	callback, gas = LastCallbackGas(callID + 1000)
+	require.Equal(t, "", callback)
+	require.Equal(t, uint64(0), gas)
+}
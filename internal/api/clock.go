@@ -0,0 +1,7 @@
+package api
+
+import "time"
+
+// nowFunc returns the current time. Code in this package must use it instead of calling time.Now
+// directly, such that tests can inject a fake clock for timing dependent features.
+var nowFunc = time.Now
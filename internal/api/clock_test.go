@@ -0,0 +1,52 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock that only moves when advanced manually
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock replaces nowFunc with a fake clock for the duration of the test
+func useFakeClock(t *testing.T) *fakeClock {
+	clock := &fakeClock{now: time.Date(2020, 1, 13, 18, 22, 23, 0, time.UTC)}
+	original := nowFunc
+	nowFunc = clock.Now
+	t.Cleanup(func() { nowFunc = original })
+	return clock
+}
+
+func TestUseFakeClock(t *testing.T) {
+	var callID uint64
+	t.Run("fake", func(t *testing.T) {
+		clock := useFakeClock(t)
+		callID = startCall()
+		require.Equal(t, time.Duration(0), CallDuration(callID))
+		clock.Advance(1500 * time.Millisecond)
+		require.Equal(t, 1500*time.Millisecond, CallDuration(callID))
+	})
+	defer endCall(callID)
+
+	// the real clock is restored once the test using the fake clock finished, so the call
+	// started at the fake time now appears to have been running for years
+	require.Greater(t, CallDuration(callID), 24*time.Hour)
+}
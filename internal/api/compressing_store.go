@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// Codec compresses values before they are written to a store and decompresses them when they are read.
+// Compress must be deterministic, since the compressed values become part of the chain state.
+type Codec interface {
+	Compress(value []byte) ([]byte, error)
+	Decompress(compressed []byte) ([]byte, error)
+}
+
+// GzipCodec is a Codec using gzip with the default compression level.
+//
+// The output of compress/gzip is not guaranteed to be stable across Go releases, so nodes built with
+// different Go versions may write different bytes for the same value. GzipCodec must therefore not be used
+// for consensus state, only for node-local stores. Use a Codec with a pinned encoding for chain state.
+type GzipCodec struct{}
+
+var _ Codec = GzipCodec{}
+
+func (GzipCodec) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCodec) Decompress(compressed []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// CompressingKVStore wraps a KVStore and transparently compresses values on Set and decompresses
+// them on Get and during iteration, such that the contract only ever sees the logical value.
+//
+// Compression and decompression are charged to the given gas meter with gasPerByte for every byte of
+// the logical (uncompressed) value. Codec errors cause a KVStoreError panic, which the callbacks return
+// to the contract as an error.
+type CompressingKVStore struct {
+	parent     KVStore
+	codec      Codec
+	meter      GasConsumer
+	gasPerByte Gas
+}
+
+var _ KVStore = (*CompressingKVStore)(nil)
+
+func NewCompressingKVStore(parent KVStore, codec Codec, meter GasConsumer, gasPerByte Gas) *CompressingKVStore {
+	return &CompressingKVStore{
+		parent:     parent,
+		codec:      codec,
+		meter:      meter,
+		gasPerByte: gasPerByte,
+	}
+}
+
+func (s *CompressingKVStore) decompress(compressed []byte) []byte {
+	if compressed == nil {
+		return nil
+	}
+	value, err := s.codec.Decompress(compressed)
+	if err != nil {
+		panic(KVStoreError{Msg: fmt.Sprintf("decompress: %v", err)})
+	}
+	s.meter.ConsumeGas(s.gasPerByte*Gas(len(value)), "decompress")
+	// keep the distinction between empty and missing values
+	if value == nil {
+		value = []byte{}
+	}
+	return value
+}
+
+// Get reads the compressed value from the parent store and returns it decompressed
+func (s *CompressingKVStore) Get(key []byte) []byte {
+	return s.decompress(s.parent.Get(key))
+}
+
+// Set compresses the value and writes it to the parent store
+func (s *CompressingKVStore) Set(key, value []byte) {
+	s.meter.ConsumeGas(s.gasPerByte*Gas(len(value)), "compress")
+	compressed, err := s.codec.Compress(value)
+	if err != nil {
+		panic(KVStoreError{Msg: fmt.Sprintf("compress: %v", err)})
+	}
+	s.parent.Set(key, compressed)
+}
+
+func (s *CompressingKVStore) Delete(key []byte) {
+	s.parent.Delete(key)
+}
+
+func (s *CompressingKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return &decompressingIterator{
+		Iterator: s.parent.Iterator(start, end),
+		store:    s,
+	}
+}
+
+func (s *CompressingKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return &decompressingIterator{
+		Iterator: s.parent.ReverseIterator(start, end),
+		store:    s,
+	}
+}
+
+// decompressingIterator decompresses the values of the wrapped iterator
+type decompressingIterator struct {
+	dbm.Iterator
+	store *CompressingKVStore
+}
+
+func (it *decompressingIterator) Value() []byte {
+	return it.store.decompress(it.Iterator.Value())
+}
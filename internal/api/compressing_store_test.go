@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipCodec(t *testing.T) {
+	codec := GzipCodec{}
+	for _, value := range [][]byte{{}, []byte("foo"), bytes.Repeat([]byte("abc"), 1000)} {
+		compressed, err := codec.Compress(value)
+		require.NoError(t, err)
+		decompressed, err := codec.Decompress(compressed)
+		require.NoError(t, err)
+		require.Equal(t, value, decompressed)
+	}
+
+	// deterministic
+	a, err := codec.Compress([]byte("foo"))
+	require.NoError(t, err)
+	b, err := codec.Compress([]byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+
+	_, err = codec.Decompress([]byte("not gzip"))
+	require.Error(t, err)
+}
+
+func TestCompressingKVStore(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	store := NewCompressingKVStore(parent, GzipCodec{}, gasMeter, 2)
+
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	store.Set([]byte("a"), []byte("small"))
+	store.Set([]byte("b"), large)
+	store.Set([]byte("c"), []byte{})
+
+	// values are stored compressed
+	require.Less(t, len(parent.Get([]byte("b"))), len(large))
+	require.NotEqual(t, []byte("small"), parent.Get([]byte("a")))
+
+	// and read decompressed
+	require.Equal(t, []byte("small"), store.Get([]byte("a")))
+	require.Equal(t, large, store.Get([]byte("b")))
+	require.Equal(t, []byte{}, store.Get([]byte("c")))
+	require.Nil(t, store.Get([]byte("missing")))
+
+	// iteration returns decompressed values
+	iter := store.Iterator(nil, nil)
+	var values [][]byte
+	for ; iter.Valid(); iter.Next() {
+		values = append(values, iter.Value())
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, [][]byte{[]byte("small"), large, {}}, values)
+
+	iter = store.ReverseIterator(nil, nil)
+	require.True(t, iter.Valid())
+	require.Equal(t, []byte("c"), iter.Key())
+	require.Equal(t, []byte{}, iter.Value())
+	require.NoError(t, iter.Close())
+
+	store.Delete([]byte("b"))
+	require.Nil(t, store.Get([]byte("b")))
+}
+
+func TestCompressingKVStoreGas(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewCompressingKVStore(NewLookup(gasMeter), GzipCodec{}, gasMeter, 3)
+
+	store.Set([]byte("foo"), []byte("12345"))
+	require.Equal(t, uint64(SetPrice+3*5), gasMeter.GasConsumed())
+
+	before := gasMeter.GasConsumed()
+	store.Get([]byte("foo"))
+	require.Equal(t, GetPrice+3*5, gasMeter.GasConsumed()-before)
+
+	// missing values are not charged for decompression
+	before = gasMeter.GasConsumed()
+	store.Get([]byte("bar"))
+	require.Equal(t, GetPrice, gasMeter.GasConsumed()-before)
+}
+
+// failingCodec fails to compress and decompress
+type failingCodec struct{}
+
+func (failingCodec) Compress([]byte) ([]byte, error) {
+	return nil, errors.New("codec broken")
+}
+
+func (failingCodec) Decompress([]byte) ([]byte, error) {
+	return nil, errors.New("codec broken")
+}
+
+func TestCompressingKVStoreCodecErrors(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	parent.Set([]byte("foo"), []byte("not compressed"))
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(NewCompressingKVStore(parent, failingCodec{}, gasMeter, 1), gasMeter, callID)
+
+	// codec errors are returned to the contract
+	_, _, errMsg, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "decompress: codec broken", errMsg)
+	_, errMsg, ret = db.set([]byte("new"), []byte("bar"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "compress: codec broken", errMsg)
+}
@@ -0,0 +1,31 @@
+package api
+
+/*
+#include "bindings.h"
+
+GoError cHumanAddress_cgo(api_t *ptr, U8SliceView src, UnmanagedVector *dest, UnmanagedVector *errOut, uint64_t *used_gas);
+
+// noop returns immediately and is used to measure the cost of calling into C
+static void noop(void) {}
+
+// call_back calls the thinnest callback, which returns GoError_BadArgument without doing any work
+// because of the NULL pointers. This measures the cost of calling into C and back into Go.
+static GoError call_back(void) {
+	U8SliceView src = { .is_none = true, .ptr = NULL, .len = 0 };
+	return cHumanAddress_cgo(NULL, src, NULL, NULL, NULL);
+}
+*/
+import "C"
+
+// The helpers in this file allow benchmarking the cgo crossing overhead in isolation
+// (see BenchmarkCgoCrossing).
+
+// crossIntoC calls a C function that does nothing
+func crossIntoC() {
+	C.noop()
+}
+
+// crossIntoCAndBack calls a C function that calls back into Go. The callback returns immediately.
+func crossIntoCAndBack() goError {
+	return C.call_back()
+}
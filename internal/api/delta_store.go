@@ -0,0 +1,86 @@
+package api
+
+import (
+	dbm "github.com/tendermint/tm-db"
+)
+
+// KVDelta describes a single change applied through a DeltaKVStore.
+// For a Set, NewValue holds the written value. For a Delete, Deleted is true and NewValue is nil.
+// OldValue is nil when the key did not exist before the change.
+type KVDelta struct {
+	Key      []byte
+	OldValue []byte
+	NewValue []byte
+	Deleted  bool
+}
+
+// DeltaKVStore wraps a KVStore and records the write set of a contract call,
+// such that a chain can emit state-diff events after the execution.
+//
+// In order to know the old value, every Set and Delete reads the key from the
+// parent store before writing it. This read goes through the parent like any
+// other read and is thus charged to the gas meter of the parent store. This keeps
+// gas usage deterministic for all nodes that use the wrapper.
+type DeltaKVStore struct {
+	parent KVStore
+	deltas []KVDelta
+}
+
+var _ KVStore = (*DeltaKVStore)(nil)
+
+func NewDeltaKVStore(parent KVStore) *DeltaKVStore {
+	return &DeltaKVStore{
+		parent: parent,
+	}
+}
+
+func (s *DeltaKVStore) Get(key []byte) []byte {
+	return s.parent.Get(key)
+}
+
+// Set reads the old value of key, writes value to the parent store and records the change.
+func (s *DeltaKVStore) Set(key, value []byte) {
+	old := s.parent.Get(key)
+	s.parent.Set(key, value)
+	s.deltas = append(s.deltas, KVDelta{
+		Key:      cloneBytes(key),
+		OldValue: cloneBytes(old),
+		NewValue: cloneBytes(value),
+	})
+}
+
+// Delete reads the old value of key, deletes it from the parent store and records the change.
+func (s *DeltaKVStore) Delete(key []byte) {
+	old := s.parent.Get(key)
+	s.parent.Delete(key)
+	s.deltas = append(s.deltas, KVDelta{
+		Key:      cloneBytes(key),
+		OldValue: cloneBytes(old),
+		Deleted:  true,
+	})
+}
+
+func (s *DeltaKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.parent.Iterator(start, end)
+}
+
+func (s *DeltaKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.parent.ReverseIterator(start, end)
+}
+
+// Deltas returns all changes recorded so far in the order they were applied.
+func (s *DeltaKVStore) Deltas() []KVDelta {
+	out := make([]KVDelta, len(s.deltas))
+	copy(out, s.deltas)
+	return out
+}
+
+// cloneBytes copies a byte slice. Returns nil if and only if the source is nil.
+func cloneBytes(bz []byte) []byte {
+	if bz == nil {
+		return nil
+	}
+	out := make([]byte, len(bz))
+	copy(out, bz)
+	return out
+}
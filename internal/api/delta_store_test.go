@@ -0,0 +1,65 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaKVStore(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	parent.Set([]byte("existing"), []byte("old"))
+	parent.Set([]byte("doomed"), []byte("bye"))
+
+	store := NewDeltaKVStore(parent)
+	require.Empty(t, store.Deltas())
+
+	// overwrite
+	store.Set([]byte("existing"), []byte("new"))
+	// fresh write
+	store.Set([]byte("fresh"), []byte("value"))
+	// delete
+	store.Delete([]byte("doomed"))
+	// delete of a missing key
+	store.Delete([]byte("missing"))
+
+	expected := []KVDelta{
+		{Key: []byte("existing"), OldValue: []byte("old"), NewValue: []byte("new")},
+		{Key: []byte("fresh"), OldValue: nil, NewValue: []byte("value")},
+		{Key: []byte("doomed"), OldValue: []byte("bye"), Deleted: true},
+		{Key: []byte("missing"), OldValue: nil, Deleted: true},
+	}
+	require.Equal(t, expected, store.Deltas())
+
+	// writes reached the parent store
+	require.Equal(t, []byte("new"), parent.Get([]byte("existing")))
+	require.Equal(t, []byte("value"), parent.Get([]byte("fresh")))
+	require.Nil(t, parent.Get([]byte("doomed")))
+}
+
+func TestDeltaKVStoreChargesOldValueRead(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewDeltaKVStore(NewLookup(gasMeter))
+
+	store.Set([]byte("foo"), []byte("bar"))
+	require.Equal(t, GetPrice+SetPrice, gasMeter.GasConsumed())
+
+	store.Delete([]byte("foo"))
+	require.Equal(t, 2*GetPrice+SetPrice+RemovePrice, gasMeter.GasConsumed())
+}
+
+func TestDeltaKVStoreCopiesInput(t *testing.T) {
+	store := NewDeltaKVStore(NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT)))
+
+	key := []byte("key")
+	value := []byte("value")
+	store.Set(key, value)
+	key[0] = 'X'
+	value[0] = 'X'
+
+	deltas := store.Deltas()
+	require.Len(t, deltas, 1)
+	require.Equal(t, []byte("key"), deltas[0].Key)
+	require.Equal(t, []byte("value"), deltas[0].NewValue)
+}
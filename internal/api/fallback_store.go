@@ -0,0 +1,89 @@
+package api
+
+import (
+	dbm "github.com/tendermint/tm-db"
+)
+
+// FallbackKVStore layers a writable primary store over a read-only secondary store, e.g. a cache over a
+// base store. Reads that miss in the primary fall through to the secondary, while writes and deletes only go
+// to the primary. Deleted keys are remembered, such that values of the secondary are hidden after a delete.
+// Iterators yield the entries of both stores, preferring the primary.
+//
+// Gas is charged by the underlying stores: a read that misses in the primary is charged for both reads,
+// a hit only for the read of the primary. Iterators are charged by both stores.
+//
+// The deleted keys are kept in memory, so create one FallbackKVStore per contract call or block.
+type FallbackKVStore struct {
+	primary   KVStore
+	secondary KVStore
+	deleted   map[string]struct{}
+}
+
+var _ KVStore = (*FallbackKVStore)(nil)
+
+func NewFallbackKVStore(primary, secondary KVStore) *FallbackKVStore {
+	return &FallbackKVStore{
+		primary:   primary,
+		secondary: secondary,
+		deleted:   make(map[string]struct{}),
+	}
+}
+
+func (s *FallbackKVStore) Get(key []byte) []byte {
+	if v := s.primary.Get(key); v != nil {
+		return v
+	}
+	if _, ok := s.deleted[string(key)]; ok {
+		return nil
+	}
+	return s.secondary.Get(key)
+}
+
+func (s *FallbackKVStore) Set(key, value []byte) {
+	s.primary.Set(key, value)
+	delete(s.deleted, string(key))
+}
+
+func (s *FallbackKVStore) Delete(key []byte) {
+	s.primary.Delete(key)
+	s.deleted[string(key)] = struct{}{}
+}
+
+func (s *FallbackKVStore) Iterator(start, end []byte) dbm.Iterator {
+	merged := newMergeIterator(s.primary.Iterator(start, end), s.secondary.Iterator(start, end), PreferLeft, false)
+	return newSkipIterator(merged, s.isDeleted)
+}
+
+func (s *FallbackKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	merged := newMergeIterator(s.primary.ReverseIterator(start, end), s.secondary.ReverseIterator(start, end), PreferLeft, true)
+	return newSkipIterator(merged, s.isDeleted)
+}
+
+// isDeleted returns true if key was deleted and not written again. Such keys can only be found in the secondary.
+func (s *FallbackKVStore) isDeleted(key []byte) bool {
+	_, ok := s.deleted[string(key)]
+	return ok
+}
+
+// skipIterator wraps an iterator and skips all entries whose key matches skip
+type skipIterator struct {
+	dbm.Iterator
+	skip func(key []byte) bool
+}
+
+func newSkipIterator(inner dbm.Iterator, skip func(key []byte) bool) *skipIterator {
+	it := &skipIterator{Iterator: inner, skip: skip}
+	it.skipEntries()
+	return it
+}
+
+func (it *skipIterator) skipEntries() {
+	for it.Iterator.Valid() && it.skip(it.Iterator.Key()) {
+		it.Iterator.Next()
+	}
+}
+
+func (it *skipIterator) Next() {
+	it.Iterator.Next()
+	it.skipEntries()
+}
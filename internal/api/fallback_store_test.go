@@ -0,0 +1,73 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackKVStore(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	primary := NewLookup(gasMeter)
+	secondary := NewLookup(gasMeter)
+	primary.Set([]byte("both"), []byte("primary"))
+	secondary.Set([]byte("both"), []byte("secondary"))
+	secondary.Set([]byte("base"), []byte("secondary"))
+	secondary.Set([]byte("removed"), []byte("secondary"))
+
+	store := NewFallbackKVStore(primary, secondary)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// a hit in the primary only reads the primary
+	val, gas, _, ret := db.get([]byte("both"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("primary"), val)
+	require.Equal(t, uint64(GetPrice), gas)
+
+	// a miss in the primary falls through to the secondary and is charged for both reads
+	val, gas, _, _ = db.get([]byte("base"))
+	require.Equal(t, []byte("secondary"), val)
+	require.Equal(t, uint64(2*GetPrice), gas)
+	val, gas, _, _ = db.get([]byte("missing"))
+	require.Nil(t, val)
+	require.Equal(t, uint64(2*GetPrice), gas)
+
+	// writes only go to the primary
+	_, _, ret = db.set([]byte("base"), []byte("updated"))
+	require.Equal(t, goErrorNone, ret)
+	val, _, _, _ = db.get([]byte("base"))
+	require.Equal(t, []byte("updated"), val)
+	require.Equal(t, []byte("secondary"), secondary.Get([]byte("base")))
+
+	// deletes hide the value of the secondary until the key is written again
+	_, _, ret = db.delete([]byte("removed"))
+	require.Equal(t, goErrorNone, ret)
+	val, _, _, _ = db.get([]byte("removed"))
+	require.Nil(t, val)
+	require.Equal(t, []byte("secondary"), secondary.Get([]byte("removed")))
+
+	collect := func(order Order) []string {
+		index, _, _, ret := db.scan(nil, nil, order)
+		require.Equal(t, goErrorNone, ret)
+		var pairs []string
+		for {
+			key, value, _, _, ret := db.next(index)
+			require.Equal(t, goErrorNone, ret)
+			if key == nil {
+				return pairs
+			}
+			pairs = append(pairs, string(key)+"="+string(value))
+		}
+	}
+	require.Equal(t, []string{"base=updated", "both=primary"}, collect(Ascending))
+	require.Equal(t, []string{"both=primary", "base=updated"}, collect(Descending))
+
+	_, _, ret = db.set([]byte("removed"), []byte("resurrected"))
+	require.Equal(t, goErrorNone, ret)
+	val, _, _, _ = db.get([]byte("removed"))
+	require.Equal(t, []byte("resurrected"), val)
+	require.Equal(t, []string{"base=updated", "both=primary", "removed=resurrected"}, collect(Ascending))
+	require.Equal(t, []string{"removed=resurrected", "both=primary", "base=updated"}, collect(Descending))
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// ImmutableKeysKVStore wraps a KVStore and protects keys that must never change once written, e.g. the
+// config of a contract set at instantiation. A protected key can be written while it is absent from the
+// parent store. Overwriting or deleting it afterwards panics with a KVStoreError, which is returned to
+// the contract as an error by the DB callbacks.
+//
+// To find out whether a protected key exists, writes and deletes of protected keys read the key from the
+// parent store, which is charged by the parent store like any other read.
+type ImmutableKeysKVStore struct {
+	parent   KVStore
+	keys     map[string]struct{}
+	prefixes [][]byte
+}
+
+var _ KVStore = (*ImmutableKeysKVStore)(nil)
+
+// NewImmutableKeysKVStore protects all keys contained in keys and all keys starting with one of prefixes
+func NewImmutableKeysKVStore(parent KVStore, keys [][]byte, prefixes [][]byte) *ImmutableKeysKVStore {
+	s := &ImmutableKeysKVStore{
+		parent:   parent,
+		keys:     make(map[string]struct{}, len(keys)),
+		prefixes: make([][]byte, len(prefixes)),
+	}
+	for _, key := range keys {
+		s.keys[string(key)] = struct{}{}
+	}
+	for i, prefix := range prefixes {
+		s.prefixes[i] = cloneBytes(prefix)
+	}
+	return s
+}
+
+// IsProtected returns true if key is protected from changes after being written
+func (s *ImmutableKeysKVStore) IsProtected(key []byte) bool {
+	if _, ok := s.keys[string(key)]; ok {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMutable panics if key is protected and already exists in the parent store
+func (s *ImmutableKeysKVStore) checkMutable(key []byte) {
+	if s.IsProtected(key) && s.parent.Get(key) != nil {
+		panic(KVStoreError{Msg: fmt.Sprintf("key %X is immutable", key)})
+	}
+}
+
+func (s *ImmutableKeysKVStore) Get(key []byte) []byte {
+	return s.parent.Get(key)
+}
+
+func (s *ImmutableKeysKVStore) Set(key, value []byte) {
+	s.checkMutable(key)
+	s.parent.Set(key, value)
+}
+
+func (s *ImmutableKeysKVStore) Delete(key []byte) {
+	s.checkMutable(key)
+	s.parent.Delete(key)
+}
+
+func (s *ImmutableKeysKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.parent.Iterator(start, end)
+}
+
+func (s *ImmutableKeysKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.parent.ReverseIterator(start, end)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutableKeysKVStore(t *testing.T) {
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	store := NewImmutableKeysKVStore(parent, [][]byte{[]byte("config")}, [][]byte{[]byte("owner/")})
+	db := newTestDB(store, gasMeter, callID)
+
+	require.True(t, store.IsProtected([]byte("config")))
+	require.True(t, store.IsProtected([]byte("owner/a")))
+	require.False(t, store.IsProtected([]byte("config2")))
+	require.False(t, store.IsProtected([]byte("owner")))
+
+	// the first write of a protected key is allowed
+	_, _, ret := db.set([]byte("config"), []byte("v1"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.set([]byte("owner/a"), []byte("alice"))
+	require.Equal(t, goErrorNone, ret)
+
+	// overwriting is rejected
+	_, errMsg, ret := db.set([]byte("config"), []byte("v2"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "key 636F6E666967 is immutable", errMsg)
+	_, _, ret = db.set([]byte("owner/a"), []byte("bob"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, []byte("v1"), parent.Get([]byte("config")))
+	require.Equal(t, []byte("alice"), parent.Get([]byte("owner/a")))
+
+	// deleting is rejected
+	_, _, ret = db.delete([]byte("config"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, []byte("v1"), parent.Get([]byte("config")))
+
+	// other keys are not affected
+	for i := 0; i < 2; i++ {
+		_, _, ret = db.set([]byte("config2"), []byte("v"))
+		require.Equal(t, goErrorNone, ret)
+	}
+	_, _, ret = db.delete([]byte("config2"))
+	require.Equal(t, goErrorNone, ret)
+}
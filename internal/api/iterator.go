@@ -2,31 +2,107 @@ package api
 
 import (
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	dbm "github.com/tendermint/tm-db"
 )
 
+// iteratorEntry is an Iterator stored in a frame along with metadata about it.
+// mtx must be held while using iter or accessing the metadata, since cNext may be called
+// concurrently for the same iterator if a call ID is shared between goroutines.
+type iteratorEntry struct {
+	mtx   sync.Mutex
+	iter  dbm.Iterator
+	order Order
+	// steps is the number of entries returned by cNext so far
+	steps uint64
+	// ended is set once cNext found the iterator to be exhausted
+	ended bool
+	// closed is set when the iterator was closed by endCall
+	closed bool
+	// lastKey is the key most recently returned by cNext
+	lastKey []byte
+	// prefetched are entries read ahead of cNext, see IteratorPrefetch
+	prefetched []prefetchedStep
+	// label is an optional name set by LabelIterator for diagnostics
+	label string
+}
+
+// describe returns a short description of the iterator for error messages, including the label if set
+func (e *iteratorEntry) describe(index uint64) string {
+	if e.label == "" {
+		return fmt.Sprintf("iterator %d", index)
+	}
+	return fmt.Sprintf("iterator %d (%s)", index, e.label)
+}
+
+// prefetchedStep is an entry of an iterator read ahead of cNext
+type prefetchedStep struct {
+	key   []byte
+	value []byte
+}
+
+// prefetch advances the iterator of the given entry by up to n steps and buffers the results.
+// It returns the gas consumed on the gas meter for reading ahead, which the caller must report.
+func (e *iteratorEntry) prefetch(gm GasMeter, n int) uint64 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	gasBefore := gm.GasConsumed()
+	for i := 0; i < n && e.iter.Valid(); i++ {
+		k := append([]byte(nil), e.iter.Key()...)
+		v := e.iter.Value()
+		if v != nil {
+			v = append([]byte{}, v...)
+		}
+		e.iter.Next()
+		e.prefetched = append(e.prefetched, prefetchedStep{key: k, value: v})
+	}
+	return gm.GasConsumed() - gasBefore
+}
+
 // frame stores all Iterators for one contract call
-type frame []dbm.Iterator
+type frame []*iteratorEntry
 
 // iteratorFrames contains one frame for each contract call, indexed by contract call ID.
 var iteratorFrames = make(map[uint64]frame)
 var iteratorFramesMutex sync.Mutex
 
+// liveIterators is the number of iterators in iteratorFrames and peakLiveIterators its high-water mark.
+// Both are guarded by iteratorFramesMutex.
+var liveIterators uint64
+var peakLiveIterators uint64
+
 // this is a global counter for creating call IDs
 var latestCallID uint64
 var latestCallIDMutex sync.Mutex
 
+// contractsStarted counts the calls of startCall. Unlike latestCallID it is a metric that can be reset.
+var contractsStarted uint64
+
 // startCall is called at the beginning of a contract call to create a new frame in iteratorFrames.
-// It updates latestCallID for generating a new call ID.
+// It updates latestCallID for generating a new call ID and registers the call in activeCalls.
 func startCall() uint64 {
 	latestCallIDMutex.Lock()
 	defer latestCallIDMutex.Unlock()
 	latestCallID += 1
+	contractsStarted += 1
+	registerCall(latestCallID)
 	return latestCallID
 }
 
+// TotalContractsStarted returns the number of contract calls started since the process started.
+// It only increases until reset by ResetMetrics and is meant for throughput metrics.
+// See ActiveCallIDs for the calls running now.
+func TotalContractsStarted() uint64 {
+	latestCallIDMutex.Lock()
+	defer latestCallIDMutex.Unlock()
+	return contractsStarted
+}
+
 // removeFrame removes the frame with for the given call ID.
 // The result can be nil when the frame is not initialized,
 // i.e. when startCall() is called but no iterator is stored.
@@ -36,23 +112,56 @@ func removeFrame(callID uint64) frame {
 
 	remove := iteratorFrames[callID]
 	delete(iteratorFrames, callID)
+	liveIterators -= uint64(len(remove))
 	return remove
 }
 
+// OnIteratorCloseError is called by endCall for every iterator that returns an error when being closed.
+// If unset, the error is logged.
+var OnIteratorCloseError func(callID, index uint64, err error)
+
 // endCall is called at the end of a contract call to remove one item the iteratorFrames
 func endCall(callID uint64) {
+	// the call stays registered while OnContractEnd runs, such that the hook can use the per-call accessors
+	var active bool
+	var startTime time.Time
+	var cleanups []func()
+	withCallState(callID, func(state *callState) {
+		active, startTime, cleanups = true, state.startTime, state.cleanups
+	})
+	if active {
+		if OnContractEnd != nil {
+			OnContractEnd(callID, nowFunc().Sub(startTime))
+		}
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+		unregisterCall(callID)
+	}
 	// we pull removeFrame in another function so we don't hold the mutex while cleaning up the removed frame
 	remove := removeFrame(callID)
 	// free all iterators in the frame when we release it
-	for _, iter := range remove {
-		_ = iter.Close()
+	for i, entry := range remove {
+		index := uint64(i + 1)
+		entry.mtx.Lock()
+		err := entry.iter.Close()
+		entry.closed = true
+		description := entry.describe(index)
+		entry.mtx.Unlock()
+		if err != nil {
+			if OnIteratorCloseError != nil {
+				OnIteratorCloseError(callID, index, err)
+			} else {
+				log.Printf("Failed to close %s of contract call %d: %v\n", description, callID, err)
+			}
+		}
 	}
 }
 
 // storeIterator will add this to the end of the frame for the given ID and return a reference to it.
 // We start counting with 1, so the 0 value is flagged as an error. This means we must
 // remember to do idx-1 when retrieving
-func storeIterator(callID uint64, it dbm.Iterator, frameLenLimit int) (uint64, error) {
+func storeIterator(callID uint64, it dbm.Iterator, order Order, frameLenLimit int) (uint64, error) {
 	iteratorFramesMutex.Lock()
 	defer iteratorFramesMutex.Unlock()
 
@@ -62,16 +171,40 @@ func storeIterator(callID uint64, it dbm.Iterator, frameLenLimit int) (uint64, e
 	}
 
 	// store at array position `old_frame_len`
-	iteratorFrames[callID] = append(iteratorFrames[callID], it)
+	iteratorFrames[callID] = append(iteratorFrames[callID], &iteratorEntry{
+		iter:  it,
+		order: order,
+	})
 	new_index := old_frame_len + 1
+	liveIterators++
+	if liveIterators > peakLiveIterators {
+		peakLiveIterators = liveIterators
+	}
 
 	return uint64(new_index), nil
 }
 
+// PeakLiveIterators returns the highest number of iterators open at the same time across all contract calls
+// since the process started or ResetMetrics was called. This helps tuning IteratorHardLimit and related limits.
+func PeakLiveIterators() uint64 {
+	iteratorFramesMutex.Lock()
+	defer iteratorFramesMutex.Unlock()
+	return peakLiveIterators
+}
+
 // retrieveIterator will recover an iterator based on index. This ensures it will not be garbage collected.
 // We start counting with 1, in storeIterator so the 0 value is flagged as an error. This means we must
 // remember to do idx-1 when retrieving
 func retrieveIterator(callID uint64, index uint64) dbm.Iterator {
+	entry := retrieveIteratorEntry(callID, index)
+	if entry == nil {
+		return nil
+	}
+	return entry.iter
+}
+
+// retrieveIteratorEntry works like retrieveIterator but returns the frame entry including metadata
+func retrieveIteratorEntry(callID uint64, index uint64) *iteratorEntry {
 	iteratorFramesMutex.Lock()
 	defer iteratorFramesMutex.Unlock()
 	myFrame := iteratorFrames[callID]
@@ -85,3 +218,73 @@ func retrieveIterator(callID uint64, index uint64) dbm.Iterator {
 	}
 	return myFrame[posInFrame]
 }
+
+// IteratorOrder returns the order of the iterator with the given index in the given contract call.
+// The second return value is false if no such iterator exists.
+func IteratorOrder(callID uint64, index uint64) (Order, bool) {
+	entry := retrieveIteratorEntry(callID, index)
+	if entry == nil {
+		return 0, false
+	}
+	return entry.order, true
+}
+
+// MaxIteratorLabelLen is the maximum length of a label in bytes
+const MaxIteratorLabelLen = 64
+
+// LabelIterator associates a human-readable label (e.g. "orders_scan") with the iterator with the given index
+// in the given contract call. The label is included in DumpFrames and error messages about the iterator.
+// Labels are optional, an empty label removes the label. Returns an error if the iterator does not exist
+// or the label is longer than MaxIteratorLabelLen.
+func LabelIterator(callID uint64, index uint64, label string) error {
+	if len(label) > MaxIteratorLabelLen {
+		return fmt.Errorf("Iterator label too long: %d bytes exceeds the limit of %d", len(label), MaxIteratorLabelLen)
+	}
+	entry := retrieveIteratorEntry(callID, index)
+	if entry == nil {
+		return fmt.Errorf("Iterator %d of contract call %d not found", index, callID)
+	}
+	entry.mtx.Lock()
+	defer entry.mtx.Unlock()
+	entry.label = label
+	return nil
+}
+
+// DumpFrames returns a human-readable snapshot of all iterator frames for debugging, listing the
+// iterators of every contract call with their order, the number of steps taken, the last key returned and the label.
+// The format is not stable and must not be parsed.
+func DumpFrames() string {
+	iteratorFramesMutex.Lock()
+	defer iteratorFramesMutex.Unlock()
+
+	callIDs := make([]uint64, 0, len(iteratorFrames))
+	for callID := range iteratorFrames {
+		callIDs = append(callIDs, callID)
+	}
+	sort.Slice(callIDs, func(i, j int) bool { return callIDs[i] < callIDs[j] })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d frames\n", len(callIDs))
+	for _, callID := range callIDs {
+		frame := iteratorFrames[callID]
+		fmt.Fprintf(&b, "call %d: %d iterators\n", callID, len(frame))
+		for i, entry := range frame {
+			entry.mtx.Lock()
+			order := "ascending"
+			if entry.order == Descending {
+				order = "descending"
+			}
+			lastKey := "-"
+			if entry.steps > 0 {
+				lastKey = fmt.Sprintf("%X", entry.lastKey)
+			}
+			fmt.Fprintf(&b, "  iterator %d: order=%s steps=%d last_key=%s ended=%t", i+1, order, entry.steps, lastKey, entry.ended)
+			if entry.label != "" {
+				fmt.Fprintf(&b, " label=%q", entry.label)
+			}
+			b.WriteString("\n")
+			entry.mtx.Unlock()
+		}
+	}
+	return b.String()
+}
@@ -2,7 +2,10 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 
@@ -73,24 +76,24 @@ func TestStoreIterator(t *testing.T) {
 	var err error
 
 	iter, _ = store.Iterator(nil, nil)
-	index, err = storeIterator(callID1, iter, limit)
+	index, err = storeIterator(callID1, iter, Ascending, limit)
 	require.NoError(t, err)
 	require.Equal(t, uint64(1), index)
 	iter, _ = store.Iterator(nil, nil)
-	index, err = storeIterator(callID1, iter, limit)
+	index, err = storeIterator(callID1, iter, Ascending, limit)
 	require.NoError(t, err)
 	require.Equal(t, uint64(2), index)
 
 	iter, _ = store.Iterator(nil, nil)
-	index, err = storeIterator(callID2, iter, limit)
+	index, err = storeIterator(callID2, iter, Ascending, limit)
 	require.NoError(t, err)
 	require.Equal(t, uint64(1), index)
 	iter, _ = store.Iterator(nil, nil)
-	index, err = storeIterator(callID2, iter, limit)
+	index, err = storeIterator(callID2, iter, Ascending, limit)
 	require.NoError(t, err)
 	require.Equal(t, uint64(2), index)
 	iter, _ = store.Iterator(nil, nil)
-	index, err = storeIterator(callID2, iter, limit)
+	index, err = storeIterator(callID2, iter, Ascending, limit)
 	require.NoError(t, err)
 	require.Equal(t, uint64(3), index)
 
@@ -98,6 +101,21 @@ func TestStoreIterator(t *testing.T) {
 	endCall(callID2)
 }
 
+func TestTotalContractsStarted(t *testing.T) {
+	before := TotalContractsStarted()
+	var callIDs []uint64
+	for i := 0; i < 5; i++ {
+		callIDs = append(callIDs, startCall())
+		require.Equal(t, before+uint64(i+1), TotalContractsStarted())
+	}
+
+	// ending calls does not decrement the counter
+	for _, callID := range callIDs {
+		endCall(callID)
+	}
+	require.Equal(t, before+5, TotalContractsStarted())
+}
+
 func TestStoreIteratorHitsLimit(t *testing.T) {
 	callID := startCall()
 
@@ -107,15 +125,15 @@ func TestStoreIteratorHitsLimit(t *testing.T) {
 	const limit = 2
 
 	iter, _ = store.Iterator(nil, nil)
-	_, err = storeIterator(callID, iter, limit)
+	_, err = storeIterator(callID, iter, Ascending, limit)
 	require.NoError(t, err)
 
 	iter, _ = store.Iterator(nil, nil)
-	_, err = storeIterator(callID, iter, limit)
+	_, err = storeIterator(callID, iter, Ascending, limit)
 	require.NoError(t, err)
 
 	iter, _ = store.Iterator(nil, nil)
-	_, err = storeIterator(callID, iter, limit)
+	_, err = storeIterator(callID, iter, Ascending, limit)
 	require.ErrorContains(t, err, "Reached iterator limit (2)")
 
 	endCall(callID)
@@ -131,19 +149,19 @@ func TestRetrieveIterator(t *testing.T) {
 	var err error
 
 	iter, _ = store.Iterator(nil, nil)
-	index11, err := storeIterator(callID1, iter, limit)
+	index11, err := storeIterator(callID1, iter, Ascending, limit)
 	require.NoError(t, err)
 	iter, _ = store.Iterator(nil, nil)
-	_, err = storeIterator(callID1, iter, limit)
+	_, err = storeIterator(callID1, iter, Ascending, limit)
 	require.NoError(t, err)
 	iter, _ = store.Iterator(nil, nil)
-	_, err = storeIterator(callID2, iter, limit)
+	_, err = storeIterator(callID2, iter, Ascending, limit)
 	require.NoError(t, err)
 	iter, _ = store.Iterator(nil, nil)
-	index22, err := storeIterator(callID2, iter, limit)
+	index22, err := storeIterator(callID2, iter, Ascending, limit)
 	require.NoError(t, err)
 	iter, err = store.Iterator(nil, nil)
-	index23, err := storeIterator(callID2, iter, limit)
+	index23, err := storeIterator(callID2, iter, Ascending, limit)
 	require.NoError(t, err)
 
 	// Retrieve existing
@@ -166,6 +184,173 @@ func TestRetrieveIterator(t *testing.T) {
 	endCall(callID2)
 }
 
+func TestIteratorOrder(t *testing.T) {
+	callID := startCall()
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	db := newTestDB(NewLookup(gasMeter), gasMeter, callID)
+
+	ascending, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	descending, _, _, ret := db.scan(nil, nil, Descending)
+	require.Equal(t, goErrorNone, ret)
+
+	order, ok := IteratorOrder(callID, ascending)
+	require.True(t, ok)
+	require.Equal(t, Ascending, order)
+	order, ok = IteratorOrder(callID, descending)
+	require.True(t, ok)
+	require.Equal(t, Descending, order)
+
+	// non-existent index
+	_, ok = IteratorOrder(callID, descending+1)
+	require.False(t, ok)
+
+	// released frame
+	endCall(callID)
+	_, ok = IteratorOrder(callID, ascending)
+	require.False(t, ok)
+}
+
+func TestIteratorSoftAndHardLimit(t *testing.T) {
+	IteratorSoftLimit = 2
+	IteratorHardLimit = 4
+	var hookCalls []int
+	OnIteratorSoftLimit = func(callID uint64, count int) {
+		hookCalls = append(hookCalls, count)
+	}
+	defer func() {
+		IteratorSoftLimit = 0
+		IteratorHardLimit = frameLenLimit
+		OnIteratorSoftLimit = nil
+	}()
+
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	db := newTestDB(NewLookup(gasMeter), gasMeter, callID)
+
+	// below the soft limit
+	for i := 0; i < 2; i++ {
+		_, _, _, ret := db.scan(nil, nil, Ascending)
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Empty(t, hookCalls)
+
+	// crossing the soft limit works but triggers the hook once
+	for i := 0; i < 2; i++ {
+		_, _, _, ret := db.scan(nil, nil, Ascending)
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, []int{3}, hookCalls)
+
+	// crossing the hard limit fails
+	_, _, errMsg, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "Reached iterator limit (4)", errMsg)
+	require.Equal(t, []int{3}, hookCalls)
+}
+
+func TestMaxIteratorsPerChecksum(t *testing.T) {
+	MaxIteratorsPerChecksum = map[string]int{
+		"heavy":   1,
+		"medium":  3,
+		"raising": frameLenLimit + 1,
+	}
+	defer func() { MaxIteratorsPerChecksum = nil }()
+
+	openUntilFailure := func(checksum string) (int, string) {
+		callID := startCall()
+		defer endCall(callID)
+		setCallChecksum(callID, []byte(checksum))
+		gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+		db := newTestDB(NewLookup(gasMeter), gasMeter, callID)
+		for opened := 0; ; opened++ {
+			_, _, errMsg, ret := db.scan(nil, nil, Ascending)
+			if ret != goErrorNone {
+				require.Equal(t, goErrorUser, ret)
+				return opened, errMsg
+			}
+		}
+	}
+
+	opened, errMsg := openUntilFailure("heavy")
+	require.Equal(t, 1, opened)
+	require.Equal(t, "Reached iterator limit (1)", errMsg)
+
+	opened, errMsg = openUntilFailure("medium")
+	require.Equal(t, 3, opened)
+	require.Equal(t, "Reached iterator limit (3)", errMsg)
+
+	// other contracts and quotas above the hard limit use the hard limit
+	IteratorHardLimit = 5
+	defer func() { IteratorHardLimit = frameLenLimit }()
+	opened, _ = openUntilFailure("other")
+	require.Equal(t, 5, opened)
+	opened, _ = openUntilFailure("raising")
+	require.Equal(t, 5, opened)
+}
+
+func TestIteratorLimitIsClamped(t *testing.T) {
+	IteratorHardLimit = frameLenLimit + 100
+	MaxIteratorsPerChecksum = map[string]int{
+		"raising": frameLenLimit + 1,
+		"heavy":   2,
+	}
+	defer func() {
+		IteratorHardLimit = frameLenLimit
+		MaxIteratorsPerChecksum = nil
+	}()
+
+	limitOf := func(checksum string) int {
+		callID := startCall()
+		defer endCall(callID)
+		setCallChecksum(callID, []byte(checksum))
+		return iteratorLimit(callID)
+	}
+
+	// neither the hard limit nor a quota can exceed frameLenLimit
+	require.Equal(t, frameLenLimit, limitOf("other"))
+	require.Equal(t, frameLenLimit, limitOf("raising"))
+	require.Equal(t, 2, limitOf("heavy"))
+}
+
+// failingCloseIterator is an iterator whose Close returns an error
+type failingCloseIterator struct {
+	dbm.Iterator
+	closed bool
+}
+
+func (i *failingCloseIterator) Close() error {
+	i.closed = true
+	_ = i.Iterator.Close()
+	return errors.New("file handle already released")
+}
+
+func TestIteratorCloseError(t *testing.T) {
+	type closeError struct {
+		callID, index uint64
+		err           string
+	}
+	var observed []closeError
+	OnIteratorCloseError = func(callID, index uint64, err error) {
+		observed = append(observed, closeError{callID, index, err.Error()})
+	}
+	defer func() { OnIteratorCloseError = nil }()
+
+	store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	callID := startCall()
+	working := store.Iterator(nil, nil)
+	failing := &failingCloseIterator{Iterator: store.Iterator(nil, nil)}
+	_, err := storeIterator(callID, working, Ascending, frameLenLimit)
+	require.NoError(t, err)
+	_, err = storeIterator(callID, failing, Ascending, frameLenLimit)
+	require.NoError(t, err)
+
+	endCall(callID)
+	require.True(t, failing.closed)
+	require.Equal(t, []closeError{{callID, 2, "file handle already released"}}, observed)
+}
+
 func TestQueueIteratorSimple(t *testing.T) {
 	cache, cleanup := withCache(t)
 	defer cleanup()
@@ -287,3 +472,295 @@ func TestQueueIteratorLimit(t *testing.T) {
 	data, _, err = Query(cache, checksum, env, query, &igasMeter, store, api, &querier, gasLimit, TESTING_PRINT_DEBUG)
 	require.ErrorContains(t, err, "Reached iterator limit (32768)")
 }
+
+// meteredIterator charges gas for every step based on the current key
+type meteredIterator struct {
+	dbm.Iterator
+	gasMeter GasConsumer
+}
+
+func (i meteredIterator) Next() {
+	i.gasMeter.ConsumeGas(Gas(10*len(i.Key())), "next")
+	i.Iterator.Next()
+}
+
+// meteredIteratorStore returns meteredIterators
+type meteredIteratorStore struct {
+	KVStore
+	gasMeter GasConsumer
+}
+
+func (s meteredIteratorStore) Iterator(start, end []byte) dbm.Iterator {
+	return meteredIterator{s.KVStore.Iterator(start, end), s.gasMeter}
+}
+
+func (s meteredIteratorStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return meteredIterator{s.KVStore.ReverseIterator(start, end), s.gasMeter}
+}
+
+func TestIteratorPrefetch(t *testing.T) {
+	defer func(old int) { IteratorPrefetch = old }(IteratorPrefetch)
+
+	type step struct {
+		key, value string
+	}
+	// run scans the store, taking up to maxSteps steps, and returns the steps along with the gas
+	// reported by the callbacks and the gas consumed on the gas meter
+	run := func(prefetch int, order Order, maxSteps int) ([]step, uint64, uint64) {
+		IteratorPrefetch = prefetch
+		gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+		store := meteredIteratorStore{newSortedKVStore(), gasMeter}
+		for _, key := range []string{"a", "bb", "ccc", "dddd", "eeeee"} {
+			store.Set([]byte(key), []byte("value-"+key))
+		}
+		callID := startCall()
+		defer endCall(callID)
+		db := newTestDB(store, gasMeter, callID)
+
+		consumedBefore := gasMeter.GasConsumed()
+		index, scanGas, _, ret := db.scan(nil, nil, order)
+		require.Equal(t, goErrorNone, ret)
+		total := scanGas
+		var steps []step
+		for len(steps) < maxSteps {
+			key, value, gas, _, ret := db.next(index)
+			require.Equal(t, goErrorNone, ret)
+			total += gas
+			if key == nil {
+				break
+			}
+			steps = append(steps, step{string(key), string(value)})
+		}
+		require.Equal(t, CallbackGasTotal(callID), total)
+		return steps, total, gasMeter.GasConsumed() - consumedBefore
+	}
+
+	for _, order := range []Order{Ascending, Descending} {
+		expected, expectedGas, _ := run(0, order, 100)
+		require.Len(t, expected, 5)
+		for _, prefetch := range []int{1, 2, 5, 100} {
+			steps, gas, consumed := run(prefetch, order, 100)
+			require.Equal(t, expected, steps, "prefetch %d", prefetch)
+			require.Equal(t, expectedGas, gas, "prefetch %d", prefetch)
+			require.Equal(t, consumed, gas, "prefetch %d", prefetch)
+
+			// stopping early, all gas consumed for reading ahead is reported
+			steps, gas, consumed = run(prefetch, order, 1)
+			require.Equal(t, expected[:1], steps, "prefetch %d", prefetch)
+			require.Equal(t, consumed, gas, "prefetch %d", prefetch)
+		}
+	}
+}
+
+func TestConcurrentNext(t *testing.T) {
+	const numKeys = 1000
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := newSortedKVStore()
+	for i := 0; i < numKeys; i++ {
+		store.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+	}
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// drain runs cNext on the given iterator until the end and returns the keys received
+	drain := func(index uint64) []string {
+		var keys []string
+		for {
+			key, value, _, _, ret := db.next(index)
+			if ret != goErrorNone {
+				panic(fmt.Sprintf("unexpected error %d", ret))
+			}
+			if key == nil {
+				return keys
+			}
+			if string(value) != "value"+string(key[3:]) {
+				panic(fmt.Sprintf("mismatched pair %s=%s", key, value))
+			}
+			keys = append(keys, string(key))
+		}
+	}
+
+	t.Run("same index", func(t *testing.T) {
+		index, _, _, ret := db.scan(nil, nil, Ascending)
+		require.Equal(t, goErrorNone, ret)
+
+		results := make([][]string, 8)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				results[i] = drain(index)
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		// every entry is returned exactly once, in order per goroutine
+		var all []string
+		for _, keys := range results {
+			require.True(t, sort.StringsAreSorted(keys))
+			all = append(all, keys...)
+		}
+		sort.Strings(all)
+		require.Len(t, all, numKeys)
+		for i, key := range all {
+			require.Equal(t, fmt.Sprintf("key%04d", i), key)
+		}
+	})
+
+	t.Run("different indices", func(t *testing.T) {
+		indices := make([]uint64, 8)
+		for i := range indices {
+			index, _, _, ret := db.scan(nil, nil, Ascending)
+			require.Equal(t, goErrorNone, ret)
+			indices[i] = index
+		}
+
+		results := make([][]string, len(indices))
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i, index := range indices {
+			wg.Add(1)
+			go func(i int, index uint64) {
+				defer wg.Done()
+				<-start
+				results[i] = drain(index)
+			}(i, index)
+		}
+		close(start)
+		wg.Wait()
+
+		for _, keys := range results {
+			require.Len(t, keys, numKeys)
+			require.True(t, sort.StringsAreSorted(keys))
+		}
+	})
+}
+
+func TestDumpFrames(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set([]byte(key), []byte("value"))
+	}
+	callID := startCall()
+	db := newTestDB(store, gasMeter, callID)
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	other := newTestDB(store, gasMeter, otherCallID)
+
+	ascending, _, _, _ := db.scan(nil, nil, Ascending)
+	db.next(ascending)
+	db.next(ascending)
+	descending, _, _, _ := db.scan(nil, nil, Descending)
+	for i := 0; i < 4; i++ {
+		db.next(descending)
+	}
+	other.scan([]byte("b"), nil, Ascending)
+
+	dump := DumpFrames()
+	require.Contains(t, dump, fmt.Sprintf("call %d: 2 iterators\n", callID))
+	require.Contains(t, dump, "  iterator 1: order=ascending steps=2 last_key=62 ended=false\n")
+	require.Contains(t, dump, "  iterator 2: order=descending steps=3 last_key=61 ended=true\n")
+	require.Contains(t, dump, fmt.Sprintf("call %d: 1 iterators\n  iterator 1: order=ascending steps=0 last_key=- ended=false\n", otherCallID))
+
+	endCall(callID)
+	require.NotContains(t, DumpFrames(), fmt.Sprintf("call %d:", callID))
+}
+
+func TestLabelIterator(t *testing.T) {
+	defer func(old uint64) { MaxIterSteps = old }(MaxIterSteps)
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	for _, key := range []string{"a", "b"} {
+		store.Set([]byte(key), []byte("value"))
+	}
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	labeled, _, _, _ := db.scan(nil, nil, Ascending)
+	unlabeled, _, _, _ := db.scan(nil, nil, Descending)
+	require.NoError(t, LabelIterator(callID, labeled, "orders_scan"))
+
+	dump := DumpFrames()
+	require.Contains(t, dump, "  iterator 1: order=ascending steps=0 last_key=- ended=false label=\"orders_scan\"\n")
+	require.Contains(t, dump, "  iterator 2: order=descending steps=0 last_key=- ended=false\n")
+
+	// the label is included in errors
+	MaxIterSteps = 1
+	db.next(labeled)
+	_, _, _, errMsg, ret := db.next(labeled)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "iterator step limit exceeded (orders_scan)", errMsg)
+	db.next(unlabeled)
+	_, _, _, errMsg, _ = db.next(unlabeled)
+	require.Equal(t, "iterator step limit exceeded", errMsg)
+
+	// labels can be removed
+	require.NoError(t, LabelIterator(callID, labeled, ""))
+	require.NotContains(t, DumpFrames(), "orders_scan")
+
+	// bounded length
+	err := LabelIterator(callID, labeled, strings.Repeat("x", MaxIteratorLabelLen+1))
+	require.EqualError(t, err, "Iterator label too long: 65 bytes exceeds the limit of 64")
+	require.NoError(t, LabelIterator(callID, labeled, strings.Repeat("x", MaxIteratorLabelLen)))
+
+	// unknown iterators
+	err = LabelIterator(callID, 3, "missing")
+	require.EqualError(t, err, fmt.Sprintf("Iterator 3 of contract call %d not found", callID))
+}
+
+func TestPeakLiveIterators(t *testing.T) {
+	const calls = 8
+	const iteratorsPerCall = 5
+
+	ResetMetrics()
+	base := PeakLiveIterators()
+
+	// all calls open their iterators before any of them ends
+	var opened, release sync.WaitGroup
+	opened.Add(calls)
+	release.Add(1)
+	var done sync.WaitGroup
+	done.Add(calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			defer done.Done()
+			// the mock gas meter is not thread-safe, so every call gets its own store
+			store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+			callID := startCall()
+			defer endCall(callID)
+			for j := 0; j < iteratorsPerCall; j++ {
+				_, err := storeIterator(callID, store.Iterator(nil, nil), Ascending, frameLenLimit)
+				assert.NoError(t, err)
+			}
+			opened.Done()
+			release.Wait()
+		}()
+	}
+	opened.Wait()
+	require.Equal(t, base+calls*iteratorsPerCall, PeakLiveIterators())
+	release.Done()
+	done.Wait()
+
+	// the peak remains after the iterators are released
+	require.Equal(t, base+calls*iteratorsPerCall, PeakLiveIterators())
+
+	// a smaller second burst does not change the peak
+	store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	callID := startCall()
+	_, err := storeIterator(callID, store.Iterator(nil, nil), Ascending, frameLenLimit)
+	require.NoError(t, err)
+	endCall(callID)
+	require.Equal(t, base+calls*iteratorsPerCall, PeakLiveIterators())
+
+	// resetting starts from the iterators open now
+	ResetMetrics()
+	require.Equal(t, base, PeakLiveIterators())
+}
@@ -28,6 +28,18 @@ type (
 // Pointers
 type cu8_ptr = *C.uint8_t
 
+// GoError values returned by the callbacks. C constants cannot be used in test files directly.
+type goError = C.GoError
+
+const (
+	goErrorNone            goError = C.GoError_None
+	goErrorPanic           goError = C.GoError_Panic
+	goErrorBadArgument     goError = C.GoError_BadArgument
+	goErrorOutOfGas        goError = C.GoError_OutOfGas
+	goErrorCannotSerialize goError = C.GoError_CannotSerialize
+	goErrorUser            goError = C.GoError_User
+)
+
 type Cache struct {
 	ptr *C.cache_t
 }
@@ -160,11 +172,14 @@ func Instantiate(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "instantiate", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -200,11 +215,14 @@ func Execute(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "execute", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -237,11 +255,14 @@ func Migrate(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "migrate", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -274,11 +295,14 @@ func Sudo(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "sudo", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -311,11 +335,14 @@ func Reply(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "reply", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -348,11 +375,14 @@ func Query(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "query", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -385,11 +415,14 @@ func IBCChannelOpen(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "ibc_channel_open", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -422,11 +455,14 @@ func IBCChannelConnect(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "ibc_channel_connect", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -459,11 +495,14 @@ func IBCChannelClose(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "ibc_channel_close", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -496,11 +535,14 @@ func IBCPacketReceive(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "ibc_packet_receive", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -533,11 +575,14 @@ func IBCPacketAck(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "ibc_packet_ack", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
@@ -570,11 +615,14 @@ func IBCPacketTimeout(
 
 	callID := startCall()
 	defer endCall(callID)
+	beginCall(callID, checksum, "ibc_packet_timeout", store)
 
 	dbState := buildDBState(store, callID)
 	db := buildDB(&dbState, gasMeter)
-	a := buildAPI(api)
-	q := buildQuerier(querier)
+	apiState := buildAPIState(api, callID)
+	a := buildAPI(&apiState)
+	querierState := buildQuerierState(*querier, callID, checksum)
+	q := buildQuerier(&querierState)
 	var gasUsed cu64
 	errmsg := newUnmanagedVector(nil)
 
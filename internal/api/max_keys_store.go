@@ -0,0 +1,67 @@
+package api
+
+import (
+	"fmt"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// MaxKeysKVStore wraps a KVStore and limits the number of keys in it, capping the state cardinality of a contract.
+// Writing a new key beyond the maximum is not executed and panics with a KVStoreError, which is returned to the
+// contract as an error by the DB callbacks. Updates of existing keys and deletes are always allowed.
+//
+// To distinguish new keys from updates, writes and deletes read the key from the parent store first, which
+// is charged by the parent store like any other read.
+type MaxKeysKVStore struct {
+	parent  KVStore
+	keys    uint64
+	maxKeys uint64
+}
+
+var _ KVStore = (*MaxKeysKVStore)(nil)
+
+// NewMaxKeysKVStore wraps a store containing keys keys such that it holds at most maxKeys keys
+func NewMaxKeysKVStore(parent KVStore, keys uint64, maxKeys uint64) *MaxKeysKVStore {
+	return &MaxKeysKVStore{
+		parent:  parent,
+		keys:    keys,
+		maxKeys: maxKeys,
+	}
+}
+
+// Keys returns the number of keys in the store
+func (s *MaxKeysKVStore) Keys() uint64 {
+	return s.keys
+}
+
+func (s *MaxKeysKVStore) Get(key []byte) []byte {
+	return s.parent.Get(key)
+}
+
+func (s *MaxKeysKVStore) Set(key, value []byte) {
+	if s.parent.Get(key) != nil {
+		s.parent.Set(key, value)
+		return
+	}
+	if s.keys >= s.maxKeys {
+		panic(KVStoreError{Msg: fmt.Sprintf("key limit reached: the store cannot hold more than %d keys", s.maxKeys)})
+	}
+	s.parent.Set(key, value)
+	s.keys++
+}
+
+func (s *MaxKeysKVStore) Delete(key []byte) {
+	existed := s.parent.Get(key) != nil
+	s.parent.Delete(key)
+	if existed && s.keys > 0 {
+		s.keys--
+	}
+}
+
+func (s *MaxKeysKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.parent.Iterator(start, end)
+}
+
+func (s *MaxKeysKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.parent.ReverseIterator(start, end)
+}
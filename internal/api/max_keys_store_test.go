@@ -0,0 +1,50 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxKeysKVStore(t *testing.T) {
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	parent.Set([]byte("existing"), []byte("value"))
+	store := NewMaxKeysKVStore(parent, 1, 3)
+	db := newTestDB(store, gasMeter, callID)
+
+	// up to the cap
+	for _, key := range []string{"a", "b"} {
+		_, _, ret := db.set([]byte(key), []byte("1"))
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, uint64(3), store.Keys())
+
+	// past the cap
+	_, errMsg, ret := db.set([]byte("c"), []byte("1"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "key limit reached: the store cannot hold more than 3 keys", errMsg)
+	require.Nil(t, parent.Get([]byte("c")))
+	require.Equal(t, uint64(3), store.Keys())
+
+	// updates are allowed
+	_, _, ret = db.set([]byte("a"), []byte("2"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.set([]byte("existing"), []byte("2"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("2"), parent.Get([]byte("a")))
+	require.Equal(t, uint64(3), store.Keys())
+
+	// deleting makes room, deleting absent keys does not
+	_, _, ret = db.delete([]byte("absent"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(3), store.Keys())
+	_, _, ret = db.delete([]byte("b"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(2), store.Keys())
+	_, _, ret = db.set([]byte("c"), []byte("1"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, uint64(3), store.Keys())
+}
@@ -39,6 +39,22 @@ func constructUnmanagedVector(is_none cbool, ptr cu8_ptr, len cusize, cap cusize
 	}
 }
 
+// Creates a C.U8SliceView pointing to the given Go memory, which cannot be done in test files directly.
+// The byte slice must outlive the view.
+func constructU8SliceView(s []byte) C.U8SliceView {
+	if s == nil {
+		return C.U8SliceView{is_none: true, ptr: cu8_ptr(nil), len: C.uintptr_t(0)}
+	}
+	if len(s) == 0 {
+		return C.U8SliceView{is_none: false, ptr: cu8_ptr(nil), len: C.uintptr_t(0)}
+	}
+	return C.U8SliceView{
+		is_none: false,
+		ptr:     cu8_ptr(unsafe.Pointer(&s[0])),
+		len:     C.uintptr_t(len(s)),
+	}
+}
+
 func newUnmanagedVector(data []byte) C.UnmanagedVector {
 	if data == nil {
 		return C.new_unmanaged_vector(cbool(true), cu8_ptr(nil), cusize(0))
@@ -54,6 +70,24 @@ func newUnmanagedVector(data []byte) C.UnmanagedVector {
 	}
 }
 
+// LargeAllocationThreshold is the size in bytes above which newCallbackVector calls OnLargeAllocation
+var LargeAllocationThreshold = 1024 * 1024
+
+// OnLargeAllocation is called when a callback returns data larger than LargeAllocationThreshold to Rust.
+// callback is the name of the callback, e.g. "cGet". Set to nil to disable (the default).
+var OnLargeAllocation func(callback string, size int)
+
+// newCallbackVector works like newUnmanagedVector and is used by callbacks for the data they return.
+// It counts the allocation for VectorAllocations and reports large allocations to OnLargeAllocation.
+func newCallbackVector(callID uint64, callback string, data []byte) C.UnmanagedVector {
+	recordVectorAllocation(callID)
+	recordBytesToVM(len(data))
+	if OnLargeAllocation != nil && len(data) > LargeAllocationThreshold {
+		OnLargeAllocation(callback, len(data))
+	}
+	return newUnmanagedVector(data)
+}
+
 func copyAndDestroyUnmanagedVector(v C.UnmanagedVector) []byte {
 	var out []byte
 	if v.is_none {
@@ -69,6 +103,20 @@ func copyAndDestroyUnmanagedVector(v C.UnmanagedVector) []byte {
 	return out
 }
 
+// UnmanagedVectorBytes copies the contents of an UnmanagedVector without destroying it, e.g. to inspect
+// what a callback wrote into an out-vector in tests. isNone is true if the vector is None, in which case
+// data is nil. An empty vector results in an empty, non-nil slice. The caller still owns the vector.
+func UnmanagedVectorBytes(v C.UnmanagedVector) (data []byte, isNone bool) {
+	if v.is_none {
+		return nil, true
+	}
+	if v.len == cusize(0) {
+		// In this case, we don't want to look into the ptr
+		return []byte{}, false
+	}
+	return C.GoBytes(unsafe.Pointer(v.ptr), cint(v.len)), false
+}
+
 // copyU8Slice copies the contents of an Option<&[u8]> that was allocated on the Rust side.
 // Returns nil if and only if the source is None.
 func copyU8Slice(view C.U8SliceView) []byte {
@@ -79,7 +127,33 @@ func copyU8Slice(view C.U8SliceView) []byte {
 		// In this case, we don't want to look into the ptr
 		return []byte{}
 	}
+	recordBytesFromVM(int(view.len))
 	// C.GoBytes create a copy (https://stackoverflow.com/a/40950744/2013738)
 	res := C.GoBytes(unsafe.Pointer(view.ptr), cint(view.len))
 	return res
 }
+
+// zeroizePlaintext zeroes plain if ZeroizeSensitive is set and plain does not share memory with stored,
+// which may be owned by the store
+func zeroizePlaintext(plain, stored []byte) {
+	if ZeroizeSensitive && !sharesMemory(plain, stored) {
+		zeroize(plain)
+	}
+}
+
+// sharesMemory returns true if the backing arrays of a and b overlap
+func sharesMemory(a, b []byte) bool {
+	if cap(a) == 0 || cap(b) == 0 {
+		return false
+	}
+	a, b = a[:cap(a)], b[:cap(b)]
+	startA, startB := uintptr(unsafe.Pointer(&a[0])), uintptr(unsafe.Pointer(&b[0]))
+	return startA < startB+uintptr(len(b)) && startB < startA+uintptr(len(a))
+}
+
+// zeroize overwrites the contents of the given byte slice with zeros
+func zeroize(bz []byte) {
+	for i := range bz {
+		bz[i] = 0
+	}
+}
@@ -56,6 +56,38 @@ func TestCreateAndDestroyUnmanagedVector(t *testing.T) {
 	}
 }
 
+func TestUnmanagedVectorBytes(t *testing.T) {
+	// populated
+	{
+		original := []byte{0xaa, 0xbb, 0x64}
+		unmanaged := newUnmanagedVector(original)
+		data, isNone := UnmanagedVectorBytes(unmanaged)
+		require.False(t, isNone)
+		require.Equal(t, original, data)
+		// the vector is not destroyed
+		require.Equal(t, original, copyAndDestroyUnmanagedVector(unmanaged))
+	}
+
+	// empty
+	{
+		unmanaged := newUnmanagedVector([]byte{})
+		data, isNone := UnmanagedVectorBytes(unmanaged)
+		require.False(t, isNone)
+		require.NotNil(t, data)
+		require.Empty(t, data)
+		copyAndDestroyUnmanagedVector(unmanaged)
+	}
+
+	// none
+	{
+		unmanaged := newUnmanagedVector(nil)
+		data, isNone := UnmanagedVectorBytes(unmanaged)
+		require.True(t, isNone)
+		require.Nil(t, data)
+		copyAndDestroyUnmanagedVector(unmanaged)
+	}
+}
+
 // Like the test above but without `newUnmanagedVector` calls.
 // Since only Rust can actually create them, we only test edge cases here.
 //
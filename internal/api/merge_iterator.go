@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// TieBreak determines how MergeIteratorsWithTieBreak handles keys contained in both iterators
+type TieBreak int
+
+const (
+	// PreferLeft uses the entry of the first iterator and skips the one of the second
+	PreferLeft TieBreak = iota
+	// PreferRight uses the entry of the second iterator and skips the one of the first
+	PreferRight
+	// TieBreakError stops the iteration at the duplicate key. The merged iterator becomes
+	// invalid and its Error method reports the duplicate.
+	TieBreakError
+)
+
+// mergeIterator yields the entries of two ascending iterators in ascending key order.
+// Keys contained in both iterators are handled according to tieBreak.
+type mergeIterator struct {
+	a        dbm.Iterator
+	b        dbm.Iterator
+	tieBreak TieBreak
+	// descending is set if a and b are descending iterators, in which case the merged iterator is descending too
+	descending bool
+	// current points to a or b, depending on which iterator holds the current entry.
+	// It is nil when both iterators are exhausted or a duplicate stopped the iteration.
+	current dbm.Iterator
+	// err is set when a duplicate key was found with TieBreakError
+	err error
+}
+
+var _ dbm.Iterator = (*mergeIterator)(nil)
+
+// MergeIterators combines two ascending iterators into one that yields the keys of both in ascending order.
+// Duplicate keys are resolved deterministically by preferring the entry of a.
+// Closing the merged iterator closes both a and b.
+//
+// This can be used to construct the iterator passed to buildIterator when scanning two ranges at once.
+func MergeIterators(a, b dbm.Iterator) dbm.Iterator {
+	return MergeIteratorsWithTieBreak(a, b, PreferLeft)
+}
+
+// MergeIteratorsWithTieBreak works like MergeIterators but handles duplicate keys according to tieBreak
+func MergeIteratorsWithTieBreak(a, b dbm.Iterator, tieBreak TieBreak) dbm.Iterator {
+	return newMergeIterator(a, b, tieBreak, false)
+}
+
+// newMergeIterator creates a mergeIterator over two iterators which are both ascending or both descending
+func newMergeIterator(a, b dbm.Iterator, tieBreak TieBreak, descending bool) *mergeIterator {
+	m := &mergeIterator{a: a, b: b, tieBreak: tieBreak, descending: descending}
+	m.selectCurrent()
+	return m
+}
+
+// selectCurrent points current to the iterator with the lower key (higher key if descending).
+// If both keys are equal, one of the entries is skipped or the iteration stops, depending on tieBreak.
+func (m *mergeIterator) selectCurrent() {
+	switch {
+	case !m.a.Valid() && !m.b.Valid():
+		m.current = nil
+	case !m.a.Valid():
+		m.current = m.b
+	case !m.b.Valid():
+		m.current = m.a
+	default:
+		cmp := bytes.Compare(m.a.Key(), m.b.Key())
+		if m.descending {
+			cmp = -cmp
+		}
+		switch {
+		case cmp < 0:
+			m.current = m.a
+		case cmp > 0:
+			m.current = m.b
+		case m.tieBreak == PreferLeft:
+			m.b.Next()
+			m.current = m.a
+		case m.tieBreak == PreferRight:
+			m.a.Next()
+			m.current = m.b
+		default:
+			m.err = fmt.Errorf("duplicate key in merged iterators: %X", m.a.Key())
+			m.current = nil
+		}
+	}
+}
+
+// Domain returns the union of both domains, where nil is an open bound
+func (m *mergeIterator) Domain() ([]byte, []byte) {
+	startA, endA := m.a.Domain()
+	startB, endB := m.b.Domain()
+
+	start := startA
+	if startA == nil || startB == nil {
+		start = nil
+	} else if bytes.Compare(startB, startA) < 0 {
+		start = startB
+	}
+	end := endA
+	if endA == nil || endB == nil {
+		end = nil
+	} else if bytes.Compare(endB, endA) > 0 {
+		end = endB
+	}
+	return start, end
+}
+
+func (m *mergeIterator) Valid() bool {
+	return m.current != nil
+}
+
+func (m *mergeIterator) Next() {
+	if m.current == nil {
+		panic("iterator is invalid")
+	}
+	m.current.Next()
+	m.selectCurrent()
+}
+
+func (m *mergeIterator) Key() []byte {
+	if m.current == nil {
+		panic("iterator is invalid")
+	}
+	return m.current.Key()
+}
+
+func (m *mergeIterator) Value() []byte {
+	if m.current == nil {
+		panic("iterator is invalid")
+	}
+	return m.current.Value()
+}
+
+func (m *mergeIterator) Error() error {
+	return errors.Join(m.err, m.a.Error(), m.b.Error())
+}
+
+func (m *mergeIterator) Close() error {
+	return errors.Join(m.a.Close(), m.b.Close())
+}
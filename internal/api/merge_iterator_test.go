@@ -0,0 +1,169 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+)
+
+func collectMerged(t *testing.T, a, b []string, startA, endA, startB, endB []byte) ([]string, []string) {
+	storeA := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	for _, key := range a {
+		storeA.Set([]byte(key), []byte("a"))
+	}
+	storeB := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	for _, key := range b {
+		storeB.Set([]byte(key), []byte("b"))
+	}
+
+	iter := MergeIterators(storeA.Iterator(startA, endA), storeB.Iterator(startB, endB))
+	var keys, values []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		values = append(values, string(iter.Value()))
+	}
+	require.NoError(t, iter.Error())
+	require.NoError(t, iter.Close())
+	return keys, values
+}
+
+func TestMergeIteratorsDisjoint(t *testing.T) {
+	keys, values := collectMerged(t, []string{"a", "b", "c", "x"}, []string{"m", "n", "y"}, nil, []byte("d"), []byte("m"), []byte("z"))
+	require.Equal(t, []string{"a", "b", "c", "m", "n", "y"}, keys)
+	require.Equal(t, []string{"a", "a", "a", "b", "b", "b"}, values)
+}
+
+func TestMergeIteratorsOverlapping(t *testing.T) {
+	keys, values := collectMerged(t, []string{"a", "c", "e", "g"}, []string{"b", "c", "d", "g", "h"}, nil, nil, nil, nil)
+	require.Equal(t, []string{"a", "b", "c", "d", "e", "g", "h"}, keys)
+	// duplicates come from a
+	require.Equal(t, []string{"a", "b", "a", "b", "a", "a", "b"}, values)
+}
+
+func TestMergeIteratorsEmpty(t *testing.T) {
+	keys, _ := collectMerged(t, nil, nil, nil, nil, nil, nil)
+	require.Empty(t, keys)
+
+	keys, _ = collectMerged(t, nil, []string{"a", "b"}, nil, nil, nil, nil)
+	require.Equal(t, []string{"a", "b"}, keys)
+
+	keys, _ = collectMerged(t, []string{"a", "b"}, nil, nil, nil, nil, nil)
+	require.Equal(t, []string{"a", "b"}, keys)
+}
+
+func TestMergeIteratorsDomain(t *testing.T) {
+	store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+
+	iter := MergeIterators(store.Iterator([]byte("c"), []byte("f")), store.Iterator([]byte("a"), []byte("d")))
+	start, end := iter.Domain()
+	require.Equal(t, []byte("a"), start)
+	require.Equal(t, []byte("f"), end)
+	require.NoError(t, iter.Close())
+
+	iter = MergeIterators(store.Iterator([]byte("c"), nil), store.Iterator(nil, []byte("d")))
+	start, end = iter.Domain()
+	require.Nil(t, start)
+	require.Nil(t, end)
+	require.NoError(t, iter.Close())
+}
+
+func TestMergeIteratorsTieBreak(t *testing.T) {
+	storeA := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	for _, key := range []string{"a", "c", "d"} {
+		storeA.Set([]byte(key), []byte("a"))
+	}
+	storeB := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	for _, key := range []string{"b", "c", "e"} {
+		storeB.Set([]byte(key), []byte("b"))
+	}
+
+	collect := func(tieBreak TieBreak) ([]string, error) {
+		iter := MergeIteratorsWithTieBreak(storeA.Iterator(nil, nil), storeB.Iterator(nil, nil), tieBreak)
+		defer iter.Close()
+		var entries []string
+		for ; iter.Valid(); iter.Next() {
+			entries = append(entries, string(iter.Key())+"="+string(iter.Value()))
+		}
+		return entries, iter.Error()
+	}
+
+	entries, err := collect(PreferLeft)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a=a", "b=b", "c=a", "d=a", "e=b"}, entries)
+
+	entries, err = collect(PreferRight)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a=a", "b=b", "c=b", "d=a", "e=b"}, entries)
+
+	entries, err = collect(TieBreakError)
+	require.EqualError(t, err, "duplicate key in merged iterators: 63")
+	require.Equal(t, []string{"a=a", "b=b"}, entries)
+}
+
+func TestMergeIteratorsDescending(t *testing.T) {
+	a := newSortedKVStore()
+	b := newSortedKVStore()
+	for _, key := range []string{"a", "c", "e"} {
+		a.Set([]byte(key), []byte("a"))
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		b.Set([]byte(key), []byte("b"))
+	}
+
+	merged := newMergeIterator(a.ReverseIterator(nil, nil), b.ReverseIterator(nil, nil), PreferLeft, true)
+	var pairs []string
+	for ; merged.Valid(); merged.Next() {
+		pairs = append(pairs, string(merged.Key())+"="+string(merged.Value()))
+	}
+	require.NoError(t, merged.Error())
+	require.NoError(t, merged.Close())
+	require.Equal(t, []string{"e=a", "d=b", "c=a", "b=b", "a=a"}, pairs)
+}
+
+// mergingStore is a KVStore whose ascending iterators merge the entries of two stores
+type mergingStore struct {
+	KVStore
+	other    KVStore
+	tieBreak TieBreak
+}
+
+func (s *mergingStore) Iterator(start, end []byte) dbm.Iterator {
+	return MergeIteratorsWithTieBreak(s.KVStore.Iterator(start, end), s.other.Iterator(start, end), s.tieBreak)
+}
+
+func TestMergeIteratorsTieBreakErrorFailsScan(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := &mergingStore{KVStore: NewLookup(gasMeter), other: NewLookup(gasMeter), tieBreak: TieBreakError}
+	store.KVStore.Set([]byte("a"), []byte("a"))
+	store.KVStore.Set([]byte("c"), []byte("a"))
+	store.other.Set([]byte("b"), []byte("b"))
+	store.other.Set([]byte("c"), []byte("b"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	key, _, _, _, ret := db.next(index)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("a"), key)
+
+	// the step running into the duplicate fails instead of ending the scan
+	_, _, _, errMsg, ret := db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "duplicate key in merged iterators: 63", errMsg)
+	_, _, _, errMsg, ret = db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "duplicate key in merged iterators: 63", errMsg)
+
+	// a duplicate at the first key fails the first step
+	store.KVStore.Delete([]byte("a"))
+	store.other.Delete([]byte("b"))
+	index, _, _, ret = db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, errMsg, ret = db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "duplicate key in merged iterators: 63", errMsg)
+}
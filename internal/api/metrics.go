@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// The process-wide counters below are updated by every callback, so they use atomic operations
+// instead of a lock shared by all contract calls.
+
+// callbackPanics is the number of unexpected panics recovered in callbacks
+var callbackPanics atomic.Uint64
+
+// bytesFromVM and bytesToVM are the number of key, value and message bytes passed from the VM
+// to the callbacks and returned by the callbacks to the VM respectively. Error messages are not counted.
+var bytesFromVM, bytesToVM atomic.Uint64
+
+// callbackGas is the gas reported as used by all callbacks
+var callbackGas atomic.Uint64
+
+// recordCallbackGas adds gas reported by a callback to callbackGas. Called by reportGas.
+func recordCallbackGas(gas uint64) {
+	callbackGas.Add(gas)
+}
+
+// recordCallbackPanic counts a panic recovered by handlePanic
+func recordCallbackPanic() {
+	callbackPanics.Add(1)
+}
+
+// recordBytesFromVM counts data received by a callback from the VM. Called by copyU8Slice.
+func recordBytesFromVM(n int) {
+	bytesFromVM.Add(uint64(n))
+}
+
+// recordBytesToVM counts data returned by a callback to the VM. Called by newCallbackVector.
+func recordBytesToVM(n int) {
+	bytesToVM.Add(uint64(n))
+}
+
+// TotalCallbackPanics returns the number of unexpected panics recovered in callbacks since the process started
+// or ResetMetrics was called. Out of gas panics are not counted.
+func TotalCallbackPanics() uint64 {
+	return callbackPanics.Load()
+}
+
+// TotalBytesTransferred returns the number of bytes passed from the VM to the callbacks (keys, values,
+// query requests and addresses) and returned by the callbacks to the VM since the process started or
+// ResetMetrics was called. Error messages are not counted.
+func TotalBytesTransferred() (fromVM uint64, toVM uint64) {
+	return bytesFromVM.Load(), bytesToVM.Load()
+}
+
+// TotalCallbackGas returns the gas reported as used by the DB and querier callbacks of all contract calls
+// since the process started or ResetMetrics was called. Unlike CallbackGasTotal it includes finished calls.
+func TotalCallbackGas() uint64 {
+	return callbackGas.Load()
+}
+
+// lockMetrics acquires the locks of all lock-guarded package-level metrics in a fixed order and returns a function
+// releasing them. Holding all of them at once gives a consistent view of these metrics for resetting and exporting.
+func lockMetrics() (unlock func()) {
+	latestCallIDMutex.Lock()
+	maxValueWrittenByChecksumMutex.Lock()
+	iteratorFramesMutex.Lock()
+	return func() {
+		iteratorFramesMutex.Unlock()
+		maxValueWrittenByChecksumMutex.Unlock()
+		latestCallIDMutex.Unlock()
+	}
+}
+
+// ResetMetrics zeroes the package-level metrics accumulated over the lifetime of the process, i.e.
+// TotalContractsStarted, TotalCallbackGas, TotalCallbackPanics, TotalBytesTransferred and MaxValueWrittenByChecksum.
+// PeakLiveIterators is reset to the number of iterators open now. This is meant for test isolation and
+// for operator-triggered resets. Per-call data of running calls and call IDs are not affected.
+//
+// ResetMetrics is safe to call concurrently with contract calls. The reset is atomic per counter only:
+// TotalCallbackGas, TotalCallbackPanics and TotalBytesTransferred are updated without a lock, so a concurrent
+// reader can observe some of them reset and others not, and updates of running calls can land right after the reset.
+func ResetMetrics() {
+	unlock := lockMetrics()
+	defer unlock()
+
+	contractsStarted = 0
+	maxValueWrittenByChecksum = make(map[string]int)
+	peakLiveIterators = liveIterators
+	callbackGas.Store(0)
+	callbackPanics.Store(0)
+	bytesFromVM.Store(0)
+	bytesToVM.Store(0)
+}
+
+// WriteMetrics writes the package-level metrics in the Prometheus text exposition format, such that
+// they can be served to a Prometheus scraper directly. Counters only increase until ResetMetrics is called.
+// The per-call accessors remain the way to get the data of a single call.
+func WriteMetrics(w io.Writer) error {
+	activeCallsMutex.Lock()
+	running := uint64(len(activeCalls))
+	activeCallsMutex.Unlock()
+
+	gas, panics := callbackGas.Load(), callbackPanics.Load()
+	fromVM, toVM := bytesFromVM.Load(), bytesToVM.Load()
+
+	// take a consistent snapshot of the lock-guarded metrics
+	unlock := lockMetrics()
+	started := contractsStarted
+	live, peak := liveIterators, peakLiveIterators
+	checksums := make([]string, 0, len(maxValueWrittenByChecksum))
+	maxValues := make(map[string]int, len(maxValueWrittenByChecksum))
+	for checksum, size := range maxValueWrittenByChecksum {
+		encoded := hex.EncodeToString([]byte(checksum))
+		checksums = append(checksums, encoded)
+		maxValues[encoded] = size
+	}
+	unlock()
+	sort.Strings(checksums)
+
+	var b strings.Builder
+	writeMetric := func(name, kind, help string, value uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	writeMetric("wasmvm_contracts_started_total", "counter", "Number of contract calls started.", started)
+	writeMetric("wasmvm_callback_gas_total", "counter", "Gas reported as used by the callbacks of all contract calls.", gas)
+	writeMetric("wasmvm_callback_panics_total", "counter", "Number of unexpected panics recovered in callbacks.", panics)
+	writeMetric("wasmvm_bytes_from_vm_total", "counter", "Number of bytes passed from the VM to the callbacks.", fromVM)
+	writeMetric("wasmvm_bytes_to_vm_total", "counter", "Number of bytes returned by the callbacks to the VM.", toVM)
+	writeMetric("wasmvm_active_calls", "gauge", "Number of contract calls running.", running)
+	writeMetric("wasmvm_live_iterators", "gauge", "Number of open iterators.", live)
+	writeMetric("wasmvm_peak_live_iterators", "gauge", "Highest number of iterators open at the same time.", peak)
+	b.WriteString("# HELP wasmvm_max_value_written_bytes Size of the largest value written by a contract.\n")
+	b.WriteString("# TYPE wasmvm_max_value_written_bytes gauge\n")
+	for _, checksum := range checksums {
+		fmt.Fprintf(&b, "wasmvm_max_value_written_bytes{checksum=\"%s\"} %d\n", checksum, maxValues[checksum])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResetMetrics(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	checksum := []byte("reset-metrics")
+
+	for i := 0; i < 3; i++ {
+		callID := startCall()
+		setCallChecksum(callID, checksum)
+		db := newTestDB(store, gasMeter, callID)
+		_, _, ret := db.set([]byte("key"), []byte("value"))
+		require.Equal(t, goErrorNone, ret)
+		endCall(callID)
+	}
+	PrintStackOnPanic = false
+	defer func() { PrintStackOnPanic = true }()
+	ret := safeCallback("cTest", func() error { panic("boom") })
+	require.Equal(t, goErrorPanic, ret)
+
+	require.GreaterOrEqual(t, TotalContractsStarted(), uint64(3))
+	require.Equal(t, 5, MaxValueWrittenByChecksum(checksum))
+	require.GreaterOrEqual(t, TotalCallbackPanics(), uint64(1))
+	require.GreaterOrEqual(t, TotalCallbackGas(), uint64(3*SetPrice))
+	fromVM, _ := TotalBytesTransferred()
+	require.GreaterOrEqual(t, fromVM, uint64(3*len("keyvalue")))
+
+	running := startCall()
+	defer endCall(running)
+	ResetMetrics()
+	require.Equal(t, uint64(0), TotalContractsStarted())
+	require.Equal(t, 0, MaxValueWrittenByChecksum(checksum))
+	require.Equal(t, uint64(0), TotalCallbackPanics())
+	require.Equal(t, uint64(0), TotalCallbackGas())
+	fromVM, toVM := TotalBytesTransferred()
+	require.Equal(t, uint64(0), fromVM)
+	require.Equal(t, uint64(0), toVM)
+
+	// call IDs keep increasing and metrics are collected again
+	callID := startCall()
+	defer endCall(callID)
+	require.Greater(t, callID, running)
+	require.Equal(t, uint64(1), TotalContractsStarted())
+}
+
+// promLine matches comment and sample lines of the Prometheus text exposition format for integer values
+var promLine = regexp.MustCompile(`^(# (HELP|TYPE) [a-zA-Z_:][a-zA-Z0-9_:]* .+|([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"]*"\})? ([0-9]+))$`)
+
+// parseMetrics parses the output of WriteMetrics into a map from metric (including labels) to value
+func parseMetrics(t *testing.T, out string) map[string]uint64 {
+	require.True(t, strings.HasSuffix(out, "\n"))
+	samples := make(map[string]uint64)
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		m := promLine.FindStringSubmatch(line)
+		require.NotNil(t, m, "invalid line %q", line)
+		if m[3] == "" {
+			continue
+		}
+		value, err := strconv.ParseUint(m[5], 10, 64)
+		require.NoError(t, err)
+		samples[m[3]+m[4]] = value
+	}
+	return samples
+}
+
+func TestWriteMetrics(t *testing.T) {
+	ResetMetrics()
+	var before strings.Builder
+	require.NoError(t, WriteMetrics(&before))
+	base := parseMetrics(t, before.String())
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	callID := startCall()
+	setCallChecksum(callID, []byte{0xab, 0xcd})
+	db := newTestDB(store, gasMeter, callID)
+	_, _, ret := db.set([]byte("key"), []byte("12345"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, ret = db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, ret = db.scan(nil, nil, Descending)
+	require.Equal(t, goErrorNone, ret)
+	value, _, _, ret := db.get([]byte("key"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("12345"), value)
+	PrintStackOnPanic = false
+	defer func() { PrintStackOnPanic = true }()
+	require.Equal(t, goErrorPanic, safeCallback("cTest", func() error { panic("boom") }))
+	callGas := CallbackGasTotal(callID)
+
+	var out strings.Builder
+	require.NoError(t, WriteMetrics(&out))
+	require.Contains(t, out.String(), "# TYPE wasmvm_contracts_started_total counter\nwasmvm_contracts_started_total ")
+	metrics := parseMetrics(t, out.String())
+	require.Equal(t, base["wasmvm_contracts_started_total"]+1, metrics["wasmvm_contracts_started_total"])
+	require.Equal(t, base["wasmvm_callback_gas_total"]+callGas, metrics["wasmvm_callback_gas_total"])
+	require.Equal(t, base["wasmvm_callback_panics_total"]+1, metrics["wasmvm_callback_panics_total"])
+	require.GreaterOrEqual(t, metrics["wasmvm_bytes_from_vm_total"], base["wasmvm_bytes_from_vm_total"]+uint64(len("key12345key")))
+	require.GreaterOrEqual(t, metrics["wasmvm_bytes_to_vm_total"], base["wasmvm_bytes_to_vm_total"]+uint64(len("12345")))
+	require.Equal(t, base["wasmvm_active_calls"]+1, metrics["wasmvm_active_calls"])
+	require.Equal(t, base["wasmvm_live_iterators"]+2, metrics["wasmvm_live_iterators"])
+	require.Equal(t, base["wasmvm_peak_live_iterators"]+2, metrics["wasmvm_peak_live_iterators"])
+	require.Equal(t, uint64(5), metrics[`wasmvm_max_value_written_bytes{checksum="abcd"}`])
+
+	// counters do not decrease when the call ends
+	endCall(callID)
+	out.Reset()
+	require.NoError(t, WriteMetrics(&out))
+	after := parseMetrics(t, out.String())
+	for name, value := range metrics {
+		if strings.HasSuffix(name, "_total") {
+			require.GreaterOrEqual(t, after[name], value, name)
+		}
+	}
+	require.Equal(t, metrics["wasmvm_active_calls"]-1, after["wasmvm_active_calls"])
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"strings"
 	"testing"
 
@@ -185,6 +186,12 @@ type ErrorOutOfGas struct {
 	Descriptor string
 }
 
+// PanicOutOfGas panics like the finschia-sdk gas meter when running out of gas. This allows testing
+// how callbacks handle out of gas without importing the SDK, since only the type name of the panic value matters.
+func PanicOutOfGas() {
+	panic(ErrorOutOfGas{Descriptor: "PanicOutOfGas"})
+}
+
 // ErrorGasOverflow defines an error thrown when an action results gas consumption
 // unsigned integer overflow.
 type ErrorGasOverflow struct {
@@ -328,6 +335,97 @@ func (l Lookup) ReverseIterator(start, end []byte) dbm.Iterator {
 
 var _ KVStore = (*Lookup)(nil)
 
+// SeededLookup is a Lookup whose iterators yield the entries in a pseudo-random order determined by a seed.
+// This simulates backends without ordering guarantees in fuzz tests: the same seed and the same sequence
+// of operations always result in the same iteration sequences, so failures are reproducible.
+// Note that the KVStore interface requires ordered iteration, so this must never be used outside of tests.
+type SeededLookup struct {
+	*Lookup
+	rng *rand.Rand
+}
+
+var _ KVStore = (*SeededLookup)(nil)
+
+func NewSeededLookup(meter MockGasMeter, seed int64) *SeededLookup {
+	return &SeededLookup{
+		Lookup: NewLookup(meter),
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (l *SeededLookup) Iterator(start, end []byte) dbm.Iterator {
+	return l.shuffle(l.Lookup.Iterator(start, end), start, end)
+}
+
+func (l *SeededLookup) ReverseIterator(start, end []byte) dbm.Iterator {
+	return l.shuffle(l.Lookup.ReverseIterator(start, end), start, end)
+}
+
+// shuffle collects all entries of iter and returns an iterator over them in a pseudo-random order
+func (l *SeededLookup) shuffle(iter dbm.Iterator, start, end []byte) dbm.Iterator {
+	defer iter.Close()
+	var items []kvPair
+	for ; iter.Valid(); iter.Next() {
+		items = append(items, kvPair{key: iter.Key(), value: iter.Value()})
+	}
+	l.rng.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+	return &sliceIterator{start: start, end: end, items: items}
+}
+
+// kvPair is a key/value pair in a sliceIterator
+type kvPair struct {
+	key   []byte
+	value []byte
+}
+
+// sliceIterator iterates over a snapshot of key/value pairs
+type sliceIterator struct {
+	start []byte
+	end   []byte
+	items []kvPair
+	pos   int
+}
+
+var _ dbm.Iterator = (*sliceIterator)(nil)
+
+func (i *sliceIterator) Domain() ([]byte, []byte) {
+	return i.start, i.end
+}
+
+func (i *sliceIterator) Valid() bool {
+	return i.pos < len(i.items)
+}
+
+func (i *sliceIterator) Next() {
+	if !i.Valid() {
+		panic("iterator is invalid")
+	}
+	i.pos++
+}
+
+func (i *sliceIterator) Key() []byte {
+	if !i.Valid() {
+		panic("iterator is invalid")
+	}
+	return i.items[i.pos].key
+}
+
+func (i *sliceIterator) Value() []byte {
+	if !i.Valid() {
+		panic("iterator is invalid")
+	}
+	return i.items[i.pos].value
+}
+
+func (i *sliceIterator) Error() error {
+	return nil
+}
+
+func (i *sliceIterator) Close() error {
+	i.items = nil
+	return nil
+}
+
 /***** Mock GoAPI ****/
 
 const CanonicalLength = 32
@@ -368,6 +466,26 @@ func NewMockAPI() *GoAPI {
 	}
 }
 
+// DefaultTestGoAPI returns a GoAPI with identity address conversions for tests that do not care about
+// address formats: the canonical form of an address are the bytes of its human form. Unlike NewMockAPI,
+// addresses of any non-zero length are supported. Empty addresses are rejected in both directions.
+func DefaultTestGoAPI() GoAPI {
+	return GoAPI{
+		HumanAddress: func(canon []byte) (string, uint64, error) {
+			if len(canon) == 0 {
+				return "", 0, fmt.Errorf("empty canonical address")
+			}
+			return string(canon), CostHuman, nil
+		},
+		CanonicalAddress: func(human string) ([]byte, uint64, error) {
+			if len(human) == 0 {
+				return nil, 0, fmt.Errorf("empty human address")
+			}
+			return []byte(human), CostCanonical, nil
+		},
+	}
+}
+
 func TestMockApi(t *testing.T) {
 	human := "foobar"
 	canon, cost, err := MockCanonicalAddress(human)
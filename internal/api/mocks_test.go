@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+)
+
+func TestSeededLookup(t *testing.T) {
+	// keysOf runs the same operations against a new store and returns the keys of several scans
+	keysOf := func(seed int64) [][]string {
+		store := NewSeededLookup(NewMockGasMeter(TESTING_GAS_LIMIT), seed)
+		for i := 0; i < 20; i++ {
+			store.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+		}
+		var scans [][]string
+		for _, iter := range []dbm.Iterator{
+			store.Iterator(nil, nil),
+			store.Iterator(nil, nil),
+			store.ReverseIterator([]byte("key05"), []byte("key15")),
+		} {
+			var keys []string
+			for ; iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			require.NoError(t, iter.Close())
+			scans = append(scans, keys)
+		}
+		return scans
+	}
+
+	first := keysOf(42)
+	require.Len(t, first[0], 20)
+	require.Len(t, first[2], 10)
+	require.False(t, sort.StringsAreSorted(first[0]))
+	// iterators of the same store are shuffled differently
+	require.NotEqual(t, first[0], first[1])
+
+	// the same seed yields the same sequences
+	require.Equal(t, first, keysOf(42))
+	// other seeds yield other sequences
+	require.NotEqual(t, first, keysOf(43))
+
+	// the entries are the same as in the ordered store
+	sorted := append([]string(nil), first[2]...)
+	sort.Strings(sorted)
+	var expected []string
+	for i := 5; i < 15; i++ {
+		expected = append(expected, fmt.Sprintf("key%02d", i))
+	}
+	require.Equal(t, expected, sorted)
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// scriptOp is one operation of a script run against a store through the DB callbacks
+type scriptOp struct {
+	set   bool
+	del   bool
+	key   []byte
+	value []byte
+	// scan parameters, used if neither set nor del is true
+	start []byte
+	end   []byte
+	order Order
+}
+
+// runScript executes ops through the DB callbacks and returns a transcript of all observable results.
+// Scans are iterated to the end with cNext.
+func runScript(store KVStore, ops []scriptOp) ([]string, error) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	var transcript []string
+	for i, op := range ops {
+		switch {
+		case op.set:
+			if _, errMsg, ret := db.set(op.key, op.value); ret != goErrorNone {
+				return nil, fmt.Errorf("op %d: set failed (%d): %s", i, ret, errMsg)
+			}
+		case op.del:
+			if _, errMsg, ret := db.delete(op.key); ret != goErrorNone {
+				return nil, fmt.Errorf("op %d: delete failed (%d): %s", i, ret, errMsg)
+			}
+		default:
+			index, _, errMsg, ret := db.scan(op.start, op.end, op.order)
+			if ret != goErrorNone {
+				transcript = append(transcript, fmt.Sprintf("%d: scan error %d: %s", i, ret, errMsg))
+				continue
+			}
+			for {
+				key, value, _, errMsg, ret := db.next(index)
+				if ret != goErrorNone {
+					return nil, fmt.Errorf("op %d: next failed (%d): %s", i, ret, errMsg)
+				}
+				if key == nil {
+					break
+				}
+				transcript = append(transcript, fmt.Sprintf("%d: %X=%X", i, key, value))
+			}
+		}
+	}
+	return transcript, nil
+}
+
+// compareStores runs the same script against two stores and returns an error describing
+// the first difference in their transcripts.
+func compareStores(a, b KVStore, ops []scriptOp) error {
+	transcriptA, err := runScript(a, ops)
+	if err != nil {
+		return fmt.Errorf("store a: %w", err)
+	}
+	transcriptB, err := runScript(b, ops)
+	if err != nil {
+		return fmt.Errorf("store b: %w", err)
+	}
+	for i := 0; i < len(transcriptA) && i < len(transcriptB); i++ {
+		if transcriptA[i] != transcriptB[i] {
+			return fmt.Errorf("transcripts differ at entry %d: %q != %q", i, transcriptA[i], transcriptB[i])
+		}
+	}
+	if len(transcriptA) != len(transcriptB) {
+		return fmt.Errorf("transcript lengths differ: %d != %d", len(transcriptA), len(transcriptB))
+	}
+	return nil
+}
+
+// randomScript creates a script of random writes, deletes and scans over a small key space
+func randomScript(rng *rand.Rand, length int) []scriptOp {
+	randomKey := func() []byte {
+		key := make([]byte, 1+rng.Intn(3))
+		for i := range key {
+			key[i] = byte('a' + rng.Intn(4))
+		}
+		return key
+	}
+
+	ops := make([]scriptOp, length)
+	for i := range ops {
+		switch rng.Intn(4) {
+		case 0, 1:
+			ops[i] = scriptOp{set: true, key: randomKey(), value: []byte{byte(i)}}
+		case 2:
+			ops[i] = scriptOp{del: true, key: randomKey()}
+		default:
+			op := scriptOp{order: Ascending}
+			if rng.Intn(2) == 0 {
+				op.order = Descending
+			}
+			if rng.Intn(2) == 0 {
+				op.start = randomKey()
+			}
+			if rng.Intn(2) == 0 {
+				op.end = randomKey()
+			}
+			ops[i] = op
+		}
+	}
+	return ops
+}
+
+func TestCompareStoresSortedAgainstLookup(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	ops := randomScript(rng, 300)
+	err := compareStores(newSortedKVStore(), NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT)), ops)
+	require.NoError(t, err)
+}
+
+// wrongOrderStore is a deliberately broken store returning ascending iterators for reverse scans
+type wrongOrderStore struct {
+	*sortedKVStore
+}
+
+func (s wrongOrderStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.sortedKVStore.Iterator(start, end)
+}
+
+func TestCompareStoresDetectsDivergence(t *testing.T) {
+	ops := []scriptOp{
+		{set: true, key: []byte("a"), value: []byte("1")},
+		{set: true, key: []byte("b"), value: []byte("2")},
+		{start: nil, end: nil, order: Ascending},
+		{start: nil, end: nil, order: Descending},
+	}
+	err := compareStores(newSortedKVStore(), wrongOrderStore{newSortedKVStore()}, ops)
+	require.EqualError(t, err, `transcripts differ at entry 2: "3: 62=32" != "3: 61=31"`)
+
+	// without reverse scans, the broken store is indistinguishable
+	err = compareStores(newSortedKVStore(), wrongOrderStore{newSortedKVStore()}, ops[:3])
+	require.NoError(t, err)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"sync"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// PinnedKeyCache holds values of hot keys of one contract store across calls. The host populates it via Pin
+// and attaches it to the store of every call using NewPinnedKeysKVStore, which serves reads of pinned keys
+// without accessing the store and invalidates entries on writes and deletes.
+//
+// A cache must only ever be used with the store of a single contract, since entries are keyed by the raw
+// store key. Hosts keep one cache per contract, e.g. indexed by contract address. Writes bypassing the
+// wrapper must be followed by Invalidate.
+type PinnedKeyCache struct {
+	mutex   sync.RWMutex
+	entries map[string][]byte
+}
+
+func NewPinnedKeyCache() *PinnedKeyCache {
+	return &PinnedKeyCache{
+		entries: make(map[string][]byte),
+	}
+}
+
+// Pin stores the value of key in the cache
+func (c *PinnedKeyCache) Pin(key, value []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[string(key)] = cloneBytes(value)
+}
+
+// Invalidate removes key from the cache. Subsequent reads go to the store until the key is pinned again.
+func (c *PinnedKeyCache) Invalidate(key []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, string(key))
+}
+
+// Len returns the number of pinned keys
+func (c *PinnedKeyCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.entries)
+}
+
+// get returns the pinned value of key
+func (c *PinnedKeyCache) get(key []byte) ([]byte, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	value, ok := c.entries[string(key)]
+	return value, ok
+}
+
+// PinnedKeysKVStore wraps the store of a contract and serves reads of the keys pinned in a PinnedKeyCache
+// without accessing the parent store. Set and Delete invalidate the cache entry of the key.
+// Iterators are served by the parent store.
+//
+// Every Get charges the same fixed readGas to the given meter, no matter if it is served from the cache
+// or the parent store. Since caches differ between nodes, the parent store must not charge gas for reads
+// itself, otherwise the gas used by a contract depends on the state of the local cache. Hosts can achieve
+// this by wrapping the store below their gas metering layer.
+type PinnedKeysKVStore struct {
+	parent  KVStore
+	cache   *PinnedKeyCache
+	meter   GasConsumer
+	readGas Gas
+}
+
+var _ KVStore = (*PinnedKeysKVStore)(nil)
+
+func NewPinnedKeysKVStore(parent KVStore, cache *PinnedKeyCache, meter GasConsumer, readGas Gas) *PinnedKeysKVStore {
+	return &PinnedKeysKVStore{
+		parent:  parent,
+		cache:   cache,
+		meter:   meter,
+		readGas: readGas,
+	}
+}
+
+// Get charges readGas and returns the pinned value of key if present or reads from the parent store otherwise
+func (s *PinnedKeysKVStore) Get(key []byte) []byte {
+	s.meter.ConsumeGas(s.readGas, "pinned keys read")
+	if value, ok := s.cache.get(key); ok {
+		return cloneBytes(value)
+	}
+	return s.parent.Get(key)
+}
+
+func (s *PinnedKeysKVStore) Set(key, value []byte) {
+	s.parent.Set(key, value)
+	s.cache.Invalidate(key)
+}
+
+func (s *PinnedKeysKVStore) Delete(key []byte) {
+	s.parent.Delete(key)
+	s.cache.Invalidate(key)
+}
+
+func (s *PinnedKeysKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.parent.Iterator(start, end)
+}
+
+func (s *PinnedKeysKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.parent.ReverseIterator(start, end)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinnedKeysKVStore(t *testing.T) {
+	cache := NewPinnedKeyCache()
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	// the parent store does not charge gas for reads
+	parent := newSortedKVStore()
+	parent.Set([]byte("config"), []byte("v1"))
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(NewPinnedKeysKVStore(parent, cache, gasMeter, GetPrice), gasMeter, callID)
+
+	// miss
+	val, missGas, _, ret := db.get([]byte("config"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("v1"), val)
+	require.Equal(t, GetPrice, missGas)
+
+	cache.Pin([]byte("config"), []byte("v1"))
+	require.Equal(t, 1, cache.Len())
+
+	// hit, the store is not accessed but the gas is the same
+	parent.Set([]byte("config"), []byte("changed behind the cache"))
+	val, hitGas, _, ret := db.get([]byte("config"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("v1"), val)
+	require.Equal(t, missGas, hitGas)
+	cache.Invalidate([]byte("config"))
+	parent.Set([]byte("config"), []byte("v1"))
+
+	// absent keys cost the same as well
+	val, gas, _, ret := db.get([]byte("missing"))
+	require.Equal(t, goErrorNone, ret)
+	require.Nil(t, val)
+	require.Equal(t, missGas, gas)
+
+	// the cache is shared across calls
+	cache.Pin([]byte("config"), []byte("v1"))
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	otherMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	other := newTestDB(NewPinnedKeysKVStore(newSortedKVStore(), cache, otherMeter, GetPrice), otherMeter, otherCallID)
+	val, gas, _, _ = other.get([]byte("config"))
+	require.Equal(t, []byte("v1"), val)
+	require.Equal(t, missGas, gas)
+
+	// writes invalidate
+	_, _, ret = db.set([]byte("config"), []byte("v2"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, 0, cache.Len())
+	val, _, _, _ = db.get([]byte("config"))
+	require.Equal(t, []byte("v2"), val)
+
+	// deletes invalidate
+	cache.Pin([]byte("config"), []byte("v2"))
+	_, _, ret = db.delete([]byte("config"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, 0, cache.Len())
+	val, _, _, _ = db.get([]byte("config"))
+	require.Nil(t, val)
+
+	// explicit invalidation
+	cache.Pin([]byte("other"), []byte("x"))
+	cache.Invalidate([]byte("other"))
+	require.Equal(t, 0, cache.Len())
+}
+
+func TestPinnedKeysGasDoesNotDependOnTheCache(t *testing.T) {
+	// two nodes with the same state, but only one of them has the key pinned
+	run := func(pinned bool) uint64 {
+		gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+		parent := newSortedKVStore()
+		parent.Set([]byte("config"), []byte("value"))
+		cache := NewPinnedKeyCache()
+		if pinned {
+			cache.Pin([]byte("config"), []byte("value"))
+		}
+
+		callID := startCall()
+		defer endCall(callID)
+		db := newTestDB(NewPinnedKeysKVStore(parent, cache, gasMeter, GetPrice), gasMeter, callID)
+		var total uint64
+		for _, key := range []string{"config", "missing", "config"} {
+			_, gas, _, ret := db.get([]byte(key))
+			require.Equal(t, goErrorNone, ret)
+			total += gas
+		}
+		require.Equal(t, total, gasMeter.GasConsumed())
+		return total
+	}
+	require.Equal(t, run(false), run(true))
+}
+
+func TestPinnedKeysAreScopedToTheStore(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	storeA, storeB := newSortedKVStore(), newSortedKVStore()
+	storeA.Set([]byte("config"), []byte("a"))
+	storeB.Set([]byte("config"), []byte("b"))
+	cacheA, cacheB := NewPinnedKeyCache(), NewPinnedKeyCache()
+	cacheA.Pin([]byte("config"), []byte("a"))
+	cacheB.Pin([]byte("config"), []byte("b"))
+
+	callA, callB := startCall(), startCall()
+	defer endCall(callA)
+	defer endCall(callB)
+	dbA := newTestDB(NewPinnedKeysKVStore(storeA, cacheA, gasMeter, GetPrice), gasMeter, callA)
+	dbB := newTestDB(NewPinnedKeysKVStore(storeB, cacheB, gasMeter, GetPrice), gasMeter, callB)
+
+	// both contracts read their own value of the shared key
+	val, _, _, ret := dbA.get([]byte("config"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("a"), val)
+	val, _, _, ret = dbB.get([]byte("config"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("b"), val)
+
+	// a write of one contract does not invalidate the entry of the other
+	_, _, ret = dbA.set([]byte("config"), []byte("a2"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, 0, cacheA.Len())
+	require.Equal(t, 1, cacheB.Len())
+	val, _, _, _ = dbA.get([]byte("config"))
+	require.Equal(t, []byte("a2"), val)
+	val, _, _, _ = dbB.get([]byte("config"))
+	require.Equal(t, []byte("b"), val)
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+
+	"github.com/Finschia/wasmvm/types"
+)
+
+// errQueryAborted is returned to the contract when a query was aborted via AbortCall
+const errQueryAborted = "query aborted"
+
+// ContextQuerier is an optional extension of Querier for queriers that support cancellation.
+// cQueryExternal calls QueryContext instead of Query with a context that is canceled by AbortCall.
+type ContextQuerier interface {
+	Querier
+	QueryContext(ctx context.Context, request types.QueryRequest, gasLimit uint64) ([]byte, error)
+}
+
+// contextQuerier adapts a ContextQuerier to the Querier interface using a fixed context
+type contextQuerier struct {
+	inner ContextQuerier
+	ctx   context.Context
+}
+
+var _ Querier = contextQuerier{}
+
+func (q contextQuerier) Query(request types.QueryRequest, gasLimit uint64) ([]byte, error) {
+	return q.inner.QueryContext(q.ctx, request, gasLimit)
+}
+
+func (q contextQuerier) GasConsumed() uint64 {
+	return q.inner.GasConsumed()
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Finschia/wasmvm/types"
+)
+
+// blockingQuerier blocks every query until its context is canceled
+type blockingQuerier struct {
+	started chan struct{}
+}
+
+var _ ContextQuerier = blockingQuerier{}
+
+func (q blockingQuerier) Query(request types.QueryRequest, gasLimit uint64) ([]byte, error) {
+	panic("QueryContext must be used")
+}
+
+func (q blockingQuerier) QueryContext(ctx context.Context, _ types.QueryRequest, _ uint64) ([]byte, error) {
+	q.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (q blockingQuerier) GasConsumed() uint64 {
+	return 0
+}
+
+func TestAbortQueries(t *testing.T) {
+	querier := blockingQuerier{started: make(chan struct{}, 1)}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+	request := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+
+	type result struct {
+		errMsg string
+		ret    goError
+	}
+	done := make(chan result)
+	go func() {
+		_, _, errMsg, ret := query(&state, 50000, request)
+		done <- result{errMsg, ret}
+	}()
+
+	<-querier.started
+	AbortQueries(state.CallID)
+	res := <-done
+	require.Equal(t, goErrorUser, res.ret)
+	require.Equal(t, errQueryAborted, res.errMsg)
+
+	// later queries of the call fail immediately
+	_, _, errMsg, ret := query(&state, 50000, request)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, errQueryAborted, errMsg)
+	require.Len(t, querier.started, 0)
+}
+
+func TestAbortQueriesOtherCalls(t *testing.T) {
+	abortedCallID := startCall()
+	defer endCall(abortedCallID)
+	AbortQueries(abortedCallID)
+
+	querier := &meteredQuerier{response: []byte(`{}`)}
+	state := buildQuerierState(querier, startCall(), []byte("checksum"))
+	defer endCall(state.CallID)
+	_, _, errMsg, ret := query(&state, 50000, []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`))
+	require.Equal(t, goErrorNone, ret)
+	require.Empty(t, errMsg)
+}
+
+func TestAbortCall(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set([]byte(key), []byte("value"))
+	}
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+	querier := blockingQuerier{started: make(chan struct{}, 1)}
+	state := buildQuerierState(querier, callID, []byte("checksum"))
+	request := []byte(`{"bank":{"balance":{"address":"foo","denom":"bar"}}}`)
+
+	// mid-iteration
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	key, _, _, _, ret := db.next(index)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("a"), key)
+
+	// mid-query
+	done := make(chan string)
+	go func() {
+		_, _, errMsg, _ := query(&state, 50000, request)
+		done <- errMsg
+	}()
+	<-querier.started
+
+	// one abort stops both
+	AbortCall(callID)
+	require.Equal(t, errQueryAborted, <-done)
+	key, _, _, errMsg, ret := db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, errIterationAborted, errMsg)
+	require.Nil(t, key)
+
+	// also for iterators created afterwards
+	index, _, _, ret = db.scan(nil, nil, Descending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, errMsg, ret = db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, errIterationAborted, errMsg)
+
+	// other calls are not affected
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	other := newTestDB(store, gasMeter, otherCallID)
+	index, _, _, _ = other.scan(nil, nil, Ascending)
+	key, _, _, _, ret = other.next(index)
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("a"), key)
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the tokens available to one checksum and the time it was last refilled
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// ReadRateLimiter limits the rate of reads per contract checksum using token buckets. Every cGet and cScan
+// takes one token from the bucket of the contract. Buckets start full and are refilled continuously.
+// Calls without a known checksum share one bucket. Time is taken from the package clock.
+//
+// Rate limiting depends on wall time and is not deterministic: the same read may succeed on one node and
+// fail on another. It must never be enabled on validators or any node executing transactions, since this
+// breaks consensus. Use it on nodes serving queries only.
+//
+// Buckets of contracts that were idle long enough for their bucket to be full again are evicted,
+// since a new bucket starts full as well. This bounds memory to the contracts read from recently.
+type ReadRateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// refillTime is the time an empty bucket takes to become full, 0 if buckets are never refilled
+	refillTime time.Duration
+	// lastEviction is the time idle buckets were last evicted
+	lastEviction time.Time
+}
+
+// NewReadRateLimiter creates a limiter allowing readsPerSecond reads on average and bursts of up to burst reads
+func NewReadRateLimiter(readsPerSecond float64, burst int) *ReadRateLimiter {
+	var refillTime time.Duration
+	if readsPerSecond > 0 {
+		refillTime = time.Duration(float64(burst) / readsPerSecond * float64(time.Second))
+	}
+	return &ReadRateLimiter{
+		rate:         readsPerSecond,
+		burst:        float64(burst),
+		buckets:      make(map[string]*tokenBucket),
+		refillTime:   refillTime,
+		lastEviction: nowFunc(),
+	}
+}
+
+// evictIdle removes the buckets that were not used for refillTime, i.e. are full again.
+// Must be called while holding the mutex.
+func (l *ReadRateLimiter) evictIdle(now time.Time) {
+	for checksum, bucket := range l.buckets {
+		if now.Sub(bucket.lastRefill) >= l.refillTime {
+			delete(l.buckets, checksum)
+		}
+	}
+	l.lastEviction = now
+}
+
+// ReadRateLimit is the limiter consulted by cGet and cScan. Reads exceeding the rate fail with
+// a "read rate exceeded" user error. Set to nil to disable (the default).
+var ReadRateLimit *ReadRateLimiter
+
+// errReadRateExceeded is the error returned by cGet and cScan when ReadRateLimit rejects a read
+const errReadRateExceeded = "read rate exceeded"
+
+// allow takes a token from the bucket of checksum and returns false if the bucket is empty
+func (l *ReadRateLimiter) allow(checksum []byte) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := nowFunc()
+	// sweeping at most once per refillTime keeps the amortized cost per read constant
+	if l.refillTime > 0 && now.Sub(l.lastEviction) >= l.refillTime {
+		l.evictIdle(now)
+	}
+	bucket, ok := l.buckets[string(checksum)]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastRefill: now}
+		l.buckets[string(checksum)] = bucket
+	}
+	if elapsed := now.Sub(bucket.lastRefill); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * l.rate
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+		bucket.lastRefill = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// allowRead returns false if ReadRateLimit is set and rejects a read in the given call
+func allowRead(callID uint64) bool {
+	limiter := ReadRateLimit
+	return limiter == nil || limiter.allow(callChecksum(callID))
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRateLimiter(t *testing.T) {
+	clock := useFakeClock(t)
+	ReadRateLimit = NewReadRateLimiter(2, 3)
+	defer func() { ReadRateLimit = nil }()
+
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	store.Set([]byte("foo"), []byte("bar"))
+	callID := startCall()
+	defer endCall(callID)
+	setCallChecksum(callID, []byte("checksum1"))
+	db := newTestDB(store, gasMeter, callID)
+
+	// the bucket starts full, reads and scans take a token each
+	for i := 0; i < 2; i++ {
+		_, _, _, ret := db.get([]byte("foo"))
+		require.Equal(t, goErrorNone, ret)
+	}
+	_, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+
+	// exhausted
+	_, _, errMsg, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "read rate exceeded", errMsg)
+	_, _, errMsg, ret = db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "read rate exceeded", errMsg)
+
+	// other contracts have their own bucket
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	setCallChecksum(otherCallID, []byte("checksum2"))
+	other := newTestDB(store, gasMeter, otherCallID)
+	_, _, _, ret = other.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+
+	// refilled at 2 reads per second
+	clock.Advance(500 * time.Millisecond)
+	_, _, _, ret = db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, ret = db.get([]byte("foo"))
+	require.Equal(t, goErrorUser, ret)
+
+	// refilling is capped at the burst size
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		_, _, _, ret = db.get([]byte("foo"))
+		require.Equal(t, goErrorNone, ret)
+	}
+	_, _, _, ret = db.get([]byte("foo"))
+	require.Equal(t, goErrorUser, ret)
+}
+
+func TestReadRateLimiterEvictsIdleBuckets(t *testing.T) {
+	clock := useFakeClock(t)
+	// a bucket is full again after 2 seconds
+	limiter := NewReadRateLimiter(2, 4)
+
+	for i := 0; i < 100; i++ {
+		require.True(t, limiter.allow([]byte(fmt.Sprintf("checksum%d", i))))
+	}
+	require.Len(t, limiter.buckets, 100)
+
+	// buckets in use are kept
+	clock.Advance(time.Second)
+	require.True(t, limiter.allow([]byte("checksum0")))
+	clock.Advance(time.Second)
+	require.True(t, limiter.allow([]byte("active")))
+	require.Len(t, limiter.buckets, 2)
+
+	// an evicted bucket behaves like the full bucket it replaced
+	for i := 0; i < 4; i++ {
+		require.True(t, limiter.allow([]byte("checksum1")))
+	}
+	require.False(t, limiter.allow([]byte("checksum1")))
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// Order is the iteration order of a scan as passed from Rust to cScan
+type Order int32
+
+const (
+	Ascending  Order = 1
+	Descending Order = 2
+)
+
+// ValidateScanRange checks whether a scan over [start, end) in the given order is valid.
+// This contains the range-validity rules enforced by cScan, so that hosts and tooling
+// can reject invalid ranges before a contract is executed.
+//
+// A nil start or end is an open bound. If both bounds are set, start must not be greater than end
+// in both orders. Equal bounds are a valid, empty range.
+func ValidateScanRange(start, end []byte, order Order) error {
+	if order != Ascending && order != Descending {
+		return fmt.Errorf("Invalid iteration order: %d", order)
+	}
+	if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+		return fmt.Errorf("Invalid scan range: start (%X) must not be greater than end (%X)", start, end)
+	}
+	return nil
+}
+
+// isEmptyScanRange returns true if the valid scan range [start, end) cannot contain any key.
+// Such ranges are not forwarded to the store, since the KVStore docs leave iterators with
+// start == end undefined.
+func isEmptyScanRange(start, end []byte) bool {
+	return start != nil && end != nil && bytes.Equal(start, end)
+}
+
+// prefixEnd returns the smallest key greater than all keys starting with prefix,
+// or nil if there is none (prefix is empty or consists of 0xFF bytes only).
+func prefixEnd(prefix []byte) []byte {
+	end := cloneBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// checkScanPrefix returns an error if the scan range [start, end) contains keys not starting with prefix.
+// This requires start to be at least prefix and end to be at most the end of the prefix range, so open bounds
+// are only allowed if the prefix range is open on that side as well.
+func checkScanPrefix(start, end, prefix []byte) error {
+	limit := prefixEnd(prefix)
+	// a nil start compares like an empty key
+	startOk := bytes.Compare(start, prefix) >= 0
+	endOk := limit == nil || (end != nil && bytes.Compare(end, limit) <= 0)
+	if !startOk || !endOk {
+		return fmt.Errorf("Invalid scan range: [%X, %X) is not within the required prefix %X", start, end, prefix)
+	}
+	return nil
+}
+
+// FullScan returns an iterator over the entire domain of the store in the given order.
+// The iterator must be closed by the caller. Panics if the order is invalid.
+func FullScan(store KVStore, order Order) dbm.Iterator {
+	switch order {
+	case Ascending:
+		return store.Iterator(nil, nil)
+	case Descending:
+		return store.ReverseIterator(nil, nil)
+	default:
+		panic(fmt.Sprintf("Invalid iteration order: %d", order))
+	}
+}
+
+// MaxAccumulatedResults is the maximum number of entries helper utilities such as ForEach visit
+// before aborting with an error. This protects tooling from unbounded memory use when draining a huge range.
+// It does not affect scans issued by contracts. Set to 0 for no limit (the default).
+var MaxAccumulatedResults uint64 = 0
+
+// ForEach calls fn for every key/value pair in the store in the given order.
+// Iteration stops at the first error returned by fn, which is then returned.
+// The slices passed to fn must not be retained or modified.
+// An error is returned when the store contains more than MaxAccumulatedResults entries.
+func ForEach(store KVStore, order Order, fn func(key, value []byte) error) error {
+	if err := ValidateScanRange(nil, nil, order); err != nil {
+		return err
+	}
+	iter := FullScan(store, order)
+	defer iter.Close()
+	var count uint64
+	for ; iter.Valid(); iter.Next() {
+		if MaxAccumulatedResults > 0 && count >= MaxAccumulatedResults {
+			return fmt.Errorf("Iteration aborted: more than %d results", MaxAccumulatedResults)
+		}
+		count++
+		if err := fn(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateScanRange(t *testing.T) {
+	cases := map[string]struct {
+		start []byte
+		end   []byte
+		valid bool
+	}{
+		"valid range":      {[]byte("a"), []byte("b"), true},
+		"inverted range":   {[]byte("b"), []byte("a"), false},
+		"equal bounds":     {[]byte("a"), []byte("a"), true},
+		"nil start":        {nil, []byte("a"), true},
+		"nil end":          {[]byte("a"), nil, true},
+		"nil bounds":       {nil, nil, true},
+		"prefix is lower":  {[]byte("a"), []byte("aa"), true},
+		"prefix is higher": {[]byte("aa"), []byte("a"), false},
+	}
+
+	for _, order := range []Order{Ascending, Descending} {
+		for name, tc := range cases {
+			err := ValidateScanRange(tc.start, tc.end, order)
+			if tc.valid {
+				require.NoError(t, err, "%s (order %d)", name, order)
+			} else {
+				require.ErrorContains(t, err, "Invalid scan range", "%s (order %d)", name, order)
+			}
+		}
+	}
+}
+
+func TestValidateScanRangeOrder(t *testing.T) {
+	for _, order := range []Order{0, 3, -1} {
+		err := ValidateScanRange(nil, nil, order)
+		require.ErrorContains(t, err, "Invalid iteration order")
+	}
+}
+
+func TestFullScan(t *testing.T) {
+	store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	for _, key := range []string{"b", "a", "c"} {
+		store.Set([]byte(key), []byte("value-"+key))
+	}
+
+	collect := func(order Order) []string {
+		var keys []string
+		iter := FullScan(store, order)
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		require.NoError(t, iter.Close())
+		return keys
+	}
+	require.Equal(t, []string{"a", "b", "c"}, collect(Ascending))
+	require.Equal(t, []string{"c", "b", "a"}, collect(Descending))
+
+	require.Panics(t, func() { FullScan(store, 0) })
+}
+
+func TestForEach(t *testing.T) {
+	store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	for _, key := range []string{"b", "a", "c"} {
+		store.Set([]byte(key), []byte("value-"+key))
+	}
+
+	var pairs []string
+	err := ForEach(store, Ascending, func(key, value []byte) error {
+		pairs = append(pairs, string(key)+"="+string(value))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a=value-a", "b=value-b", "c=value-c"}, pairs)
+
+	pairs = nil
+	err = ForEach(store, Descending, func(key, value []byte) error {
+		pairs = append(pairs, string(key)+"="+string(value))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"c=value-c", "b=value-b", "a=value-a"}, pairs)
+
+	// early termination
+	stop := errors.New("stop")
+	var keys []string
+	err = ForEach(store, Ascending, func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		if string(key) == "b" {
+			return stop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, []string{"a", "b"}, keys)
+
+	// invalid order
+	err = ForEach(store, 3, func(_, _ []byte) error { return nil })
+	require.ErrorContains(t, err, "Invalid iteration order")
+}
+
+func TestForEachMaxAccumulatedResults(t *testing.T) {
+	store := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	for i := 0; i < 10; i++ {
+		store.Set([]byte{byte(i)}, []byte("value"))
+	}
+
+	MaxAccumulatedResults = 4
+	defer func() { MaxAccumulatedResults = 0 }()
+
+	var visited int
+	err := ForEach(store, Ascending, func(_, _ []byte) error {
+		visited++
+		return nil
+	})
+	require.EqualError(t, err, "Iteration aborted: more than 4 results")
+	require.Equal(t, 4, visited)
+
+	// a range within the cap is drained completely
+	MaxAccumulatedResults = 10
+	visited = 0
+	err = ForEach(store, Descending, func(_, _ []byte) error {
+		visited++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10, visited)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte("nt"), prefixEnd([]byte("ns")))
+	require.Equal(t, []byte{0x01, 0x03}, prefixEnd([]byte{0x01, 0x02, 0xFF}))
+	require.Nil(t, prefixEnd([]byte{0xFF, 0xFF}))
+	require.Nil(t, prefixEnd(nil))
+}
+
+func TestRequireScanPrefix(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+	for _, key := range []string{"nr", "ns/a", "ns/b", "nt"} {
+		store.Set([]byte(key), []byte("value"))
+	}
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	// not required by default
+	_, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+
+	RequireScanPrefix(callID, []byte("ns/"))
+	inPrefix := map[string][2][]byte{
+		"full prefix range": {[]byte("ns/"), []byte("ns0")},
+		"sub range":         {[]byte("ns/a"), []byte("ns/b")},
+	}
+	for name, r := range inPrefix {
+		for _, order := range []Order{Ascending, Descending} {
+			_, _, errMsg, ret := db.scan(r[0], r[1], order)
+			require.Equal(t, goErrorNone, ret, name)
+			require.Empty(t, errMsg, name)
+		}
+	}
+
+	crossPrefix := map[string][2][]byte{
+		"open start":       {nil, []byte("ns0")},
+		"open end":         {[]byte("ns/"), nil},
+		"start before":     {[]byte("nr"), []byte("ns0")},
+		"end after":        {[]byte("ns/a"), []byte("nt")},
+		"different prefix": {[]byte("nt"), []byte("nu")},
+	}
+	for name, r := range crossPrefix {
+		_, _, errMsg, ret := db.scan(r[0], r[1], Ascending)
+		require.Equal(t, goErrorUser, ret, name)
+		require.Contains(t, errMsg, "is not within the required prefix 6E732F", name)
+	}
+	_, _, errMsg, ret := db.scan([]byte("nr"), []byte("ns/b"), Descending)
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "Invalid scan range: [6E72, 6E732F62) is not within the required prefix 6E732F", errMsg)
+
+	// other calls are not restricted
+	otherCallID := startCall()
+	defer endCall(otherCallID)
+	_, _, _, ret = newTestDB(store, gasMeter, otherCallID).scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+
+	// removing the restriction
+	RequireScanPrefix(callID, nil)
+	_, _, _, ret = db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// sortedKVStore is an in-memory KVStore backed by a sorted slice.
+// It iterates in correct ascending and descending byte order for arbitrary key sets,
+// which makes it suitable as a drop-in store for callback tests. It does not consume gas.
+//
+// Keys and values are copied on write. Iterators work on a snapshot taken at creation,
+// so the store can be modified while iterating.
+type sortedKVStore struct {
+	items []kvPair
+}
+
+var _ KVStore = (*sortedKVStore)(nil)
+
+func newSortedKVStore() *sortedKVStore {
+	return &sortedKVStore{}
+}
+
+// search returns the index of the first item with a key not less than key
+func (s *sortedKVStore) search(key []byte) int {
+	return sort.Search(len(s.items), func(i int) bool {
+		return bytes.Compare(s.items[i].key, key) >= 0
+	})
+}
+
+func (s *sortedKVStore) Get(key []byte) []byte {
+	i := s.search(key)
+	if i < len(s.items) && bytes.Equal(s.items[i].key, key) {
+		return s.items[i].value
+	}
+	return nil
+}
+
+func (s *sortedKVStore) Set(key, value []byte) {
+	if value == nil {
+		panic("value is nil")
+	}
+	item := kvPair{key: cloneBytes(key), value: cloneBytes(value)}
+	i := s.search(key)
+	if i < len(s.items) && bytes.Equal(s.items[i].key, key) {
+		s.items[i] = item
+		return
+	}
+	s.items = append(s.items, kvPair{})
+	copy(s.items[i+1:], s.items[i:])
+	s.items[i] = item
+}
+
+func (s *sortedKVStore) Delete(key []byte) {
+	i := s.search(key)
+	if i < len(s.items) && bytes.Equal(s.items[i].key, key) {
+		s.items = append(s.items[:i], s.items[i+1:]...)
+	}
+}
+
+func (s *sortedKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.newIterator(start, end, false)
+}
+
+func (s *sortedKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.newIterator(start, end, true)
+}
+
+// newIterator copies all items in [start, end) in ascending order and reverses them if needed
+func (s *sortedKVStore) newIterator(start, end []byte, reverse bool) *sliceIterator {
+	from, to := 0, len(s.items)
+	if start != nil {
+		from = s.search(start)
+	}
+	if end != nil {
+		to = s.search(end)
+	}
+	var items []kvPair
+	if from < to {
+		items = append(items, s.items[from:to]...)
+	}
+
+	if reverse {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	return &sliceIterator{
+		start: start,
+		end:   end,
+		items: items,
+	}
+}
+
+func TestSortedKVStoreRandomKeys(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	store := newSortedKVStore()
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		key := make([]byte, 1+rng.Intn(8))
+		rng.Read(key)
+		value := []byte{byte(i)}
+		store.Set(key, value)
+		expected[string(key)] = value
+	}
+	sortedKeys := make([]string, 0, len(expected))
+	for key := range expected {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	var ascending []string
+	iter := store.Iterator(nil, nil)
+	for ; iter.Valid(); iter.Next() {
+		ascending = append(ascending, string(iter.Key()))
+		require.Equal(t, expected[string(iter.Key())], iter.Value())
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, sortedKeys, ascending)
+
+	var descending []string
+	iter = store.ReverseIterator(nil, nil)
+	for ; iter.Valid(); iter.Next() {
+		descending = append(descending, string(iter.Key()))
+	}
+	require.NoError(t, iter.Close())
+	require.Len(t, descending, len(sortedKeys))
+	for i := range descending {
+		require.Equal(t, sortedKeys[len(sortedKeys)-1-i], descending[i])
+	}
+
+	// bounded ranges
+	start, end := []byte(sortedKeys[10]), []byte(sortedKeys[20])
+	iter = store.Iterator(start, end)
+	var bounded []string
+	for ; iter.Valid(); iter.Next() {
+		require.True(t, bytes.Compare(iter.Key(), start) >= 0)
+		require.True(t, bytes.Compare(iter.Key(), end) < 0)
+		bounded = append(bounded, string(iter.Key()))
+	}
+	require.Equal(t, sortedKeys[10:20], bounded)
+
+	iter = store.ReverseIterator(start, end)
+	bounded = nil
+	for ; iter.Valid(); iter.Next() {
+		bounded = append(bounded, string(iter.Key()))
+	}
+	require.Len(t, bounded, 10)
+	require.Equal(t, sortedKeys[19], bounded[0])
+	require.Equal(t, sortedKeys[10], bounded[9])
+}
+
+func TestSortedKVStoreGetSetDelete(t *testing.T) {
+	store := newSortedKVStore()
+	require.Nil(t, store.Get([]byte("foo")))
+
+	key := []byte("foo")
+	value := []byte("bar")
+	store.Set(key, value)
+	// input is copied
+	key[0] = 'x'
+	value[0] = 'x'
+	require.Equal(t, []byte("bar"), store.Get([]byte("foo")))
+
+	store.Set([]byte("foo"), []byte("baz"))
+	require.Equal(t, []byte("baz"), store.Get([]byte("foo")))
+
+	store.Delete([]byte("foo"))
+	require.Nil(t, store.Get([]byte("foo")))
+}
+
+func TestSortedKVStoreCallbacks(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := newSortedKVStore()
+	for _, key := range []string{"b", "ab", "a", "c", "ba"} {
+		store.Set([]byte(key), []byte("value"))
+	}
+
+	callID := startCall()
+	defer endCall(callID)
+	db := newTestDB(store, gasMeter, callID)
+
+	for order, expected := range map[Order][]string{
+		Ascending:  {"a", "ab", "b", "ba", "c"},
+		Descending: {"c", "ba", "b", "ab", "a"},
+	} {
+		index, _, _, ret := db.scan(nil, nil, order)
+		require.Equal(t, goErrorNone, ret)
+		var keys []string
+		for {
+			key, _, _, _, ret := db.next(index)
+			require.Equal(t, goErrorNone, ret)
+			if key == nil {
+				break
+			}
+			keys = append(keys, string(key))
+		}
+		require.Equal(t, expected, keys)
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import "sync"
+
+// maxValueWrittenByChecksum contains the size of the largest value ever written by a contract, indexed by checksum.
+var maxValueWrittenByChecksum = make(map[string]int)
+var maxValueWrittenByChecksumMutex sync.Mutex
+
+// recordValueWritten updates the maximum value size trackers of the given call and its contract checksum.
+// Called by cSet after a successful write.
+func recordValueWritten(callID uint64, size int) {
+	var checksum []byte
+	withCallState(callID, func(state *callState) {
+		if size > state.maxValueWritten {
+			state.maxValueWritten = size
+		}
+		checksum = state.checksum
+	})
+	if checksum == nil {
+		return
+	}
+
+	maxValueWrittenByChecksumMutex.Lock()
+	defer maxValueWrittenByChecksumMutex.Unlock()
+	if size > maxValueWrittenByChecksum[string(checksum)] {
+		maxValueWrittenByChecksum[string(checksum)] = size
+	}
+}
+
+// MaxValueWritten returns the size in bytes of the largest value written by the given contract call.
+// The data is only available while the call is running. Returns 0 for unknown calls.
+func MaxValueWritten(callID uint64) int {
+	var max int
+	withCallState(callID, func(state *callState) {
+		max = state.maxValueWritten
+	})
+	return max
+}
+
+// MaxValueWrittenByChecksum returns the size in bytes of the largest value written
+// by any call of the contract with the given checksum since the process started or ResetMetrics was called.
+func MaxValueWrittenByChecksum(checksum []byte) int {
+	maxValueWrittenByChecksumMutex.Lock()
+	defer maxValueWrittenByChecksumMutex.Unlock()
+	return maxValueWrittenByChecksum[string(checksum)]
+}
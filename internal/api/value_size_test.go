@@ -0,0 +1,47 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxValueWritten(t *testing.T) {
+	checksum := []byte("max value checksum")
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := NewLookup(gasMeter)
+
+	callID := startCall()
+	setCallChecksum(callID, checksum)
+	db := newTestDB(store, gasMeter, callID)
+	require.Equal(t, 0, MaxValueWritten(callID))
+
+	for _, size := range []int{1, 10, 5, 100, 50} {
+		_, _, ret := db.set([]byte("key"), bytes.Repeat([]byte{0xaa}, size))
+		require.Equal(t, goErrorNone, ret)
+	}
+	require.Equal(t, 100, MaxValueWritten(callID))
+	require.Equal(t, 100, MaxValueWrittenByChecksum(checksum))
+
+	// a second call of the same contract has its own maximum
+	otherCallID := startCall()
+	setCallChecksum(otherCallID, checksum)
+	other := newTestDB(store, gasMeter, otherCallID)
+	_, _, ret := other.set([]byte("key"), bytes.Repeat([]byte{0xbb}, 20))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, 20, MaxValueWritten(otherCallID))
+	require.Equal(t, 100, MaxValueWritten(callID))
+	require.Equal(t, 100, MaxValueWrittenByChecksum(checksum))
+
+	_, _, ret = other.set([]byte("key"), bytes.Repeat([]byte{0xbb}, 200))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, 200, MaxValueWrittenByChecksum(checksum))
+
+	// per-call data is dropped when the call ends, per-checksum data is kept
+	endCall(callID)
+	endCall(otherCallID)
+	require.Equal(t, 0, MaxValueWritten(callID))
+	require.Equal(t, 200, MaxValueWrittenByChecksum(checksum))
+	require.Equal(t, 0, MaxValueWrittenByChecksum([]byte("unknown")))
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// valueChecksumLen is the length of the checksum prepended to every value by VerifyingKVStore
+const valueChecksumLen = 4
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// VerifyingKVStore wraps a KVStore and stores a checksum alongside every value, which is verified
+// whenever the value is read. This allows detecting silent state corruption.
+//
+// The checksum (CRC-32C, 4 bytes) is prepended to the value stored under the same key. This way the
+// wrapper does not need any extra keys that could collide with contract keys and a value and its checksum
+// are always written atomically. A mismatch on read panics with a KVStoreError, which is returned to the
+// contract as an error by the DB callbacks.
+type VerifyingKVStore struct {
+	parent KVStore
+}
+
+var _ KVStore = (*VerifyingKVStore)(nil)
+
+func NewVerifyingKVStore(parent KVStore) *VerifyingKVStore {
+	return &VerifyingKVStore{
+		parent: parent,
+	}
+}
+
+// verifyValue strips and checks the checksum of a stored value
+func verifyValue(key, stored []byte) []byte {
+	if stored == nil {
+		return nil
+	}
+	if len(stored) < valueChecksumLen {
+		panic(KVStoreError{Msg: fmt.Sprintf("value checksum mismatch for key %X", key)})
+	}
+	checksum := binary.BigEndian.Uint32(stored[:valueChecksumLen])
+	value := stored[valueChecksumLen:]
+	if crc32.Checksum(value, castagnoliTable) != checksum {
+		panic(KVStoreError{Msg: fmt.Sprintf("value checksum mismatch for key %X", key)})
+	}
+	return value
+}
+
+func (s *VerifyingKVStore) Get(key []byte) []byte {
+	return verifyValue(key, s.parent.Get(key))
+}
+
+func (s *VerifyingKVStore) Set(key, value []byte) {
+	stored := make([]byte, valueChecksumLen+len(value))
+	binary.BigEndian.PutUint32(stored, crc32.Checksum(value, castagnoliTable))
+	copy(stored[valueChecksumLen:], value)
+	s.parent.Set(key, stored)
+}
+
+func (s *VerifyingKVStore) Delete(key []byte) {
+	s.parent.Delete(key)
+}
+
+func (s *VerifyingKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return &verifyingIterator{s.parent.Iterator(start, end)}
+}
+
+func (s *VerifyingKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return &verifyingIterator{s.parent.ReverseIterator(start, end)}
+}
+
+// verifyingIterator verifies the checksums of the values of the wrapped iterator
+type verifyingIterator struct {
+	dbm.Iterator
+}
+
+func (it *verifyingIterator) Value() []byte {
+	return verifyValue(it.Iterator.Key(), it.Iterator.Value())
+}
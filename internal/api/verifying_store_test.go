@@ -0,0 +1,72 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyingKVStore(t *testing.T) {
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	store := NewVerifyingKVStore(parent)
+
+	store.Set([]byte("foo"), []byte("bar"))
+	store.Set([]byte("empty"), []byte{})
+	require.Equal(t, []byte("bar"), store.Get([]byte("foo")))
+	require.Equal(t, []byte{}, store.Get([]byte("empty")))
+	require.Nil(t, store.Get([]byte("missing")))
+
+	// checksum is stored with the value under the same key
+	require.Len(t, parent.Get([]byte("foo")), valueChecksumLen+3)
+
+	iter := store.Iterator(nil, nil)
+	var values [][]byte
+	for ; iter.Valid(); iter.Next() {
+		values = append(values, iter.Value())
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, [][]byte{{}, []byte("bar")}, values)
+
+	store.Delete([]byte("foo"))
+	require.Nil(t, store.Get([]byte("foo")))
+}
+
+func TestVerifyingKVStoreDetectsCorruption(t *testing.T) {
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	store := NewVerifyingKVStore(parent)
+	db := newTestDB(store, gasMeter, callID)
+
+	_, _, ret := db.set([]byte("foo"), []byte("bar"))
+	require.Equal(t, goErrorNone, ret)
+	value, _, _, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorNone, ret)
+	require.Equal(t, []byte("bar"), value)
+
+	// corrupt the stored value
+	stored := parent.Get([]byte("foo"))
+	corrupted := append([]byte{}, stored...)
+	corrupted[len(corrupted)-1] ^= 0x01
+	parent.Set([]byte("foo"), corrupted)
+
+	value, _, errMsg, ret := db.get([]byte("foo"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "value checksum mismatch for key 666F6F", errMsg)
+	require.Nil(t, value)
+
+	// truncated value
+	parent.Set([]byte("foo"), []byte{0x01})
+	_, _, errMsg, ret = db.get([]byte("foo"))
+	require.Equal(t, goErrorUser, ret)
+	require.Contains(t, errMsg, "value checksum mismatch")
+
+	// iteration
+	index, _, _, ret := db.scan(nil, nil, Ascending)
+	require.Equal(t, goErrorNone, ret)
+	_, _, _, errMsg, ret = db.next(index)
+	require.Equal(t, goErrorUser, ret)
+	require.Contains(t, errMsg, "value checksum mismatch")
+}
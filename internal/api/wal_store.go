@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// Operation tags of the records written by WALKVStore
+const (
+	walSet    byte = 1
+	walDelete byte = 2
+)
+
+// WALKVStore wraps a KVStore and appends every Set and Delete to a write-ahead log before applying it
+// to the parent store, such that the mutations can be replayed with ReplayWAL after a crash.
+//
+// Every record starts with an operation tag (1 for Set, 2 for Delete) followed by the key and, for Set,
+// the value. Keys and values are prefixed with their length as unsigned varint. Each record is passed to
+// the writer in a single Write call. If writing fails, the mutation is not applied and the store panics
+// with a KVStoreError, which is returned to the contract as an error by the DB callbacks.
+//
+// Writing the log is not charged to the gas meter. It is an operational feature of the host, and gas must not
+// depend on whether it is enabled.
+type WALKVStore struct {
+	parent KVStore
+	w      io.Writer
+}
+
+var _ KVStore = (*WALKVStore)(nil)
+
+func NewWALKVStore(parent KVStore, w io.Writer) *WALKVStore {
+	return &WALKVStore{
+		parent: parent,
+		w:      w,
+	}
+}
+
+// appendRecord writes one record to the log
+func (s *WALKVStore) appendRecord(op byte, key, value []byte) {
+	record := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(key)+len(value))
+	record = append(record, op)
+	record = binary.AppendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	if op == walSet {
+		record = binary.AppendUvarint(record, uint64(len(value)))
+		record = append(record, value...)
+	}
+	if _, err := s.w.Write(record); err != nil {
+		panic(KVStoreError{Msg: fmt.Sprintf("write-ahead log: %v", err)})
+	}
+}
+
+func (s *WALKVStore) Get(key []byte) []byte {
+	return s.parent.Get(key)
+}
+
+func (s *WALKVStore) Set(key, value []byte) {
+	s.appendRecord(walSet, key, value)
+	s.parent.Set(key, value)
+}
+
+func (s *WALKVStore) Delete(key []byte) {
+	s.appendRecord(walDelete, key, nil)
+	s.parent.Delete(key)
+}
+
+func (s *WALKVStore) Iterator(start, end []byte) dbm.Iterator {
+	return s.parent.Iterator(start, end)
+}
+
+func (s *WALKVStore) ReverseIterator(start, end []byte) dbm.Iterator {
+	return s.parent.ReverseIterator(start, end)
+}
+
+// ReplayWAL applies the mutations of a log written by WALKVStore to store in order and returns the number
+// of records applied. A record cut off at the end of the log, e.g. by a crash while writing it, is not applied
+// and reported as an error wrapping io.ErrUnexpectedEOF.
+func ReplayWAL(r io.Reader, store KVStore) (int, error) {
+	br := bufio.NewReader(r)
+	applied := 0
+	for {
+		op, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return applied, nil
+		}
+		if err != nil {
+			return applied, err
+		}
+		if op != walSet && op != walDelete {
+			return applied, fmt.Errorf("Invalid write-ahead log record %d: unknown operation %d", applied, op)
+		}
+		key, err := readWALBytes(br)
+		if err != nil {
+			return applied, fmt.Errorf("Invalid write-ahead log record %d: %w", applied, err)
+		}
+		if op == walDelete {
+			store.Delete(key)
+		} else {
+			value, err := readWALBytes(br)
+			if err != nil {
+				return applied, fmt.Errorf("Invalid write-ahead log record %d: %w", applied, err)
+			}
+			store.Set(key, value)
+		}
+		applied++
+	}
+}
+
+// readWALBytes reads a length-prefixed byte slice. A log ending within the slice is an io.ErrUnexpectedEOF.
+func readWALBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if errors.Is(err, io.EOF) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxInt64 {
+		return nil, fmt.Errorf("length %d out of range", n)
+	}
+	// copy instead of allocating n bytes upfront, such that a corrupted length cannot exhaust memory
+	var out bytes.Buffer
+	if _, err := io.CopyN(&out, br, int64(n)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALKVStore(t *testing.T) {
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	var log bytes.Buffer
+	store := NewWALKVStore(parent, &log)
+	db := newTestDB(store, gasMeter, callID)
+
+	_, _, ret := db.set([]byte("foo"), []byte("bar"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.set([]byte("empty"), []byte{})
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.set([]byte("foo"), []byte("baz"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.set([]byte("gone"), []byte("soon"))
+	require.Equal(t, goErrorNone, ret)
+	_, _, ret = db.delete([]byte("gone"))
+	require.Equal(t, goErrorNone, ret)
+
+	// the log is written in addition to the parent store
+	require.Equal(t, []byte("baz"), parent.Get([]byte("foo")))
+	require.Equal(t, []byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'}, log.Bytes()[:9])
+
+	// replaying reconstructs the state
+	replayed := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	applied, err := ReplayWAL(bytes.NewReader(log.Bytes()), replayed)
+	require.NoError(t, err)
+	require.Equal(t, 5, applied)
+	require.Equal(t, []byte("baz"), replayed.Get([]byte("foo")))
+	require.Equal(t, []byte{}, replayed.Get([]byte("empty")))
+	require.Nil(t, replayed.Get([]byte("gone")))
+	var keys []string
+	require.NoError(t, ForEach(replayed, Ascending, func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	require.Equal(t, []string{"empty", "foo"}, keys)
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWALKVStoreWriteError(t *testing.T) {
+	callID := startCall()
+	defer endCall(callID)
+	gasMeter := NewMockGasMeter(TESTING_GAS_LIMIT)
+	parent := NewLookup(gasMeter)
+	db := newTestDB(NewWALKVStore(parent, failingWriter{}), gasMeter, callID)
+
+	// the mutation is not applied if it cannot be logged
+	_, errMsg, ret := db.set([]byte("foo"), []byte("bar"))
+	require.Equal(t, goErrorUser, ret)
+	require.Equal(t, "write-ahead log: disk full", errMsg)
+	require.Nil(t, parent.Get([]byte("foo")))
+}
+
+func TestReplayWALTruncated(t *testing.T) {
+	var log bytes.Buffer
+	store := NewWALKVStore(NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT)), &log)
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+
+	// a crash while writing the last record
+	truncated := log.Bytes()[:log.Len()-1]
+	replayed := NewLookup(NewMockGasMeter(TESTING_GAS_LIMIT))
+	applied, err := ReplayWAL(bytes.NewReader(truncated), replayed)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, 1, applied)
+	require.Equal(t, []byte("1"), replayed.Get([]byte("a")))
+	require.Nil(t, replayed.Get([]byte("b")))
+
+	// unknown operations
+	_, err = ReplayWAL(bytes.NewReader([]byte{7}), replayed)
+	require.EqualError(t, err, "Invalid write-ahead log record 0: unknown operation 7")
+}
@@ -1,8 +1,17 @@
+// Package cosmwasm executes CosmWasm contracts via libwasmvm on behalf of a host chain.
+//
+// Contract executions must produce the same result on every node. Options depending on wall time or
+// other node-local state break this and must never be enabled on validators or other nodes executing
+// transactions. Currently this applies to SetReadRateLimiter, which is meant for query nodes only.
 package cosmwasm
 
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"time"
+
+	dbm "github.com/tendermint/tm-db"
 
 	"github.com/Finschia/wasmvm/internal/api"
 	"github.com/Finschia/wasmvm/types"
@@ -26,6 +35,390 @@ type Querier = types.Querier
 // GasMeter is a read-only version of the sdk gas meter
 type GasMeter = api.GasMeter
 
+// GasConsumer is the part of the sdk gas meter used by store wrappers to charge gas
+type GasConsumer = api.GasConsumer
+
+// SizedKVStore is an optional extension of KVStore for stores that can cheaply report their approximate size
+type SizedKVStore = api.SizedKVStore
+
+// ApproximateSize returns the approximate number of keys and bytes of the store if it implements SizedKVStore.
+// ok is false for stores that cannot report their size.
+func ApproximateSize(store KVStore) (keys uint64, bytes uint64, ok bool) {
+	return api.ApproximateSize(store)
+}
+
+// DeltaKVStore is a KVStore wrapper recording the write set of a contract call
+type DeltaKVStore = api.DeltaKVStore
+
+// KVDelta is a single change recorded by a DeltaKVStore
+type KVDelta = api.KVDelta
+
+// NewDeltaKVStore wraps the given store such that all writes and deletes are recorded
+// along with the value they replaced. See DeltaKVStore.Deltas.
+func NewDeltaKVStore(parent KVStore) *DeltaKVStore {
+	return api.NewDeltaKVStore(parent)
+}
+
+// CompressingKVStore is a KVStore wrapper storing values compressed
+type CompressingKVStore = api.CompressingKVStore
+
+// Codec compresses and decompresses values for a CompressingKVStore
+type Codec = api.Codec
+
+// GzipCodec is a Codec using gzip. Its output may change between Go releases, so it must not be used for consensus state.
+type GzipCodec = api.GzipCodec
+
+// NewCompressingKVStore wraps the given store such that values are compressed using codec.
+// Compression and decompression are charged to meter with gasPerByte per logical value byte.
+func NewCompressingKVStore(parent KVStore, codec Codec, meter GasConsumer, gasPerByte uint64) *CompressingKVStore {
+	return api.NewCompressingKVStore(parent, codec, meter, gasPerByte)
+}
+
+// VerifyingKVStore is a KVStore wrapper storing a checksum with every value and verifying it on read
+type VerifyingKVStore = api.VerifyingKVStore
+
+// NewVerifyingKVStore wraps the given store such that corrupted values are detected on read
+func NewVerifyingKVStore(parent KVStore) *VerifyingKVStore {
+	return api.NewVerifyingKVStore(parent)
+}
+
+// CachingQuerier is a Querier decorator that memoizes successful responses within a contract call
+type CachingQuerier = api.CachingQuerier
+
+// NewCachingQuerier wraps a querier such that repeated identical requests within one contract call
+// are answered from a cache. Gas is only charged for the first request. Use one instance per call.
+func NewCachingQuerier(inner Querier) *CachingQuerier {
+	return api.NewCachingQuerier(inner)
+}
+
+// BudgetedKVStore is a KVStore wrapper limiting the total number of bytes written through it
+type BudgetedKVStore = api.BudgetedKVStore
+
+// NewBudgetedKVStore wraps a store such that at most maxWriteBytes bytes of keys and values can be written.
+// Further writes fail with an error returned to the contract. Create one instance per contract call.
+func NewBudgetedKVStore(parent KVStore, maxWriteBytes uint64) *BudgetedKVStore {
+	return api.NewBudgetedKVStore(parent, maxWriteBytes)
+}
+
+// AccessTimedKVStore is a KVStore wrapper recording the time of the last read of each key
+type AccessTimedKVStore = api.AccessTimedKVStore
+
+// NewAccessTimedKVStore wraps a store such that the last read times of up to maxKeys keys are recorded.
+func NewAccessTimedKVStore(parent KVStore, maxKeys int) *AccessTimedKVStore {
+	return api.NewAccessTimedKVStore(parent, maxKeys)
+}
+
+// FallbackKVStore is a KVStore layering a writable primary store over a read-only secondary store
+type FallbackKVStore = api.FallbackKVStore
+
+// NewFallbackKVStore creates a store that reads from secondary on a miss in primary and writes to primary only.
+func NewFallbackKVStore(primary, secondary KVStore) *FallbackKVStore {
+	return api.NewFallbackKVStore(primary, secondary)
+}
+
+// ImmutableKeysKVStore is a KVStore wrapper rejecting changes of protected keys after they were written
+type ImmutableKeysKVStore = api.ImmutableKeysKVStore
+
+// NewImmutableKeysKVStore protects the given keys and all keys starting with one of the given prefixes.
+func NewImmutableKeysKVStore(parent KVStore, keys [][]byte, prefixes [][]byte) *ImmutableKeysKVStore {
+	return api.NewImmutableKeysKVStore(parent, keys, prefixes)
+}
+
+// WALKVStore is a KVStore wrapper appending all writes and deletes to a write-ahead log
+type WALKVStore = api.WALKVStore
+
+// NewWALKVStore wraps a store such that every mutation is written to w before it is applied.
+func NewWALKVStore(parent KVStore, w io.Writer) *WALKVStore {
+	return api.NewWALKVStore(parent, w)
+}
+
+// ReplayWAL applies the mutations of a log written by a WALKVStore to store and returns the number of records applied.
+func ReplayWAL(r io.Reader, store KVStore) (int, error) {
+	return api.ReplayWAL(r, store)
+}
+
+// MaxKeysKVStore is a KVStore wrapper limiting the number of keys in a store
+type MaxKeysKVStore = api.MaxKeysKVStore
+
+// NewMaxKeysKVStore wraps a store currently containing keys keys such that new keys can be written up to maxKeys keys.
+func NewMaxKeysKVStore(parent KVStore, keys uint64, maxKeys uint64) *MaxKeysKVStore {
+	return api.NewMaxKeysKVStore(parent, keys, maxKeys)
+}
+
+// PinnedKeyCache holds values of hot keys of one contract store across calls
+type PinnedKeyCache = api.PinnedKeyCache
+
+// NewPinnedKeyCache creates an empty PinnedKeyCache. Use one cache per contract store.
+func NewPinnedKeyCache() *PinnedKeyCache {
+	return api.NewPinnedKeyCache()
+}
+
+// PinnedKeysKVStore is a KVStore wrapper serving reads of pinned keys from a PinnedKeyCache
+type PinnedKeysKVStore = api.PinnedKeysKVStore
+
+// NewPinnedKeysKVStore wraps the given store such that reads of keys pinned in cache do not access it.
+// Every read charges readGas to meter, whether it is served from the cache or not, so parent must not charge gas for reads.
+func NewPinnedKeysKVStore(parent KVStore, cache *PinnedKeyCache, meter GasConsumer, readGas uint64) *PinnedKeysKVStore {
+	return api.NewPinnedKeysKVStore(parent, cache, meter, readGas)
+}
+
+// KVStoreError can be used as a panic value by KVStore implementations to return an error to the contract
+type KVStoreError = api.KVStoreError
+
+// Order is the iteration order of a scan (Ascending or Descending)
+type Order = api.Order
+
+const (
+	Ascending  = api.Ascending
+	Descending = api.Descending
+)
+
+// ValidateScanRange checks a scan range using the same rules the VM applies to
+// scans issued by contracts. This allows rejecting invalid ranges before execution.
+func ValidateScanRange(start, end []byte, order Order) error {
+	return api.ValidateScanRange(start, end, order)
+}
+
+// FullScan returns an iterator over the entire domain of the store in the given order.
+// The iterator must be closed by the caller.
+func FullScan(store KVStore, order Order) dbm.Iterator {
+	return api.FullScan(store, order)
+}
+
+// ForEach calls fn for every key/value pair in the store in the given order,
+// stopping at the first error returned by fn. This is meant for export and backup tooling.
+func ForEach(store KVStore, order Order, fn func(key, value []byte) error) error {
+	return api.ForEach(store, order, fn)
+}
+
+// MergeIterators combines two ascending iterators into one that yields the keys of both in ascending order.
+// Duplicate keys are resolved by preferring the entry of a.
+func MergeIterators(a, b dbm.Iterator) dbm.Iterator {
+	return api.MergeIterators(a, b)
+}
+
+// TieBreak determines how MergeIteratorsWithTieBreak handles keys contained in both iterators
+type TieBreak = api.TieBreak
+
+const (
+	PreferLeft    = api.PreferLeft
+	PreferRight   = api.PreferRight
+	TieBreakError = api.TieBreakError
+)
+
+// MergeIteratorsWithTieBreak works like MergeIterators but handles duplicate keys according to tieBreak
+func MergeIteratorsWithTieBreak(a, b dbm.Iterator, tieBreak TieBreak) dbm.Iterator {
+	return api.MergeIteratorsWithTieBreak(a, b, tieBreak)
+}
+
+// MaxValueWrittenByChecksum returns the size in bytes of the largest value written
+// by any call of the contract with the given checksum since the process started.
+func MaxValueWrittenByChecksum(checksum Checksum) int {
+	return api.MaxValueWrittenByChecksum(checksum)
+}
+
+// TotalContractsStarted returns the number of contract calls started since the process started or ResetMetrics was called
+func TotalContractsStarted() uint64 {
+	return api.TotalContractsStarted()
+}
+
+// TotalCallbackGas returns the gas reported as used by the callbacks of all contract calls since the process started
+// or ResetMetrics was called
+func TotalCallbackGas() uint64 {
+	return api.TotalCallbackGas()
+}
+
+// TotalCallbackPanics returns the number of unexpected panics recovered in callbacks since the process started
+// or ResetMetrics was called
+func TotalCallbackPanics() uint64 {
+	return api.TotalCallbackPanics()
+}
+
+// TotalBytesTransferred returns the number of bytes passed from the VM to the callbacks and returned
+// by the callbacks to the VM since the process started or ResetMetrics was called
+func TotalBytesTransferred() (fromVM uint64, toVM uint64) {
+	return api.TotalBytesTransferred()
+}
+
+// ResetMetrics zeroes TotalContractsStarted, TotalCallbackGas, TotalCallbackPanics, TotalBytesTransferred
+// and MaxValueWrittenByChecksum. It is safe to call concurrently with contract calls, but the reset is only atomic per counter.
+func ResetMetrics() {
+	api.ResetMetrics()
+}
+
+// WriteMetrics writes the package-level metrics in the Prometheus text exposition format, such that
+// operators can serve them to a Prometheus scraper directly
+func WriteMetrics(w io.Writer) error {
+	return api.WriteMetrics(w)
+}
+
+// ActiveCallIDs returns the IDs of all contract calls currently running in ascending order
+func ActiveCallIDs() []uint64 {
+	return api.ActiveCallIDs()
+}
+
+// AbortCall aborts the contract call with the given ID, e.g. when the execution is aborted by an outer timeout.
+// Iteration and queries of the call fail from then on.
+func AbortCall(callID uint64) {
+	api.AbortCall(callID)
+}
+
+// SetOnContractStart registers fn to be called on the goroutine of every contract call before the contract is executed.
+// It receives the call ID used by the per-call accessors below (e.g. CallbackGasTotal), the name of the entry point,
+// the checksum of the contract and the store passed to the call. The store allows hosts to associate the call ID
+// with their own context of the call, e.g. by passing a store wrapper carrying that context. Pass nil to disable.
+func SetOnContractStart(fn func(callID uint64, entryPoint string, checksum Checksum, store KVStore)) {
+	if fn == nil {
+		api.OnContractStart = nil
+		return
+	}
+	api.OnContractStart = func(callID uint64, entryPoint string, checksum []byte, store KVStore) {
+		fn(callID, entryPoint, checksum, store)
+	}
+}
+
+// SetOnContractEnd registers fn to be called when a contract call ends, with the wall-clock duration of the call.
+// The per-call accessors still return the data of the call while fn runs. Pass nil to disable.
+func SetOnContractEnd(fn func(callID uint64, d time.Duration)) {
+	api.OnContractEnd = fn
+}
+
+// CallbackGasTotal returns the sum of the gas reported to the VM by all DB and querier callbacks of the given call so far
+func CallbackGasTotal(callID uint64) uint64 {
+	return api.CallbackGasTotal(callID)
+}
+
+// LastCallbackGas returns the name of the most recent callback of the given call (e.g. "cGet") and the gas it reported
+func LastCallbackGas(callID uint64) (callback string, gas uint64) {
+	return api.LastCallbackGas(callID)
+}
+
+// GasByEntryPoint returns the callback gas of the given call bucketed by entry point (see MarkEntryPoint)
+func GasByEntryPoint(callID uint64) map[string]uint64 {
+	return api.GasByEntryPoint(callID)
+}
+
+// MarkEntryPoint attributes all callback gas of the given call reported after this point to the entry point with the given name
+func MarkEntryPoint(callID uint64, name string) {
+	api.MarkEntryPoint(callID, name)
+}
+
+// CallEntryPoints returns the names of the entry points invoked under the given call ID in order
+func CallEntryPoints(callID uint64) []string {
+	return api.CallEntryPoints(callID)
+}
+
+// CallDuration returns the time elapsed since the given call was started
+func CallDuration(callID uint64) time.Duration {
+	return api.CallDuration(callID)
+}
+
+// MissedReads returns the number of reads of absent keys in the given call
+func MissedReads(callID uint64) uint64 {
+	return api.MissedReads(callID)
+}
+
+// VectorAllocations returns the number of vectors allocated for data returned to the VM by the callbacks of the given call
+func VectorAllocations(callID uint64) uint64 {
+	return api.VectorAllocations(callID)
+}
+
+// MaxValueWritten returns the size in bytes of the largest value written by the given call
+func MaxValueWritten(callID uint64) int {
+	return api.MaxValueWritten(callID)
+}
+
+// DistinctKeysWritten returns the number of distinct keys written in the given call.
+// The result is a lower bound if DistinctKeysWrittenIsApproximate returns true.
+func DistinctKeysWritten(callID uint64) int {
+	return api.DistinctKeysWritten(callID)
+}
+
+// DistinctKeysWrittenIsApproximate returns true if the given call wrote more distinct keys than can be tracked
+func DistinctKeysWrittenIsApproximate(callID uint64) bool {
+	return api.DistinctKeysWrittenIsApproximate(callID)
+}
+
+// IteratorOrder returns the order of the iterator with the given index in the given call.
+// The second return value is false if no such iterator exists.
+func IteratorOrder(callID uint64, index uint64) (Order, bool) {
+	return api.IteratorOrder(callID, index)
+}
+
+// RequireScanPrefix restricts the scans of the given call to keys starting with prefix.
+// A nil prefix removes the restriction (the default).
+func RequireScanPrefix(callID uint64, prefix []byte) {
+	api.RequireScanPrefix(callID, prefix)
+}
+
+// WithoutGas runs fn with gas reporting suspended for the given call, such that the callbacks report 0 used gas
+// to the contract. Gas consumed on the gas meter is not reverted.
+func WithoutGas(callID uint64, fn func()) {
+	api.WithoutGas(callID, fn)
+}
+
+// WithReadOnly runs fn with writes forbidden for the given call
+func WithReadOnly(callID uint64, fn func()) {
+	api.WithReadOnly(callID, fn)
+}
+
+// PeakLiveIterators returns the highest number of iterators open at the same time across all contract calls
+// since the process started or ResetMetrics was called
+func PeakLiveIterators() uint64 {
+	return api.PeakLiveIterators()
+}
+
+// SetWritePolicy makes writes and deletes of contracts fail with the error returned by policy, if any.
+// Pass nil to allow all writes (the default).
+func SetWritePolicy(policy func(key []byte) error) {
+	api.WritePolicy = policy
+}
+
+// SetMaxIterSteps limits the number of entries a contract can read from a single iterator. 0 disables the limit (the default).
+func SetMaxIterSteps(steps uint64) {
+	api.MaxIterSteps = steps
+}
+
+// SetMaxIteratorsPerChecksum limits the number of iterators per call for the contracts with the given checksums,
+// indexed by string(checksum). Pass nil to disable (the default).
+func SetMaxIteratorsPerChecksum(quotas map[string]int) {
+	api.MaxIteratorsPerChecksum = quotas
+}
+
+// SetMaxHumanAddressLen sets the maximum length of an address returned by GoAPI.HumanAddress. 0 disables the check.
+func SetMaxHumanAddressLen(length int) {
+	api.MaxHumanAddressLen = length
+}
+
+// SetResponseRewriter registers rewrite to post-process every serialized query result before it is returned
+// to the contract. Pass nil to disable (the default).
+func SetResponseRewriter(rewrite func(request, response []byte) ([]byte, error)) {
+	api.ResponseRewriter = rewrite
+}
+
+// SetPrintStackOnPanic controls whether unexpected panics in callbacks are logged with their value and a stack trace
+// (the default) or with the type of the panic value only
+func SetPrintStackOnPanic(enabled bool) {
+	api.PrintStackOnPanic = enabled
+}
+
+// ReadRateLimiter limits the rate of contract reads per checksum using token buckets
+type ReadRateLimiter = api.ReadRateLimiter
+
+// NewReadRateLimiter creates a limiter allowing readsPerSecond reads on average and bursts of up to burst reads
+func NewReadRateLimiter(readsPerSecond float64, burst int) *ReadRateLimiter {
+	return api.NewReadRateLimiter(readsPerSecond, burst)
+}
+
+// SetReadRateLimiter makes reads of contracts exceeding the rate of limiter fail with a "read rate exceeded"
+// error. Pass nil to disable rate limiting (the default).
+//
+// Rate limiting depends on wall time, so the same read can succeed on one node and fail on another.
+// Never enable it on validators or other nodes executing transactions, as this breaks consensus.
+func SetReadRateLimiter(limiter *ReadRateLimiter) {
+	api.ReadRateLimit = limiter
+}
+
 // VM is the main entry point to this library.
 // You should create an instance with its own subdirectory to manage state inside,
 // and call it for all cosmwasm code related actions.
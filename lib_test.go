@@ -278,6 +278,47 @@ func TestGetMetrics(t *testing.T) {
 	require.InEpsilon(t, 5602873, metrics.SizeMemoryCache, 0.18)
 }
 
+func TestOnContractStart(t *testing.T) {
+	vm := withVM(t)
+	checksum := createTestContract(t, vm, HACKATOM_TEST_CONTRACT)
+
+	var callIDs []uint64
+	var entryPoints []string
+	var stores []KVStore
+	SetOnContractStart(func(callID uint64, entryPoint string, c Checksum, s KVStore) {
+		callIDs = append(callIDs, callID)
+		stores = append(stores, s)
+		entryPoints = append(entryPoints, entryPoint)
+		require.Equal(t, checksum, c)
+		require.Contains(t, ActiveCallIDs(), callID)
+		require.Equal(t, []string{entryPoint}, CallEntryPoints(callID))
+		require.Equal(t, uint64(0), CallbackGasTotal(callID))
+	})
+	defer SetOnContractStart(nil)
+
+	deserCost := types.UFraction{1, 1}
+	gasMeter := api.NewMockGasMeter(TESTING_GAS_LIMIT)
+	store := api.NewLookup(gasMeter)
+	goapi := api.NewMockAPI()
+	querier := api.DefaultQuerier(api.MOCK_CONTRACT_ADDR, nil)
+	env := api.MockEnv()
+	info := api.MockInfo("creator", nil)
+	msg := []byte(`{"verifier": "fred", "beneficiary": "bob"}`)
+	_, _, err := vm.Instantiate(checksum, env, info, msg, store, *goapi, querier, gasMeter, TESTING_GAS_LIMIT, deserCost)
+	require.NoError(t, err)
+	_, _, err = vm.Query(checksum, env, []byte(`{"verifier":{}}`), store, *goapi, querier, gasMeter, TESTING_GAS_LIMIT, deserCost)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"instantiate", "query"}, entryPoints)
+	require.Len(t, callIDs, 2)
+	require.Less(t, callIDs[0], callIDs[1])
+	for _, s := range stores {
+		require.Same(t, store, s)
+	}
+	// the data is gone after the call ended
+	require.NotContains(t, ActiveCallIDs(), callIDs[0])
+}
+
 func TestLibwasmvmVersion(t *testing.T) {
 	version, err := LibwasmvmVersion()
 	require.NoError(t, err)
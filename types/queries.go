@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 )
 
 //-------- Queries --------
@@ -48,6 +49,9 @@ func RustQuery(querier Querier, binRequest []byte, gasLimit uint64) QuerierResul
 		}
 	}
 	bz, err := querier.Query(request, gasLimit)
+	if errors.Is(err, ErrNotFound) {
+		return notFoundResult(binRequest)
+	}
 	return ToQuerierResult(bz, err)
 }
 
@@ -57,7 +61,35 @@ type QuerierResult struct {
 	Err *SystemError   `json:"error,omitempty"`
 }
 
+// ErrNotFound can be returned by a Querier, directly or wrapped, to signal that the queried entity does not exist.
+// It is returned to the contract as a SystemError rather than a contract error or a null response, such that
+// contracts can tell a missing entity apart from both a failed query and an entity whose value is JSON null.
+//
+// The encoding is the same for all kinds of queries: an InvalidRequest whose error is "not found" (the message
+// of ErrNotFound) and whose request is the original request, or empty if unknown. Other system errors never use
+// this message, so contracts can match on it.
+var ErrNotFound = errors.New("not found")
+
+// notFoundResult is the QuerierResult returned for queries failing with ErrNotFound
+func notFoundResult(request []byte) QuerierResult {
+	if request == nil {
+		// Binary must not be null on the Rust side
+		request = []byte{}
+	}
+	return QuerierResult{
+		Err: &SystemError{
+			InvalidRequest: &InvalidRequest{
+				Err:     ErrNotFound.Error(),
+				Request: request,
+			},
+		},
+	}
+}
+
 func ToQuerierResult(response []byte, err error) QuerierResult {
+	if errors.Is(err, ErrNotFound) {
+		return notFoundResult(nil)
+	}
 	if err == nil {
 		return QuerierResult{
 			Ok: &QueryResponse{
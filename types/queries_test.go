@@ -2,6 +2,8 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -113,3 +115,24 @@ func TestQueryResponseWithEmptyData(t *testing.T) {
 		})
 	}
 }
+
+func TestToQuerierResultNotFound(t *testing.T) {
+	// not found is a system error, distinct from a null response
+	res := ToQuerierResult(nil, fmt.Errorf("balance of foo: %w", ErrNotFound))
+	require.Nil(t, res.Ok)
+	require.Equal(t, &SystemError{InvalidRequest: &InvalidRequest{Err: "not found", Request: []byte{}}}, res.Err)
+	bz, err := json.Marshal(res)
+	require.NoError(t, err)
+	assert.Equal(t, `{"error":{"invalid_request":{"error":"not found","request":""}}}`, string(bz))
+	res = ToQuerierResult([]byte("null"), nil)
+	require.Nil(t, res.Err)
+	require.Equal(t, &QueryResponse{Ok: []byte("null")}, res.Ok)
+
+	// other errors are returned as errors
+	res = ToQuerierResult(nil, errors.New("try again later"))
+	require.Nil(t, res.Err)
+	require.Equal(t, &QueryResponse{Err: "try again later"}, res.Ok)
+	res = ToQuerierResult(nil, NoSuchContract{Addr: "foo"})
+	require.Nil(t, res.Ok)
+	require.Equal(t, &SystemError{NoSuchContract: &NoSuchContract{Addr: "foo"}}, res.Err)
+}